@@ -1,17 +1,23 @@
 package accessqueue
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/xiaokangwang/s3emu/lgpd"
 )
 
 type AccessQueue struct {
-	uploadSynclocker  sync.WaitGroup
 	uploadWorker      *sync.WaitGroup
 	uploadCloseStatus sync.Mutex
 	uploadworkersum   int
@@ -20,18 +26,40 @@ type AccessQueue struct {
 	directLGPD        lgpd.LGPD
 	uploadChan        chan NetworkUploadTask
 	id                string
+	stagingdir        string
 	backlogSum        int64
 	totalSum          int64
 	oppulist          []lgpd.File
 	listcache         []lgpd.File
+	// pending counts the uploads not yet settled; drained is closed when
+	// it drops to zero. Both are guarded by uploadCloseStatus.
+	pending int
+	drained chan struct{}
+	// enqueuing counts the PutS calls between being let in and handing
+	// their task to the workers. It is only added to under
+	// uploadCloseStatus while working is not done.
+	enqueuing sync.WaitGroup
 }
 
+// NetworkUploadTask is an upload waiting for a worker. Its content lives in
+// the Spool file under the staging directory rather than in memory.
 type NetworkUploadTask struct {
 	Filename string
-	Content  []byte
+	Spool    string
+	Length   int64
+	Mark     string
+	Meta     lgpd.Metadata
 }
 
-func NewAccessQueue(uploadworkersum, maxbacklog int, directLGPD lgpd.LGPD, working context.Context, uploadWorker *sync.WaitGroup, id string) *AccessQueue {
+// file is how the task's object will be listed once it is stored.
+func (task NetworkUploadTask) file() lgpd.File {
+	return lgpd.File{Name: task.Filename, Length: int(task.Length), Mark: task.Mark, Metadata: task.Meta}
+}
+
+// NewAccessQueue creates a queue in front of directLGPD. Pending uploads
+// are spooled to stagingdir; an empty stagingdir uses the system default
+// temporary directory.
+func NewAccessQueue(uploadworkersum, maxbacklog int, directLGPD lgpd.LGPD, working context.Context, uploadWorker *sync.WaitGroup, id string, stagingdir string) *AccessQueue {
 	fmt.Printf("AQ Created")
 	ret := &AccessQueue{}
 	ret.uploadworkersum = uploadworkersum
@@ -41,6 +69,7 @@ func NewAccessQueue(uploadworkersum, maxbacklog int, directLGPD lgpd.LGPD, worki
 	ret.uploadWorker = uploadWorker
 	ret.uploadChan = make(chan NetworkUploadTask, ret.maxbacklog)
 	ret.id = id
+	ret.stagingdir = stagingdir
 
 	for uploadworkersum >= 0 {
 		uploadWorker.Add(1)
@@ -55,70 +84,344 @@ func (aq *AccessQueue) UploadWorker() {
 		select {
 		case Task := <-aq.uploadChan:
 			fmt.Printf("Uploading: %v->%v;\n", aq.id, Task.Filename)
-			aq.directLGPD.Put(Task.Filename, Task.Content)
-			aq.uploadSynclocker.Done()
+			err := aq.upload(Task)
+			aq.settle(Task, err)
 			currentBacklog := atomic.AddInt64(&aq.backlogSum, -1)
 			totalsum := atomic.LoadInt64(&aq.totalSum)
 			fmt.Printf("Uploaded: %v->%v; Backlog %v, Total %v\n", aq.id, Task.Filename, currentBacklog, totalsum)
 		case <-aq.working.Done():
-			aq.uploadCloseStatus.Lock()
 			aq.Finishup()
-			aq.uploadCloseStatus.Unlock()
 			aq.uploadWorker.Done()
 			return
 		}
 	}
 }
 
+// Finishup uploads what is left in the queue once the queue has stopped
+// working. Each upload is settled as a worker would, so that nothing waiting
+// on the pending uploads is left blocked. It must not be called with
+// uploadCloseStatus held.
 func (aq *AccessQueue) Finishup() {
+	// Once the lock has been taken, no PutS is let in any more; those that
+	// were are waited for, so that no task reaches the queue after it has
+	// been drained.
+	aq.uploadCloseStatus.Lock()
+	aq.uploadCloseStatus.Unlock()
+	aq.enqueuing.Wait()
 	for {
 		select {
 		case Task := <-aq.uploadChan:
-			aq.directLGPD.Put(Task.Filename, Task.Content)
+			aq.settle(Task, aq.upload(Task))
+			atomic.AddInt64(&aq.backlogSum, -1)
 		default:
 			return
 		}
 	}
 }
 
-func (aq *AccessQueue) Put(key string, value []byte) error {
+func (aq *AccessQueue) upload(task NetworkUploadTask) error {
+	defer os.Remove(task.Spool)
+	f, err := os.Open(task.Spool)
+	if err != nil {
+		fmt.Printf("Upload Failed: %v->%v; %v\n", aq.id, task.Filename, err)
+		return err
+	}
+	defer f.Close()
+	err = aq.directLGPD.PutS(context.Background(), task.Filename, f, task.Length, task.Meta)
+	if err != nil {
+		fmt.Printf("Upload Failed: %v->%v; %v\n", aq.id, task.Filename, err)
+	}
+	return err
+}
+
+// settle takes a finished upload off the pending list and, if it made it to
+// the backend, records it in the cached listing.
+func (aq *AccessQueue) settle(task NetworkUploadTask, err error) {
+	aq.uploadCloseStatus.Lock()
+	defer aq.uploadCloseStatus.Unlock()
+	file := task.file()
+	aq.unlist(file)
+	aq.finish()
+	if err != nil || aq.listcache == nil {
+		return
+	}
+	for i, cached := range aq.listcache {
+		if cached.Name == file.Name {
+			aq.listcache[i] = file
+			return
+		}
+	}
+	aq.listcache = append(aq.listcache, file)
+}
+
+// begin counts an upload as pending. The caller holds uploadCloseStatus.
+func (aq *AccessQueue) begin() {
+	if aq.pending == 0 {
+		aq.drained = make(chan struct{})
+	}
+	aq.pending++
+}
+
+// finish counts a pending upload as settled. The caller holds
+// uploadCloseStatus.
+func (aq *AccessQueue) finish() {
+	if aq.pending--; aq.pending == 0 {
+		close(aq.drained)
+	}
+}
+
+// unlist removes file from the pending list. The caller holds
+// uploadCloseStatus.
+func (aq *AccessQueue) unlist(file lgpd.File) {
+	for i, pending := range aq.oppulist {
+		if pending.Name == file.Name && pending.Mark == file.Mark && pending.ModTime.Equal(file.ModTime) {
+			aq.oppulist = append(aq.oppulist[:i:i], aq.oppulist[i+1:]...)
+			return
+		}
+	}
+}
+
+func (aq *AccessQueue) Put(ctx context.Context, key string, value []byte) error {
+	return aq.PutS(ctx, key, bytes.NewReader(value), int64(len(value)), lgpd.Metadata{})
+}
+
+// PutS spools value to the staging directory and queues it for upload,
+// returning once it is queued. The upload itself is not bound to ctx: once
+// accepted it is carried through, even across shutdown. The object is
+// stamped with the time it was accepted rather than the time it reaches
+// the backend.
+func (aq *AccessQueue) PutS(ctx context.Context, key string, value io.Reader, size int64, meta lgpd.Metadata) error {
+	// the backend would only turn meta down once the upload is queued
+	if err := lgpd.CheckMetadata(aq.directLGPD, meta); err != nil {
+		return err
+	}
+	spool, length, mark, err := aq.spool(value)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && length != size {
+		os.Remove(spool)
+		return io.ErrUnexpectedEOF
+	}
+
 	aq.uploadCloseStatus.Lock()
 
 	if aq.working.Err() != nil {
+		aq.uploadCloseStatus.Unlock()
+		os.Remove(spool)
 		return aq.working.Err()
 	}
+	if ctx.Err() != nil {
+		aq.uploadCloseStatus.Unlock()
+		os.Remove(spool)
+		return ctx.Err()
+	}
 
-	task := NetworkUploadTask{Filename: key, Content: value}
-	aq.uploadSynclocker.Add(1)
+	if meta.ModTime.IsZero() {
+		meta.ModTime = time.Now()
+	}
+	task := NetworkUploadTask{Filename: key, Spool: spool, Length: length, Mark: mark, Meta: meta}
+	aq.begin()
 	totalsum := atomic.AddInt64(&aq.totalSum, 1)
 	currentBacklog := atomic.AddInt64(&aq.backlogSum, 1)
 	fmt.Printf("Upload Queued: %v->%v; Backlog %v, Total %v\n", aq.id, key, currentBacklog, totalsum)
-	aq.uploadChan <- task
-	aq.oppulist = append(aq.oppulist, lgpd.File{Name: key, Length: len(value)})
+	aq.oppulist = append(aq.oppulist, task.file())
+	aq.enqueuing.Add(1)
+	aq.uploadCloseStatus.Unlock()
+	defer aq.enqueuing.Done()
+
+	// The lock must not be held while waiting for room in the queue: the
+	// workers need it to settle the uploads that would make that room.
+	select {
+	case aq.uploadChan <- task:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-aq.working.Done():
+		err = aq.working.Err()
+	}
+	aq.uploadCloseStatus.Lock()
+	aq.unlist(task.file())
+	aq.finish()
 	aq.uploadCloseStatus.Unlock()
-	return nil
+	atomic.AddInt64(&aq.totalSum, -1)
+	atomic.AddInt64(&aq.backlogSum, -1)
+	os.Remove(spool)
+	return err
+}
+
+// spool copies value into a new file in the staging directory, returning
+// its path, length and MD5.
+func (aq *AccessQueue) spool(value io.Reader) (string, int64, string, error) {
+	f, err := ioutil.TempFile(aq.stagingdir, "aq-"+aq.id+"-")
+	if err != nil {
+		return "", 0, "", err
+	}
+	hash := md5.New()
+	length, err := io.Copy(io.MultiWriter(f, hash), value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, "", err
+	}
+	return f.Name(), length, hex.EncodeToString(hash.Sum(nil)), nil
 }
-func (aq *AccessQueue) Get(key string, nofetch bool) ([]byte, lgpd.File, error) {
-	aq.uploadSynclocker.Wait()
-	return aq.directLGPD.Get(key, nofetch)
+func (aq *AccessQueue) Get(ctx context.Context, key string, nofetch bool) ([]byte, lgpd.File, error) {
+	if err := aq.waitUploads(ctx); err != nil {
+		return nil, lgpd.File{}, err
+	}
+	return aq.directLGPD.Get(ctx, key, nofetch)
 }
-func (aq *AccessQueue) GetS(key string, nofetch bool) (io.ReadCloser, lgpd.File, error) {
-	aq.uploadSynclocker.Wait()
-	return aq.directLGPD.GetS(key, nofetch)
+func (aq *AccessQueue) GetS(ctx context.Context, key string, nofetch bool) (io.ReadCloser, lgpd.File, error) {
+	if err := aq.waitUploads(ctx); err != nil {
+		return nil, lgpd.File{}, err
+	}
+	return aq.directLGPD.GetS(ctx, key, nofetch)
 }
-func (aq *AccessQueue) List(perfix string) []lgpd.File {
-	if (len(aq.listcache)) == 0 {
-		aq.listcache = aq.directLGPD.List(perfix)
+func (aq *AccessQueue) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, lgpd.File, error) {
+	if err := aq.waitUploads(ctx); err != nil {
+		return nil, lgpd.File{}, err
 	}
-	result := append(aq.listcache, aq.oppulist...)
+	return aq.directLGPD.GetRange(ctx, key, offset, length)
+}
+
+// List answers from a cached listing of the backend, overlaid with the
+// uploads still waiting in the queue.
+func (aq *AccessQueue) List(ctx context.Context, perfix string) ([]lgpd.File, error) {
+	aq.uploadCloseStatus.Lock()
+	cached := aq.listcache
+	aq.uploadCloseStatus.Unlock()
+	if cached == nil {
+		list, err := aq.directLGPD.List(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		aq.uploadCloseStatus.Lock()
+		aq.listcache = list
+		aq.uploadCloseStatus.Unlock()
+		cached = list
+	}
+	aq.uploadCloseStatus.Lock()
+	result := append(append([]lgpd.File(nil), cached...), aq.oppulist...)
+	aq.uploadCloseStatus.Unlock()
 	var resultx []lgpd.File
-	dedup := make(map[string]bool)
-	for _, ctx := range result {
-		_, dup := dedup[ctx.Name]
-		dedup[ctx.Name] = true
-		if !dup {
-			resultx = append(resultx, ctx)
+	index := make(map[string]int)
+	for _, file := range result {
+		if !strings.HasPrefix(file.Name, perfix) {
+			continue
+		}
+		// later entries are newer, so they replace earlier ones
+		if i, dup := index[file.Name]; dup {
+			resultx[i] = file
+			continue
+		}
+		index[file.Name] = len(resultx)
+		resultx = append(resultx, file)
+	}
+	return resultx, nil
+}
+
+func (aq *AccessQueue) Stat(ctx context.Context, key string) (lgpd.File, error) {
+	if err := aq.waitUploads(ctx); err != nil {
+		return lgpd.File{}, err
+	}
+	return aq.directLGPD.Stat(ctx, key)
+}
+
+// Delete waits for queued uploads to land first, so a delete issued after
+// a put is never overtaken by it.
+func (aq *AccessQueue) Delete(ctx context.Context, key string) error {
+	if err := aq.waitUploads(ctx); err != nil {
+		return err
+	}
+	err := aq.directLGPD.Delete(ctx, key)
+	aq.forget(key)
+	return err
+}
+
+func (aq *AccessQueue) Rename(ctx context.Context, oldkey, newkey string) error {
+	if err := aq.waitUploads(ctx); err != nil {
+		return err
+	}
+	err := aq.directLGPD.Rename(ctx, oldkey, newkey)
+	aq.forget(oldkey, newkey)
+	return err
+}
+
+// Copy lets the backend copy by itself when it can, after queued uploads
+// have landed so that src is there to copy.
+func (aq *AccessQueue) Copy(ctx context.Context, src, dst string, meta lgpd.Metadata) error {
+	if err := aq.waitUploads(ctx); err != nil {
+		return err
+	}
+	err := lgpd.Copy(ctx, aq.directLGPD, src, aq.directLGPD, dst, meta)
+	aq.forget(dst)
+	return err
+}
+
+// DeleteBatch waits for queued uploads once for the whole batch, then lets
+// the backend delete the keys.
+func (aq *AccessQueue) DeleteBatch(ctx context.Context, keys []string) []error {
+	errs := make([]error, len(keys))
+	if err := aq.waitUploads(ctx); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	errs = lgpd.DeleteBatch(ctx, aq.directLGPD, keys)
+	aq.forget(keys...)
+	return errs
+}
+
+// CheckMetadata lets the backend turn meta down before an upload is queued
+// with it.
+func (aq *AccessQueue) CheckMetadata(meta lgpd.Metadata) error {
+	return lgpd.CheckMetadata(aq.directLGPD, meta)
+}
+
+// Flush waits until every upload queued so far has reached the backend, or
+// until ctx is done.
+func (aq *AccessQueue) Flush(ctx context.Context) error {
+	return aq.waitUploads(ctx)
+}
+
+// waitUploads blocks until every queued upload has reached the backend, or
+// until ctx is done.
+func (aq *AccessQueue) waitUploads(ctx context.Context) error {
+	aq.uploadCloseStatus.Lock()
+	pending, drained := aq.pending, aq.drained
+	aq.uploadCloseStatus.Unlock()
+	if pending == 0 {
+		return nil
+	}
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// forget drops keys from the pending upload list and invalidates the
+// cached backend listing so the next List reflects the change.
+func (aq *AccessQueue) forget(keys ...string) {
+	aq.uploadCloseStatus.Lock()
+	defer aq.uploadCloseStatus.Unlock()
+	var kept []lgpd.File
+	for _, f := range aq.oppulist {
+		drop := false
+		for _, key := range keys {
+			if f.Name == key {
+				drop = true
+			}
+		}
+		if !drop {
+			kept = append(kept, f)
 		}
 	}
-	return resultx
+	aq.oppulist = kept
+	aq.listcache = nil
 }
@@ -0,0 +1,189 @@
+package accessqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xiaokangwang/s3emu/backend/memory"
+	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/lgpd/lgpdtest"
+)
+
+// newTestQueue puts a queue in front of a memory backend, stopping its
+// workers when t is done.
+func newTestQueue(t *testing.T) *AccessQueue {
+	working, cancel := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+	aq := NewAccessQueue(2, 8, memory.NewMemoryBackend(0, 0), working, &workers, "test", t.TempDir())
+	t.Cleanup(func() {
+		cancel()
+		workers.Wait()
+	})
+	return aq
+}
+
+func TestConformance(t *testing.T) {
+	lgpdtest.RunConformance(t, func(t *testing.T) lgpd.LGPD {
+		return newTestQueue(t)
+	})
+}
+
+// gatedBackend holds every upload until its gate is closed.
+type gatedBackend struct {
+	lgpd.LGPD
+	gate chan struct{}
+}
+
+func (g *gatedBackend) PutS(ctx context.Context, key string, value io.Reader, size int64, meta lgpd.Metadata) error {
+	<-g.gate
+	return g.LGPD.PutS(ctx, key, value, size, meta)
+}
+
+func TestPendingUploads(t *testing.T) {
+	ctx := context.Background()
+	backend := &gatedBackend{LGPD: memory.NewMemoryBackend(0, 0), gate: make(chan struct{})}
+	working, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var workers sync.WaitGroup
+	aq := NewAccessQueue(1, 8, backend, working, &workers, "test", t.TempDir())
+
+	if err := aq.Put(ctx, "a", []byte("queued")); err != nil {
+		t.Fatal(err)
+	}
+	files, err := aq.List(ctx, "")
+	if err != nil || len(files) != 1 || files[0].Name != "a" || files[0].Length != 6 {
+		t.Fatalf("List while uploading = %+v, %v", files, err)
+	}
+	if _, err := backend.LGPD.Stat(ctx, "a"); !errors.Is(err, lgpd.ErrNotFound) {
+		t.Fatalf("the backend has the object before its upload: %v", err)
+	}
+
+	short, stop := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer stop()
+	if err := aq.Flush(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Flush with an upload held: %v, want context.DeadlineExceeded", err)
+	}
+
+	close(backend.gate)
+	if err := aq.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	value, _, err := backend.LGPD.Get(ctx, "a", false)
+	if err != nil || string(value) != "queued" {
+		t.Fatalf("the backend holds %q, %v", value, err)
+	}
+	cancel()
+	workers.Wait()
+}
+
+func TestShutdownSettles(t *testing.T) {
+	ctx := context.Background()
+	backend := &gatedBackend{LGPD: memory.NewMemoryBackend(0, 0), gate: make(chan struct{})}
+	working, cancel := context.WithCancel(ctx)
+	var workers sync.WaitGroup
+	aq := NewAccessQueue(0, 8, backend, working, &workers, "test", t.TempDir())
+
+	for i := 0; i < 4; i++ {
+		if err := aq.Put(ctx, fmt.Sprint(i), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	close(backend.gate)
+	workers.Wait()
+
+	// what was still queued when the queue stopped is uploaded and settled
+	short, stop := context.WithTimeout(ctx, time.Second)
+	defer stop()
+	if err := aq.Flush(short); err != nil {
+		t.Fatalf("Flush after shutdown: %v", err)
+	}
+	files, err := backend.LGPD.List(ctx, "")
+	if err != nil || len(files) != 4 {
+		t.Fatalf("the backend holds %d files, %v", len(files), err)
+	}
+	if err := aq.Put(ctx, "late", []byte("x")); err == nil {
+		t.Error("Put after shutdown succeeded")
+	}
+}
+
+func TestShutdownWhileQueueing(t *testing.T) {
+	ctx := context.Background()
+	for round := 0; round < 100; round++ {
+		working, cancel := context.WithCancel(ctx)
+		var workers sync.WaitGroup
+		staging := t.TempDir()
+		backend := memory.NewMemoryBackend(0, 0)
+		aq := NewAccessQueue(1, 64, backend, working, &workers, "test", staging)
+
+		var putters sync.WaitGroup
+		accepted := make([]bool, 16)
+		for i := range accepted {
+			putters.Add(1)
+			go func(i int) {
+				defer putters.Done()
+				accepted[i] = aq.Put(ctx, fmt.Sprint(i), []byte{byte(i)}) == nil
+			}(i)
+		}
+		cancel()
+		putters.Wait()
+		workers.Wait()
+
+		// every upload that was accepted reached the backend, and none
+		// was left behind in the staging directory
+		short, stop := context.WithTimeout(ctx, time.Second)
+		err := aq.Flush(short)
+		stop()
+		if err != nil {
+			t.Fatalf("round %d: Flush after shutdown: %v", round, err)
+		}
+		for i, ok := range accepted {
+			if _, err := backend.Stat(ctx, fmt.Sprint(i)); ok && err != nil {
+				t.Fatalf("round %d: accepted upload %d is missing: %v", round, i, err)
+			}
+		}
+		if left, _ := ioutil.ReadDir(staging); len(left) != 0 {
+			t.Fatalf("round %d: %d spool files left", round, len(left))
+		}
+	}
+}
+
+// limitedBackend keeps no metadata, as a backend with no room for it would.
+type limitedBackend struct {
+	lgpd.LGPD
+}
+
+func (limitedBackend) CheckMetadata(meta lgpd.Metadata) error {
+	if len(meta.UserMeta) != 0 {
+		return lgpd.ErrMetadataTooLarge
+	}
+	return nil
+}
+
+func TestCheckMetadata(t *testing.T) {
+	ctx := context.Background()
+	working, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var workers sync.WaitGroup
+	aq := NewAccessQueue(1, 8, limitedBackend{memory.NewMemoryBackend(0, 0)}, working, &workers, "test", t.TempDir())
+
+	meta := lgpd.Metadata{UserMeta: map[string]string{"color": "blue"}}
+	if err := lgpd.CheckMetadata(aq, meta); !errors.Is(err, lgpd.ErrMetadataTooLarge) {
+		t.Fatalf("CheckMetadata = %v, want lgpd.ErrMetadataTooLarge", err)
+	}
+	// the upload is refused at once rather than failing once queued
+	err := aq.PutS(ctx, "a", strings.NewReader("hello"), 5, meta)
+	if !errors.Is(err, lgpd.ErrMetadataTooLarge) {
+		t.Fatalf("PutS = %v, want lgpd.ErrMetadataTooLarge", err)
+	}
+	if files, err := aq.List(ctx, ""); err != nil || len(files) != 0 {
+		t.Fatalf("List after a refused upload = %+v, %v", files, err)
+	}
+}
@@ -2,24 +2,54 @@ package gdrive
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/xiaokangwang/s3emu/lgpd"
-	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// maxRetry bounds how many times a failed Drive call is retried before the
+// error is handed back to the caller.
+const maxRetry = 5
+
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// blobMimeType is the Drive mimeType of every stored object. The content
+// type of an object goes into its appProperties instead, as some mimeTypes,
+// application/vnd.google-apps.* among them, make Drive treat a file as
+// something other than the bytes uploaded.
+const blobMimeType = "application/octet-stream"
+
+// contentTypeProperty is the appProperty keeping the content type. Its
+// capitals keep it apart from the user metadata, whose names are lowercase.
+const contentTypeProperty = "Content-Type"
+
+// Drive limits on the appProperties of a file: each one may take up
+// maxPropertySize bytes of key and value, and a file may have at most
+// maxProperties of them.
+const (
+	maxPropertySize = 124
+	maxProperties   = 100
 )
 
 type GDriveBackend struct {
 	srv          *drive.Service
+	srvOnce      sync.Once
 	uploadprefix string
 }
 
@@ -27,7 +57,30 @@ func NewGDriveBackend(prefix string) *GDriveBackend {
 	return &GDriveBackend{uploadprefix: prefix}
 }
 
+// NewGDriveBackendWithClient talks to the Drive API at endpoint through
+// client instead of authorizing with credentials.json, which lets it run
+// against a stand-in such as package gdrivetest. An empty endpoint keeps
+// the default Google endpoint.
+func NewGDriveBackendWithClient(prefix, endpoint string, client *http.Client) (*GDriveBackend, error) {
+	srv, err := drive.New(client)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint != "" {
+		srv.BasePath = endpoint
+	}
+	return &GDriveBackend{srv: srv, uploadprefix: prefix}, nil
+}
+
 func (ntq *GDriveBackend) ensureToken() {
+	ntq.srvOnce.Do(func() {
+		if ntq.srv == nil {
+			ntq.authorize()
+		}
+	})
+}
+
+func (ntq *GDriveBackend) authorize() {
 	b, err := ioutil.ReadFile("credentials.json")
 	if err != nil {
 		log.Fatalf("Unable to read client secret file: %v", err)
@@ -99,125 +152,483 @@ func saveToken(path string, token *oauth2.Token) {
 	json.NewEncoder(f).Encode(token)
 }
 
-func (ntq *GDriveBackend) Put(key string, value []byte) error {
+func (ntq *GDriveBackend) Put(ctx context.Context, key string, value []byte) error {
+	return ntq.PutS(ctx, key, bytes.NewReader(value), int64(len(value)), lgpd.Metadata{})
+}
+
+// PutS streams value to Drive. The metadata goes into the Drive
+// modifiedTime and appProperties of the file. A failed upload is only
+// retried when value can be rewound, as the bytes already sent are
+// otherwise gone.
+func (ntq *GDriveBackend) PutS(ctx context.Context, key string, value io.Reader, size int64, meta lgpd.Metadata) error {
 	ntq.ensureToken()
 	var err error
 	var file drive.File
 	file.Name = key
 	file.Parents = []string{ntq.uploadprefix}
+	file.MimeType = blobMimeType
+	file.AppProperties = appProperties(meta)
+	if !meta.ModTime.IsZero() {
+		file.ModifiedTime = meta.ModTime.UTC().Format(time.RFC3339Nano)
+	}
+	options := []googleapi.MediaOption{googleapi.ContentType(blobMimeType)}
+	seeker, rewindable := value.(io.Seeker)
+	retry := 0
 EnqueueUploadTask_retry:
-	_, err = ntq.srv.Files.Create(&file).Media(bytes.NewReader(value)).Do()
+	body := &sizedReader{r: value, size: size}
+	_, err = ntq.srv.Files.Create(&file).Media(body, options...).Context(ctx).Do()
 	if err != nil {
 		fmt.Println(err)
-		goto EnqueueUploadTask_retry
+		if body.short {
+			return io.ErrUnexpectedEOF
+		}
+		if !rewindable {
+			return classify(err)
+		}
+		if _, serr := seeker.Seek(0, io.SeekStart); serr != nil {
+			return classify(err)
+		}
+		if ntq.again(ctx, &retry) {
+			goto EnqueueUploadTask_retry
+		}
+		return classify(err)
 	}
-	return nil
+	return ntq.settle(ctx, key)
+}
+
+// settle trashes every file named key but the newest one, which holds its
+// value. Drive allows many files of one name in a folder, but a key has one
+// value. Writers racing on a key all settle on the same file, where each
+// keeping its own would have them trash one another's.
+func (ntq *GDriveBackend) settle(ctx context.Context, key string) error {
+	r, err := ntq.lookup(ctx, key)
+	if err != nil || len(r.Files) == 0 {
+		return err
+	}
+	return ntq.trash(ctx, except(r.Files, newest(r.Files).Id))
+}
+
+// supersede trashes every file named key other than the one with id keep.
+func (ntq *GDriveBackend) supersede(ctx context.Context, key string, keep string) error {
+	r, err := ntq.lookup(ctx, key)
+	if err != nil {
+		return err
+	}
+	return ntq.trash(ctx, except(r.Files, keep))
+}
+
+// except returns files without the one with id keep.
+func except(files []*drive.File, keep string) []*drive.File {
+	var ret []*drive.File
+	for _, f := range files {
+		if f.Id != keep {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// newest picks the file holding the value of a key out of the files of that
+// name: the one created last, ties going to the greater id.
+func newest(files []*drive.File) *drive.File {
+	var ret *drive.File
+	var retCreated time.Time
+	for _, f := range files {
+		created, _ := time.Parse(time.RFC3339Nano, f.CreatedTime)
+		if ret == nil || created.After(retCreated) || created.Equal(retCreated) && f.Id > ret.Id {
+			ret, retCreated = f, created
+		}
+	}
+	return ret
+}
+func (ntq *GDriveBackend) Get(ctx context.Context, key string, nofetch bool) ([]byte, lgpd.File, error) {
+	body, ret, err := ntq.GetS(ctx, key, nofetch)
+	if err != nil || nofetch {
+		return nil, ret, err
+	}
+	defer body.Close()
+	c, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, ret, err
+	}
+	return c, ret, nil
+}
+
+func (ntq *GDriveBackend) GetS(ctx context.Context, key string, nofetch bool) (io.ReadCloser, lgpd.File, error) {
+	return ntq.fetch(ctx, key, nofetch, "")
 }
-func (ntq *GDriveBackend) Get(key string, nofetch bool) ([]byte, lgpd.File, error) {
+
+// GetRange asks Drive for just the wanted bytes with an HTTP Range header
+// on the media download.
+func (ntq *GDriveBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, lgpd.File, error) {
+	if offset < 0 {
+		return nil, lgpd.File{Name: key}, errors.New("invalid range")
+	}
+	byterange := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		if length == 0 {
+			_, ret, err := ntq.fetch(ctx, key, true, "")
+			return ioutil.NopCloser(bytes.NewReader(nil)), ret, err
+		}
+		byterange += fmt.Sprint(offset + length - 1)
+	}
+	return ntq.fetch(ctx, key, false, byterange)
+}
+
+func (ntq *GDriveBackend) fetch(ctx context.Context, key string, nofetch bool, byterange string) (io.ReadCloser, lgpd.File, error) {
 	ntq.ensureToken()
 	var ret lgpd.File
 	ret.Name = key
 	fn := key
-	r, err := ntq.srv.Files.List().Q("name = '" + fn + "' and '" + ntq.uploadprefix + "' in parents ").PageSize(10).
-		Fields("nextPageToken, files(*)").Do()
+	r, err := ntq.lookup(ctx, fn)
 	if err != nil {
-		log.Fatalf("Unable to retrieve files: %v", err)
+		return nil, ret, err
 	}
 
 	if len(r.Files) == 0 {
-		return nil, ret, errors.New("File not found")
+		return nil, ret, lgpd.ErrNotFound
 	}
 
-	did := r.Files[0].Id
-
-	ret.Length = int(r.Files[0].Size)
-	ret.Mark = r.Files[0].Md5Checksum
+	found := newest(r.Files)
+	did := found.Id
+	ret = describe(found)
 
 	if nofetch {
 		return nil, ret, nil
 	}
 
 	abuseFlag := false
+	retry := 0
 EnqueueDownloadTask_download:
 	fd := ntq.srv.Files.Get(did)
-	resp, err := fd.AcknowledgeAbuse(abuseFlag).Download()
+	if byterange != "" {
+		fd.Header().Set("Range", byterange)
+	}
+	resp, err := fd.AcknowledgeAbuse(abuseFlag).Context(ctx).Download()
 	if err != nil {
 		if !abuseFlag {
 			abuseFlag = true
 			goto EnqueueDownloadTask_download
 		}
-		goto EnqueueDownloadTask_download
+		if ntq.again(ctx, &retry) {
+			goto EnqueueDownloadTask_download
+		}
+		return nil, ret, classify(err)
 	}
-	c, err := ioutil.ReadAll(resp.Body)
+	return resp.Body, ret, nil
+}
+
+func (ntq *GDriveBackend) List(ctx context.Context, perfix string) ([]lgpd.File, error) {
+	ntq.ensureToken()
+	var ret []lgpd.File
+	var nextpageToken string
+
+FetchPage:
+	r, err := ntq.srv.Files.List().Q("'" + ntq.uploadprefix + "' in parents and trashed = false").PageToken(nextpageToken).PageSize(1000).
+		Fields("nextPageToken, files(*)").Context(ctx).Do()
 	if err != nil {
-		goto EnqueueDownloadTask_download
+		return nil, classify(err)
 	}
-	resp.Body.Close()
+	nextpageToken = r.NextPageToken
 
-	return c, ret, nil
+	for _, i := range r.Files {
+		if !strings.HasPrefix(i.Name, perfix) {
+			continue
+		}
+		ret = append(ret, describe(i))
+	}
+
+	if nextpageToken != "" {
+		goto FetchPage
+	}
+	return ret, nil
+}
+
+func (ntq *GDriveBackend) Stat(ctx context.Context, key string) (lgpd.File, error) {
+	_, ret, err := ntq.GetS(ctx, key, true)
+	return ret, err
 }
 
-func (ntq *GDriveBackend) GetS(key string, nofetch bool) (io.ReadCloser, lgpd.File, error) {
+// Delete moves every file named key in the upload folder to the trash,
+// so that an accidental delete can still be recovered from Drive.
+func (ntq *GDriveBackend) Delete(ctx context.Context, key string) error {
 	ntq.ensureToken()
-	var ret lgpd.File
-	ret.Name = key
-	fn := key
-	r, err := ntq.srv.Files.List().Q("name = '" + fn + "' and '" + ntq.uploadprefix + "' in parents ").PageSize(10).
-		Fields("nextPageToken, files(*)").Do()
+	r, err := ntq.lookup(ctx, key)
 	if err != nil {
-		log.Fatalf("Unable to retrieve files: %v", err)
+		return err
 	}
-
 	if len(r.Files) == 0 {
-		return nil, ret, errors.New("File not found")
+		return lgpd.ErrNotFound
 	}
+	return ntq.trash(ctx, r.Files)
+}
 
-	did := r.Files[0].Id
-
-	ret.Length = int(r.Files[0].Size)
-	ret.Mark = r.Files[0].Md5Checksum
-
-	if nofetch {
-		return nil, ret, nil
+// Rename gives the file named oldkey the name newkey, replacing whatever
+// was stored under newkey before. What newkey held is only trashed once the
+// rename went through, so a failed rename loses neither.
+func (ntq *GDriveBackend) Rename(ctx context.Context, oldkey, newkey string) error {
+	ntq.ensureToken()
+	r, err := ntq.lookup(ctx, oldkey)
+	if err != nil {
+		return err
+	}
+	if len(r.Files) == 0 {
+		return lgpd.ErrNotFound
 	}
+	if oldkey == newkey {
+		return nil
+	}
+	id := newest(r.Files).Id
+	if _, err := ntq.srv.Files.Update(id, &drive.File{Name: newkey}).Context(ctx).Do(); err != nil {
+		return classify(err)
+	}
+	return ntq.supersede(ctx, newkey, id)
+}
 
-	abuseFlag := false
-EnqueueDownloadTask_download:
-	fd := ntq.srv.Files.Get(did)
-	resp, err := fd.AcknowledgeAbuse(abuseFlag).Download()
+// Copy has Drive duplicate the file named src as dst, so no content is
+// transferred. Drive merges the appProperties given for the copy into those
+// of src, so the ones meta leaves out are cleared explicitly.
+func (ntq *GDriveBackend) Copy(ctx context.Context, src, dst string, meta lgpd.Metadata) error {
+	ntq.ensureToken()
+	r, err := ntq.lookup(ctx, src)
 	if err != nil {
-		if !abuseFlag {
-			abuseFlag = true
-			goto EnqueueDownloadTask_download
+		return err
+	}
+	if len(r.Files) == 0 {
+		return lgpd.ErrNotFound
+	}
+	source := newest(r.Files)
+	file := &drive.File{
+		Name:          dst,
+		Parents:       []string{ntq.uploadprefix},
+		MimeType:      blobMimeType,
+		AppProperties: appProperties(meta),
+	}
+	if !meta.ModTime.IsZero() {
+		file.ModifiedTime = meta.ModTime.UTC().Format(time.RFC3339Nano)
+	}
+	for name := range source.AppProperties {
+		if _, kept := file.AppProperties[name]; !kept {
+			file.NullFields = append(file.NullFields, "AppProperties."+name)
 		}
-		goto EnqueueDownloadTask_download
 	}
-	return resp.Body, ret, nil
+	_, err = ntq.srv.Files.Copy(source.Id, file).Context(ctx).Do()
+	if err != nil {
+		return classify(err)
+	}
+	return ntq.settle(ctx, dst)
 }
 
-func (ntq *GDriveBackend) List(perfix string) []lgpd.File {
+// Folders returns a backend for each folder inside the upload folder,
+// keyed by the folder name.
+func (ntq *GDriveBackend) Folders(ctx context.Context) (map[string]*GDriveBackend, error) {
 	ntq.ensureToken()
-	var ret []lgpd.File
+	ret := make(map[string]*GDriveBackend)
 	var nextpageToken string
 
 FetchPage:
-	r, err := ntq.srv.Files.List().Q("'" + ntq.uploadprefix + "' in parents ").PageToken(nextpageToken).PageSize(1000).
-		Fields("nextPageToken, files(*)").Do()
+	r, err := ntq.srv.Files.List().Q("'" + ntq.uploadprefix + "' in parents and mimeType = '" + folderMimeType + "' and trashed = false").
+		PageToken(nextpageToken).PageSize(1000).Fields("nextPageToken, files(id, name)").Context(ctx).Do()
 	if err != nil {
-		log.Fatalf("Unable to retrieve files: %v", err)
+		return nil, classify(err)
 	}
 	nextpageToken = r.NextPageToken
 
 	for _, i := range r.Files {
-		var retx lgpd.File
-		retx.Name = i.Name
-		retx.Length = int(i.Size)
-		retx.Mark = i.Md5Checksum
-		ret = append(ret, retx)
+		if _, dup := ret[i.Name]; dup {
+			log.Printf("gdrive: more than one folder called %q, using the first", i.Name)
+			continue
+		}
+		ret[i.Name] = ntq.sub(i.Id)
 	}
 
 	if nextpageToken != "" {
 		goto FetchPage
 	}
+	return ret, nil
+}
+
+// CreateFolder makes a folder called name inside the upload folder and
+// returns a backend storing into it. It fails with lgpd.ErrExists if there
+// is such a folder already.
+func (ntq *GDriveBackend) CreateFolder(ctx context.Context, name string) (*GDriveBackend, error) {
+	ntq.ensureToken()
+	r, err := ntq.srv.Files.List().Q("name = '" + quote(name) + "' and '" + ntq.uploadprefix + "' in parents and mimeType = '" + folderMimeType + "' and trashed = false").
+		PageSize(1).Fields("files(id)").Context(ctx).Do()
+	if err != nil {
+		return nil, classify(err)
+	}
+	if len(r.Files) != 0 {
+		return nil, lgpd.ErrExists
+	}
+	folder := &drive.File{Name: name, MimeType: folderMimeType, Parents: []string{ntq.uploadprefix}}
+	created, err := ntq.srv.Files.Create(folder).Fields("id").Context(ctx).Do()
+	if err != nil {
+		return nil, classify(err)
+	}
+	return ntq.sub(created.Id), nil
+}
+
+// RemoveFolder moves the upload folder, with whatever is left in it, to
+// the trash.
+func (ntq *GDriveBackend) RemoveFolder(ctx context.Context) error {
+	ntq.ensureToken()
+	return ntq.trash(ctx, []*drive.File{{Id: ntq.uploadprefix}})
+}
+
+// sub is a backend for the folder with id, sharing this backend's
+// connection to Drive.
+func (ntq *GDriveBackend) sub(id string) *GDriveBackend {
+	return &GDriveBackend{srv: ntq.srv, uploadprefix: id}
+}
+
+func (ntq *GDriveBackend) trash(ctx context.Context, files []*drive.File) error {
+	for _, f := range files {
+		_, err := ntq.srv.Files.Update(f.Id, &drive.File{Trashed: true}).Context(ctx).Do()
+		if err != nil {
+			return classify(err)
+		}
+	}
+	return nil
+}
+
+// CheckMetadata turns down meta if Drive could not keep it in the
+// appProperties of a file.
+func (ntq *GDriveBackend) CheckMetadata(meta lgpd.Metadata) error {
+	properties := appProperties(meta)
+	if len(properties) > maxProperties {
+		return lgpd.ErrMetadataTooLarge
+	}
+	for name, value := range properties {
+		if len(name)+len(value) > maxPropertySize {
+			return lgpd.ErrMetadataTooLarge
+		}
+	}
+	return nil
+}
+
+// appProperties returns the Drive appProperties keeping meta, the content
+// type included.
+func appProperties(meta lgpd.Metadata) map[string]string {
+	ret := make(map[string]string, len(meta.UserMeta)+1)
+	for name, value := range meta.UserMeta {
+		ret[name] = value
+	}
+	if meta.ContentType != "" {
+		ret[contentTypeProperty] = meta.ContentType
+	}
+	return ret
+}
+
+// describe turns the Drive view of a file into ours. Files put before the
+// content type moved into the appProperties still have it as their mimeType.
+func describe(f *drive.File) lgpd.File {
+	ret := lgpd.File{Name: f.Name, Length: int(f.Size), Mark: f.Md5Checksum}
+	if contentType, ok := f.AppProperties[contentTypeProperty]; ok {
+		ret.ContentType = contentType
+	} else if f.MimeType != blobMimeType {
+		ret.ContentType = f.MimeType
+	}
+	for name, value := range f.AppProperties {
+		if name == contentTypeProperty {
+			continue
+		}
+		if ret.UserMeta == nil {
+			ret.UserMeta = make(map[string]string, len(f.AppProperties))
+		}
+		ret.UserMeta[name] = value
+	}
+	ret.ModTime, _ = time.Parse(time.RFC3339Nano, f.ModifiedTime)
 	return ret
 }
+
+// lookup finds the live files named key in the upload folder, going
+// through every page so that none of them is missed.
+func (ntq *GDriveBackend) lookup(ctx context.Context, key string) (*drive.FileList, error) {
+	ret := &drive.FileList{}
+	var nextpageToken string
+
+FetchPage:
+	r, err := ntq.srv.Files.List().Q("name = '" + quote(key) + "' and '" + ntq.uploadprefix + "' in parents and trashed = false").
+		PageToken(nextpageToken).PageSize(1000).Fields("nextPageToken, files(*)").Context(ctx).Do()
+	if err != nil {
+		return nil, classify(err)
+	}
+	ret.Files = append(ret.Files, r.Files...)
+	nextpageToken = r.NextPageToken
+	if nextpageToken != "" {
+		goto FetchPage
+	}
+	return ret, nil
+}
+
+// again reports whether a failed call should be retried, sleeping a little
+// longer each time. It gives up once maxRetry is reached or ctx is done.
+func (ntq *GDriveBackend) again(ctx context.Context, retry *int) bool {
+	*retry++
+	if *retry > maxRetry {
+		return false
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(time.Duration(*retry) * time.Second):
+		return true
+	}
+}
+
+// classify marks the Drive failures that are expected to pass, such as
+// rate limiting, server errors and network trouble, as
+// lgpd.ErrBackendUnavailable. A file that vanished between lookup and use
+// becomes lgpd.ErrNotFound.
+func classify(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	var apierr *googleapi.Error
+	if errors.As(err, &apierr) {
+		switch {
+		case apierr.Code == http.StatusNotFound:
+			return fmt.Errorf("%w: %v", lgpd.ErrNotFound, err)
+		case apierr.Code == http.StatusTooManyRequests || apierr.Code >= 500:
+			return fmt.Errorf("%w: %v", lgpd.ErrBackendUnavailable, err)
+		case apierr.Code == http.StatusForbidden:
+			for _, item := range apierr.Errors {
+				if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+					return fmt.Errorf("%w: %v", lgpd.ErrBackendUnavailable, err)
+				}
+			}
+		}
+		return err
+	}
+	var neterr net.Error
+	if errors.As(err, &neterr) {
+		return fmt.Errorf("%w: %v", lgpd.ErrBackendUnavailable, err)
+	}
+	return err
+}
+
+// sizedReader fails with io.ErrUnexpectedEOF if r ends before size bytes,
+// so that an upload cut short is not stored as if it were whole. A
+// negative size is not checked.
+type sizedReader struct {
+	r     io.Reader
+	size  int64
+	read  int64
+	short bool
+}
+
+func (sr *sizedReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.read += int64(n)
+	if err == io.EOF && sr.size >= 0 && sr.read < sr.size {
+		sr.short = true
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// quote escapes a value for use inside a single quoted Drive query string.
+func quote(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(s)
+}
@@ -0,0 +1,197 @@
+package gdrive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/xiaokangwang/s3emu/backend/gdrive/gdrivetest"
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+func newTestBackend(t *testing.T) (*GDriveBackend, *gdrivetest.Server) {
+	fake := gdrivetest.NewServer()
+	t.Cleanup(fake.Close)
+	backend, err := NewGDriveBackendWithClient(fake.AddFolder("bucket"), fake.Endpoint(), fake.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend, fake
+}
+
+func TestPutGet(t *testing.T) {
+	ctx := context.Background()
+	backend, fake := newTestBackend(t)
+	if err := backend.Put(ctx, "a", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	value, file, err := backend.Get(ctx, "a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "hello" || file.Length != 5 || file.Mark != "5d41402abc4b2a76b9719d911017c592" {
+		t.Fatalf("Get returned %q, %+v", value, file)
+	}
+
+	// the upload went through the media endpoint, so Drive has the bytes
+	files := fake.Files()
+	if len(files) != 2 || files[1].Name != "a" || files[1].Size != 5 {
+		t.Fatalf("Drive holds %+v", files)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	ctx := context.Background()
+	backend, fake := newTestBackend(t)
+	meta := lgpd.Metadata{ContentType: "application/vnd.google-apps.document", UserMeta: map[string]string{"color": "blue"}}
+	if err := backend.PutS(ctx, "a", bytes.NewReader([]byte("hello")), 5, meta); err != nil {
+		t.Fatal(err)
+	}
+	// the content type is kept aside, so Drive sees only bytes
+	files := fake.Files()
+	if len(files) != 2 || files[1].MimeType != "application/octet-stream" {
+		t.Fatalf("Drive holds %+v", files)
+	}
+	file, err := backend.Stat(ctx, "a")
+	if err != nil || file.ContentType != meta.ContentType || len(file.UserMeta) != 1 || file.UserMeta["color"] != "blue" {
+		t.Fatalf("Stat = %+v, %v", file, err)
+	}
+
+	if err := backend.Copy(ctx, "a", "b", lgpd.Metadata{UserMeta: map[string]string{"size": "large"}}); err != nil {
+		t.Fatal(err)
+	}
+	file, err = backend.Stat(ctx, "b")
+	if err != nil || file.ContentType != "" || len(file.UserMeta) != 1 || file.UserMeta["size"] != "large" {
+		t.Fatalf("Stat of the copy = %+v, %v", file, err)
+	}
+
+	long := lgpd.Metadata{UserMeta: map[string]string{"long": string(bytes.Repeat([]byte("x"), 121))}}
+	if err := backend.CheckMetadata(long); !errors.Is(err, lgpd.ErrMetadataTooLarge) {
+		t.Fatalf("CheckMetadata of a long value: %v, want lgpd.ErrMetadataTooLarge", err)
+	}
+	if err := backend.PutS(ctx, "c", bytes.NewReader(nil), 0, long); err == nil {
+		t.Fatal("Drive took a long value")
+	}
+	long.UserMeta["long"] = long.UserMeta["long"][:120]
+	if err := backend.CheckMetadata(long); err != nil {
+		t.Fatalf("CheckMetadata of a value at the limit: %v", err)
+	}
+}
+
+func TestQuotedNames(t *testing.T) {
+	ctx := context.Background()
+	backend, _ := newTestBackend(t)
+	for _, key := range []string{`it's`, `back\slash`, `' or name contains '`} {
+		if err := backend.Put(ctx, key, []byte(key)); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+	for _, key := range []string{`it's`, `back\slash`, `' or name contains '`} {
+		value, _, err := backend.Get(ctx, key, false)
+		if err != nil || string(value) != key {
+			t.Fatalf("Get(%q) = %q, %v", key, value, err)
+		}
+	}
+	if _, err := backend.Stat(ctx, "it"); !errors.Is(err, lgpd.ErrNotFound) {
+		t.Fatalf("Stat of a prefix of a name: %v, want lgpd.ErrNotFound", err)
+	}
+}
+
+func TestListPaging(t *testing.T) {
+	ctx := context.Background()
+	backend, fake := newTestBackend(t)
+	fake.LimitPages(3)
+	for i := 0; i < 10; i++ {
+		if err := backend.Put(ctx, fmt.Sprintf("key%02d", i), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := backend.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 10 {
+		t.Fatalf("List returned %d files over several pages, want 10", len(files))
+	}
+	files, err = backend.List(ctx, "key0")
+	if err != nil || len(files) != 10 {
+		t.Fatalf("List(key0) returned %d files, %v", len(files), err)
+	}
+
+	folders, err := backend.Folders(ctx)
+	if err != nil || len(folders) != 0 {
+		t.Fatalf("Folders = %v, %v", folders, err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := backend.CreateFolder(ctx, fmt.Sprintf("sub%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	folders, err = backend.Folders(ctx)
+	if err != nil || len(folders) != 5 {
+		t.Fatalf("Folders returned %d folders, %v", len(folders), err)
+	}
+	if _, err := backend.CreateFolder(ctx, "sub0"); !errors.Is(err, lgpd.ErrExists) {
+		t.Fatalf("CreateFolder of an existing folder: %v, want lgpd.ErrExists", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits out a retry")
+	}
+	ctx := context.Background()
+	backend, fake := newTestBackend(t)
+	fake.FailNext(1)
+	if err := backend.PutS(ctx, "a", bytes.NewReader([]byte("hello")), 5, lgpd.Metadata{}); err != nil {
+		t.Fatalf("PutS did not retry a failed upload: %v", err)
+	}
+	value, _, err := backend.Get(ctx, "a", false)
+	if err != nil || string(value) != "hello" {
+		t.Fatalf("Get = %q, %v", value, err)
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	ctx := context.Background()
+	backend, fake := newTestBackend(t)
+	if err := backend.Put(ctx, "a", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	fake.FailNext(1)
+	if _, err := backend.Stat(ctx, "a"); !errors.Is(err, lgpd.ErrBackendUnavailable) {
+		t.Fatalf("Stat while Drive fails: %v, want lgpd.ErrBackendUnavailable", err)
+	}
+	// a reader that cannot be rewound is not retried
+	fake.FailNext(1)
+	body := io.MultiReader(bytes.NewReader([]byte("x")))
+	if err := backend.PutS(ctx, "b", body, 1, lgpd.Metadata{}); !errors.Is(err, lgpd.ErrBackendUnavailable) {
+		t.Fatalf("PutS while Drive fails: %v, want lgpd.ErrBackendUnavailable", err)
+	}
+}
+
+func TestAbusiveDownload(t *testing.T) {
+	ctx := context.Background()
+	backend, fake := newTestBackend(t)
+	if err := backend.Put(ctx, "flagged", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	fake.MarkAbusive("flagged")
+	value, _, err := backend.Get(ctx, "flagged", false)
+	if err != nil || string(value) != "content" {
+		t.Fatalf("Get of a flagged file = %q, %v", value, err)
+	}
+	body, _, err := backend.GetRange(ctx, "flagged", 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	var got bytes.Buffer
+	got.ReadFrom(body)
+	if got.String() != "nte" {
+		t.Fatalf("GetRange of a flagged file = %q", got.String())
+	}
+}
@@ -0,0 +1,15 @@
+package gdrive
+
+import (
+	"testing"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/lgpd/lgpdtest"
+)
+
+func TestConformance(t *testing.T) {
+	lgpdtest.RunConformance(t, func(t *testing.T) lgpd.LGPD {
+		backend, _ := newTestBackend(t)
+		return backend
+	})
+}
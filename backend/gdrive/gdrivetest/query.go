@@ -0,0 +1,133 @@
+package gdrivetest
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// parseQuery compiles the subset of the Drive search syntax the backend
+// uses: terms joined by "and", each one of
+//
+//	name = 'x'   name != 'x'   name contains 'x'
+//	mimeType = 'x'   mimeType != 'x'
+//	'x' in parents
+//	trashed = true   trashed = false
+//
+// Anything else is rejected, so a query the fake cannot answer faithfully
+// fails loudly instead of matching the wrong files.
+func parseQuery(q string) (func(*drive.File) bool, error) {
+	tokens, err := tokenize(q)
+	if err != nil {
+		return nil, err
+	}
+	var terms []func(*drive.File) bool
+	for len(tokens) > 0 {
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("incomplete term in query %q", q)
+		}
+		term, err := parseTerm(tokens[0], tokens[1], tokens[2])
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+		tokens = tokens[3:]
+		if len(tokens) > 0 {
+			if tokens[0].quoted || tokens[0].text != "and" {
+				return nil, fmt.Errorf("only \"and\" may join terms in query %q", q)
+			}
+			tokens = tokens[1:]
+			if len(tokens) == 0 {
+				return nil, fmt.Errorf("dangling \"and\" in query %q", q)
+			}
+		}
+	}
+	return func(f *drive.File) bool {
+		for _, term := range terms {
+			if !term(f) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+type token struct {
+	text   string
+	quoted bool
+}
+
+func tokenize(q string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(q); {
+		switch c := q[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '\'':
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(q) {
+					return nil, fmt.Errorf("unterminated string in query %q", q)
+				}
+				if q[i] == '\\' && i+1 < len(q) {
+					b.WriteByte(q[i+1])
+					i += 2
+					continue
+				}
+				if q[i] == '\'' {
+					i++
+					break
+				}
+				b.WriteByte(q[i])
+				i++
+			}
+			tokens = append(tokens, token{text: b.String(), quoted: true})
+		default:
+			start := i
+			for i < len(q) && q[i] != ' ' && q[i] != '\t' && q[i] != '\n' && q[i] != '\'' {
+				i++
+			}
+			tokens = append(tokens, token{text: q[start:i]})
+		}
+	}
+	return tokens, nil
+}
+
+func parseTerm(a, op, b token) (func(*drive.File) bool, error) {
+	if a.quoted && op.text == "in" && !b.quoted && b.text == "parents" {
+		parent := a.text
+		return func(f *drive.File) bool {
+			for _, p := range f.Parents {
+				if p == parent {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	if a.quoted || op.quoted {
+		return nil, fmt.Errorf("unsupported term %v %v %v", a.text, op.text, b.text)
+	}
+	switch {
+	case a.text == "trashed" && op.text == "=" && !b.quoted && (b.text == "true" || b.text == "false"):
+		want := b.text == "true"
+		return func(f *drive.File) bool { return f.Trashed == want }, nil
+	case (a.text == "name" || a.text == "mimeType") && b.quoted:
+		field := func(f *drive.File) string { return f.Name }
+		if a.text == "mimeType" {
+			field = func(f *drive.File) string { return f.MimeType }
+		}
+		value := b.text
+		switch op.text {
+		case "=":
+			return func(f *drive.File) bool { return field(f) == value }, nil
+		case "!=":
+			return func(f *drive.File) bool { return field(f) != value }, nil
+		case "contains":
+			return func(f *drive.File) bool { return strings.Contains(field(f), value) }, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported term %v %v %v", a.text, op.text, b.text)
+}
@@ -0,0 +1,564 @@
+// Package gdrivetest provides an in-process stand-in for the parts of the
+// Drive v3 API that backend/gdrive uses, so the backend can be exercised
+// without a Google account:
+//
+//	fake := gdrivetest.NewServer()
+//	defer fake.Close()
+//	backend, err := gdrive.NewGDriveBackendWithClient(fake.AddFolder("bucket"), fake.Endpoint(), fake.Client())
+package gdrivetest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// maxPropertySize is the most bytes Drive takes for the key and value of
+// one appProperty.
+const maxPropertySize = 124
+
+type file struct {
+	meta    drive.File
+	content []byte
+	abusive bool
+}
+
+type session struct {
+	meta    drive.File
+	content bytes.Buffer
+}
+
+// Server is a fake Drive v3 endpoint. It keeps files in memory and
+// understands files.list (with the name, parents, trashed and mimeType
+// terms of q), files.create (plain, multipart and resumable), files.get
+// (with alt=media and Range), files.update (with or without media),
+// files.delete and files.copy. Media goes through the /upload/drive/v3
+// paths, as the Drive client sends it. It turns down appProperties larger
+// than Drive allows.
+type Server struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	files    map[string]*file
+	order    []string
+	sessions map[string]*session
+	nextID   int
+	failing  int
+	pageMax  int
+}
+
+var (
+	fileRoute    = regexp.MustCompile(`^/drive/v3/files/([^/]+)$`)
+	copyRoute    = regexp.MustCompile(`^/drive/v3/files/([^/]+)/copy$`)
+	uploadRoute  = regexp.MustCompile(`^/upload/drive/v3/files/([^/]+)$`)
+	sessionRoute = regexp.MustCompile(`^/upload/session/([^/]+)$`)
+)
+
+func NewServer() *Server {
+	s := &Server{files: make(map[string]*file), sessions: make(map[string]*session)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Endpoint is the base path to hand to the Drive client.
+func (s *Server) Endpoint() string {
+	return s.URL + "/drive/v3/"
+}
+
+// AddFolder creates a folder and returns its id.
+func (s *Server) AddFolder(name string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.store(drive.File{Name: name, MimeType: folderMimeType}, nil).meta.Id
+}
+
+// MarkAbusive flags every file named name, so downloading it fails unless
+// the request acknowledges the abuse risk, as Drive does for flagged files.
+func (s *Server) MarkAbusive(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, f := range s.files {
+		if f.meta.Name == name {
+			f.abusive = true
+		}
+	}
+}
+
+// FailNext makes the next n requests fail with 503 Service Unavailable.
+func (s *Server) FailNext(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failing = n
+}
+
+// LimitPages makes files.list return at most n files a page, whatever page
+// size was asked for, as Drive itself may. Zero lifts the limit.
+func (s *Server) LimitPages(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pageMax = n
+}
+
+// Files returns every file ever created, trashed ones included, in order
+// of creation.
+func (s *Server) Files() []drive.File {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var ret []drive.File
+	for _, id := range s.order {
+		if f, ok := s.files[id]; ok {
+			ret = append(ret, f.meta)
+		}
+	}
+	return ret
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.failing > 0 {
+		s.failing--
+		writeError(w, http.StatusServiceUnavailable, "backendError", "Backend Error")
+		return
+	}
+
+	path := r.URL.Path
+	switch {
+	case path == "/drive/v3/files" && r.Method == "GET":
+		s.list(w, r)
+	case (path == "/drive/v3/files" || path == "/upload/drive/v3/files") && r.Method == "POST":
+		s.create(w, r)
+	case uploadRoute.MatchString(path) && r.Method == "PATCH":
+		s.update(w, r, uploadRoute.FindStringSubmatch(path)[1])
+	case copyRoute.MatchString(path) && r.Method == "POST":
+		s.copy(w, r, copyRoute.FindStringSubmatch(path)[1])
+	case fileRoute.MatchString(path):
+		id := fileRoute.FindStringSubmatch(path)[1]
+		switch r.Method {
+		case "GET":
+			s.get(w, r, id)
+		case "PATCH":
+			s.update(w, r, id)
+		case "DELETE":
+			s.delete(w, id)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "methodNotAllowed", "Method not allowed")
+		}
+	case sessionRoute.MatchString(path) && r.Method == "PUT":
+		s.resume(w, r, sessionRoute.FindStringSubmatch(path)[1])
+	default:
+		writeError(w, http.StatusNotFound, "notFound", "Unknown call "+r.Method+" "+path)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	match, err := parseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	pageSize := 100
+	if v := r.URL.Query().Get("pageSize"); v != "" {
+		pageSize, err = strconv.Atoi(v)
+		if err != nil || pageSize < 1 || pageSize > 1000 {
+			writeError(w, http.StatusBadRequest, "invalid", "Invalid pageSize")
+			return
+		}
+	}
+	if s.pageMax > 0 && pageSize > s.pageMax {
+		pageSize = s.pageMax
+	}
+	start := 0
+	if v := r.URL.Query().Get("pageToken"); v != "" {
+		start, err = strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid", "Invalid pageToken")
+			return
+		}
+	}
+
+	var matched []*drive.File
+	for _, id := range s.order {
+		if f, ok := s.files[id]; ok && match(&f.meta) {
+			meta := f.meta
+			matched = append(matched, &meta)
+		}
+	}
+	ret := drive.FileList{Files: []*drive.File{}}
+	if start < len(matched) {
+		end := start + pageSize
+		if end < len(matched) {
+			ret.NextPageToken = strconv.Itoa(end)
+		} else {
+			end = len(matched)
+		}
+		ret.Files = matched[start:end]
+	}
+	writeJSON(w, http.StatusOK, &ret)
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	var meta drive.File
+	var content []byte
+	switch r.URL.Query().Get("uploadType") {
+	case "":
+		if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+			writeError(w, http.StatusBadRequest, "parseError", err.Error())
+			return
+		}
+	case "media":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "parseError", err.Error())
+			return
+		}
+		meta.MimeType = r.Header.Get("Content-Type")
+		content = body
+	case "multipart":
+		metapart, media, mediatype, err := readMultipart(r)
+		if err == nil {
+			err = json.Unmarshal(metapart, &meta)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "parseError", err.Error())
+			return
+		}
+		if meta.MimeType == "" {
+			meta.MimeType = mediatype
+		}
+		content = media
+	case "resumable":
+		if err := json.NewDecoder(r.Body).Decode(&meta); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, "parseError", err.Error())
+			return
+		}
+		if meta.MimeType == "" {
+			meta.MimeType = r.Header.Get("X-Upload-Content-Type")
+		}
+		if err := checkProperties(meta.AppProperties); err != nil {
+			writeError(w, http.StatusBadRequest, "badRequest", err.Error())
+			return
+		}
+		s.nextID++
+		sid := fmt.Sprintf("session%d", s.nextID)
+		s.sessions[sid] = &session{meta: meta}
+		w.Header().Set("Location", s.URL+"/upload/session/"+sid)
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		writeError(w, http.StatusBadRequest, "invalid", "Unknown uploadType")
+		return
+	}
+	if err := checkProperties(meta.AppProperties); err != nil {
+		writeError(w, http.StatusBadRequest, "badRequest", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, &s.store(meta, content).meta)
+}
+
+// resume takes one chunk of a resumable upload.
+func (s *Server) resume(w http.ResponseWriter, r *http.Request, sid string) {
+	sess, ok := s.sessions[sid]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "Upload session not found")
+		return
+	}
+	if _, err := io.Copy(&sess.content, r.Body); err != nil {
+		writeError(w, http.StatusBadRequest, "parseError", err.Error())
+		return
+	}
+	// Content-Range is "bytes first-last/total", with total "*" while the
+	// length is still unknown, or "bytes */total" for a status query.
+	total := -1
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		if slash := strings.LastIndex(cr, "/"); slash >= 0 && cr[slash+1:] != "*" {
+			total, _ = strconv.Atoi(cr[slash+1:])
+		}
+	}
+	if total < 0 || sess.content.Len() < total {
+		if sess.content.Len() > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", sess.content.Len()-1))
+		}
+		w.WriteHeader(308)
+		return
+	}
+	delete(s.sessions, sid)
+	writeJSON(w, http.StatusOK, &s.store(sess.meta, sess.content.Bytes()).meta)
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, id string) {
+	f, ok := s.files[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "File not found: "+id+".")
+		return
+	}
+	if r.URL.Query().Get("alt") != "media" {
+		writeJSON(w, http.StatusOK, &f.meta)
+		return
+	}
+	if f.meta.MimeType == folderMimeType {
+		writeError(w, http.StatusForbidden, "fileNotDownloadable", "Only files with binary content can be downloaded.")
+		return
+	}
+	if f.abusive && r.URL.Query().Get("acknowledgeAbuse") != "true" {
+		writeError(w, http.StatusForbidden, "cannotDownloadAbusiveFile", "This file has been identified as malware or spam and cannot be downloaded.")
+		return
+	}
+	w.Header().Set("Content-Type", f.meta.MimeType)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(f.content))
+}
+
+func (s *Server) update(w http.ResponseWriter, r *http.Request, id string) {
+	f, ok := s.files[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "File not found: "+id+".")
+		return
+	}
+	// an update through the upload endpoint replaces the content as well
+	var patch map[string]json.RawMessage
+	var content []byte
+	var err error
+	media := true
+	switch r.URL.Query().Get("uploadType") {
+	case "":
+		media = false
+		err = json.NewDecoder(r.Body).Decode(&patch)
+		if err == io.EOF {
+			err = nil
+		}
+	case "media":
+		content, err = ioutil.ReadAll(r.Body)
+	case "multipart":
+		var metapart []byte
+		metapart, content, _, err = readMultipart(r)
+		if err == nil {
+			err = json.Unmarshal(metapart, &patch)
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "invalid", "Unknown uploadType")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "parseError", err.Error())
+		return
+	}
+	if media {
+		hash := md5.Sum(content)
+		f.content = content
+		f.meta.Md5Checksum = hex.EncodeToString(hash[:])
+		f.meta.Size = int64(len(content))
+		f.meta.ModifiedTime = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	for field, value := range patch {
+		var err error
+		switch field {
+		case "name":
+			err = json.Unmarshal(value, &f.meta.Name)
+		case "trashed":
+			err = json.Unmarshal(value, &f.meta.Trashed)
+		case "mimeType":
+			err = json.Unmarshal(value, &f.meta.MimeType)
+		case "appProperties":
+			err = mergeAppProperties(&f.meta, value)
+		case "modifiedTime":
+			err = json.Unmarshal(value, &f.meta.ModifiedTime)
+		default:
+			err = fmt.Errorf("field %v is not writable", field)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "fieldNotWritable", err.Error())
+			return
+		}
+	}
+	if v := r.URL.Query().Get("addParents"); v != "" {
+		f.meta.Parents = append(f.meta.Parents, strings.Split(v, ",")...)
+	}
+	if v := r.URL.Query().Get("removeParents"); v != "" {
+		for _, parent := range strings.Split(v, ",") {
+			for i, p := range f.meta.Parents {
+				if p == parent {
+					f.meta.Parents = append(f.meta.Parents[:i:i], f.meta.Parents[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, &f.meta)
+}
+
+func (s *Server) delete(w http.ResponseWriter, id string) {
+	if _, ok := s.files[id]; !ok {
+		writeError(w, http.StatusNotFound, "notFound", "File not found: "+id+".")
+		return
+	}
+	delete(s.files, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) copy(w http.ResponseWriter, r *http.Request, id string) {
+	f, ok := s.files[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "File not found: "+id+".")
+		return
+	}
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "parseError", err.Error())
+		return
+	}
+	copied := f.meta
+	copied.Id = ""
+	copied.ModifiedTime = ""
+	copied.AppProperties = nil
+	for k, v := range f.meta.AppProperties {
+		if copied.AppProperties == nil {
+			copied.AppProperties = make(map[string]string)
+		}
+		copied.AppProperties[k] = v
+	}
+	for field, value := range patch {
+		var err error
+		switch field {
+		case "name":
+			err = json.Unmarshal(value, &copied.Name)
+		case "parents":
+			err = json.Unmarshal(value, &copied.Parents)
+		case "mimeType":
+			err = json.Unmarshal(value, &copied.MimeType)
+		case "appProperties":
+			err = mergeAppProperties(&copied, value)
+		case "modifiedTime":
+			err = json.Unmarshal(value, &copied.ModifiedTime)
+		default:
+			err = fmt.Errorf("field %v is not writable", field)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "fieldNotWritable", err.Error())
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, &s.store(copied, f.content).meta)
+}
+
+// mergeAppProperties applies the appProperties of an update or copy the way
+// Drive does: entries are added or replaced one by one, and an entry set to
+// null is removed.
+func mergeAppProperties(f *drive.File, raw json.RawMessage) error {
+	var entries map[string]*string
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return err
+	}
+	for k, v := range entries {
+		if v == nil {
+			delete(f.AppProperties, k)
+			continue
+		}
+		if f.AppProperties == nil {
+			f.AppProperties = make(map[string]string)
+		}
+		f.AppProperties[k] = *v
+	}
+	return checkProperties(f.AppProperties)
+}
+
+// checkProperties fails if an entry of properties is larger than Drive
+// allows.
+func checkProperties(properties map[string]string) error {
+	for k, v := range properties {
+		if len(k)+len(v) > maxPropertySize {
+			return fmt.Errorf("The property %v is too large.", k)
+		}
+	}
+	return nil
+}
+
+// store adds a file, filling in the fields Drive computes itself. The
+// caller holds the lock.
+func (s *Server) store(meta drive.File, content []byte) *file {
+	s.nextID++
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	meta.Id = fmt.Sprintf("file%d", s.nextID)
+	meta.Trashed = false
+	meta.CreatedTime = now
+	if meta.ModifiedTime == "" {
+		meta.ModifiedTime = now
+	}
+	if meta.MimeType == "" {
+		meta.MimeType = "application/octet-stream"
+	}
+	if meta.MimeType != folderMimeType {
+		hash := md5.Sum(content)
+		meta.Md5Checksum = hex.EncodeToString(hash[:])
+		meta.Size = int64(len(content))
+	}
+	f := &file{meta: meta, content: append([]byte(nil), content...)}
+	s.files[meta.Id] = f
+	s.order = append(s.order, meta.Id)
+	return f
+}
+
+// readMultipart splits a multipart/related upload into its JSON metadata
+// and its media, returning the content type of the media as well.
+func readMultipart(r *http.Request) ([]byte, []byte, string, error) {
+	mediatype, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if mediatype != "multipart/related" {
+		return nil, nil, "", fmt.Errorf("unexpected content type %v", mediatype)
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	metapart, err := parts.NextPart()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	meta, err := ioutil.ReadAll(metapart)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	mediapart, err := parts.NextPart()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	content, err := ioutil.ReadAll(mediapart)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return meta, content, mediapart.Header.Get("Content-Type"), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, reason, message string) {
+	body := map[string]interface{}{
+		"error": map[string]interface{}{
+			"errors": []map[string]string{
+				{"domain": "global", "reason": reason, "message": message},
+			},
+			"code":    status,
+			"message": message,
+		},
+	}
+	writeJSON(w, status, body)
+}
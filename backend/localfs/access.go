@@ -0,0 +1,378 @@
+package localfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+// LocalFSBackend keeps every object as one file directly under root. Keys
+// are escaped into flat file names, so no key can reach outside of root.
+// The MD5 and metadata of each object are kept in a sidecar under
+// root/.meta; the modification time is that of the object file. Keys that
+// would escape to a name too long for the filesystem are stored under a
+// hash instead, and are only known by the key kept in their sidecar.
+type LocalFSBackend struct {
+	root string
+	// namespace guards the pairing of an object file with its sidecar
+	namespace sync.RWMutex
+}
+
+type sidecar struct {
+	Key         string            `json:"Key,omitempty"`
+	Length      int64             `json:"Length"`
+	Mark        string            `json:"Mark"`
+	ContentType string            `json:"ContentType,omitempty"`
+	UserMeta    map[string]string `json:"UserMeta,omitempty"`
+}
+
+func NewLocalFSBackend(root string) (*LocalFSBackend, error) {
+	if err := os.MkdirAll(filepath.Join(root, ".meta"), 0700); err != nil {
+		return nil, err
+	}
+	return &LocalFSBackend{root: root}, nil
+}
+
+func (lfs *LocalFSBackend) Put(ctx context.Context, key string, value []byte) error {
+	return lfs.PutS(ctx, key, bytes.NewReader(value), int64(len(value)), lgpd.Metadata{})
+}
+
+// PutS writes value to a temporary file and renames it into place, so a
+// reader sees either the old object or the new one, never a partial one.
+func (lfs *LocalFSBackend) PutS(ctx context.Context, key string, value io.Reader, size int64, meta lgpd.Metadata) error {
+	tmp, err := ioutil.TempFile(lfs.root, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := md5.New()
+	length, err := io.Copy(io.MultiWriter(tmp, hash), &ctxReader{ctx: ctx, r: value})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 && length != size {
+		return io.ErrUnexpectedEOF
+	}
+	if !meta.ModTime.IsZero() {
+		if err := os.Chtimes(tmp.Name(), meta.ModTime, meta.ModTime); err != nil {
+			return err
+		}
+	}
+
+	tmpmeta, err := lfs.stageSidecar(sidecar{
+		Key:         key,
+		Length:      length,
+		Mark:        hex.EncodeToString(hash.Sum(nil)),
+		ContentType: meta.ContentType,
+		UserMeta:    meta.UserMeta,
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpmeta)
+
+	lfs.namespace.Lock()
+	defer lfs.namespace.Unlock()
+	if err := os.Rename(tmpmeta, lfs.metaPath(key)); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), lfs.path(key))
+}
+
+// stageSidecar writes meta to a temporary file under root, returning its
+// path for the caller to rename into place.
+func (lfs *LocalFSBackend) stageSidecar(meta sidecar) (string, error) {
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(lfs.root, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(encoded)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+func (lfs *LocalFSBackend) Get(ctx context.Context, key string, nofetch bool) ([]byte, lgpd.File, error) {
+	body, ret, err := lfs.GetS(ctx, key, nofetch)
+	if err != nil || nofetch {
+		return nil, ret, err
+	}
+	defer body.Close()
+	c, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, ret, err
+	}
+	return c, ret, nil
+}
+
+func (lfs *LocalFSBackend) GetS(ctx context.Context, key string, nofetch bool) (io.ReadCloser, lgpd.File, error) {
+	if nofetch {
+		ret, err := lfs.Stat(ctx, key)
+		return nil, ret, err
+	}
+	return lfs.GetRange(ctx, key, 0, -1)
+}
+
+func (lfs *LocalFSBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, lgpd.File, error) {
+	ret := lgpd.File{Name: key}
+	if offset < 0 {
+		return nil, ret, errors.New("invalid range")
+	}
+	lfs.namespace.RLock()
+	f, err := os.Open(lfs.path(key))
+	if err != nil {
+		lfs.namespace.RUnlock()
+		return nil, ret, notFound(err)
+	}
+	ret, err = lfs.describe(key, f)
+	lfs.namespace.RUnlock()
+	if err != nil {
+		f.Close()
+		return nil, ret, err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, ret, err
+	}
+	var body io.Reader = f
+	if length >= 0 {
+		body = io.LimitReader(f, length)
+	}
+	return &readCloser{Reader: &ctxReader{ctx: ctx, r: body}, Closer: f}, ret, nil
+}
+
+func (lfs *LocalFSBackend) List(ctx context.Context, perfix string) ([]lgpd.File, error) {
+	lfs.namespace.RLock()
+	defer lfs.namespace.RUnlock()
+	entries, err := ioutil.ReadDir(lfs.root)
+	if err != nil {
+		return nil, err
+	}
+	var ret []lgpd.File
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		key, ok := lfs.key(entry.Name())
+		if !ok || !strings.HasPrefix(key, perfix) {
+			continue
+		}
+		f, err := os.Open(lfs.path(key))
+		if err != nil {
+			continue
+		}
+		file, err := lfs.describe(key, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, file)
+	}
+	return ret, nil
+}
+
+func (lfs *LocalFSBackend) Stat(ctx context.Context, key string) (lgpd.File, error) {
+	lfs.namespace.RLock()
+	defer lfs.namespace.RUnlock()
+	f, err := os.Open(lfs.path(key))
+	if err != nil {
+		return lgpd.File{Name: key}, notFound(err)
+	}
+	defer f.Close()
+	return lfs.describe(key, f)
+}
+
+func (lfs *LocalFSBackend) Delete(ctx context.Context, key string) error {
+	lfs.namespace.Lock()
+	defer lfs.namespace.Unlock()
+	if err := os.Remove(lfs.path(key)); err != nil {
+		return notFound(err)
+	}
+	os.Remove(lfs.metaPath(key))
+	return nil
+}
+
+func (lfs *LocalFSBackend) Rename(ctx context.Context, oldkey, newkey string) error {
+	lfs.namespace.Lock()
+	defer lfs.namespace.Unlock()
+	if _, err := os.Stat(lfs.path(oldkey)); err != nil {
+		return notFound(err)
+	}
+	if oldkey == newkey {
+		return nil
+	}
+	// the sidecar names the key, so it is rewritten rather than moved
+	var meta sidecar
+	b, err := ioutil.ReadFile(lfs.metaPath(oldkey))
+	if err == nil && json.Unmarshal(b, &meta) == nil {
+		meta.Key = newkey
+		tmpmeta, err := lfs.stageSidecar(meta)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmpmeta)
+		if err := os.Rename(tmpmeta, lfs.metaPath(newkey)); err != nil {
+			return err
+		}
+		os.Remove(lfs.metaPath(oldkey))
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	} else {
+		// the replaced object's sidecar must not describe the new one
+		os.Remove(lfs.metaPath(newkey))
+	}
+	return os.Rename(lfs.path(oldkey), lfs.path(newkey))
+}
+
+// describe builds the File for the open object f, taking the MD5 from the
+// sidecar when it is present and agrees with the file, and rebuilding the
+// sidecar from the content otherwise. Metadata in a sidecar that no longer
+// agrees is kept.
+func (lfs *LocalFSBackend) describe(key string, f *os.File) (lgpd.File, error) {
+	ret := lgpd.File{Name: key}
+	info, err := f.Stat()
+	if err != nil {
+		return ret, err
+	}
+	ret.Length = int(info.Size())
+	ret.ModTime = info.ModTime()
+
+	var meta sidecar
+	if b, err := ioutil.ReadFile(lfs.metaPath(key)); err == nil {
+		if json.Unmarshal(b, &meta) != nil {
+			meta = sidecar{}
+		}
+	}
+	ret.ContentType = meta.ContentType
+	ret.UserMeta = meta.UserMeta
+	if meta.Length == info.Size() && meta.Mark != "" {
+		ret.Mark = meta.Mark
+		return ret, nil
+	}
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(f, 0, info.Size())); err != nil {
+		return ret, err
+	}
+	ret.Mark = hex.EncodeToString(hash.Sum(nil))
+	meta.Key = key
+	meta.Length = info.Size()
+	meta.Mark = ret.Mark
+	if b, err := json.Marshal(meta); err == nil {
+		ioutil.WriteFile(lfs.metaPath(key), b, 0600)
+	}
+	return ret, nil
+}
+
+func (lfs *LocalFSBackend) path(key string) string {
+	return filepath.Join(lfs.root, escape(key))
+}
+
+func (lfs *LocalFSBackend) metaPath(key string) string {
+	return filepath.Join(lfs.root, ".meta", escape(key))
+}
+
+// key returns the key stored under the file name, which for a hashed name
+// is only to be found in its sidecar.
+func (lfs *LocalFSBackend) key(name string) (string, bool) {
+	if !strings.HasPrefix(name, hashedPrefix) {
+		key, err := url.PathUnescape(name)
+		return key, err == nil
+	}
+	var meta sidecar
+	b, err := ioutil.ReadFile(filepath.Join(lfs.root, ".meta", name))
+	if err != nil || json.Unmarshal(b, &meta) != nil || escape(meta.Key) != name {
+		return "", false
+	}
+	return meta.Key, true
+}
+
+// maxName is the longest file name most filesystems allow, in bytes.
+const maxName = 255
+
+// hashedPrefix starts the names of keys stored under a hash. It is never
+// left as is by escape, so a hashed name cannot be an escaped one.
+const hashedPrefix = "~"
+
+// escape maps a key to a single path element. Everything outside of
+// [A-Za-z0-9_.-] is percent-encoded, as is a leading dot, which keeps "."
+// and ".." out and leaves dot-names free for our own bookkeeping. A key
+// that escapes to more than maxName bytes is named by its SHA-256 instead.
+func escape(key string) string {
+	if name := percentEncode(key); len(name) <= maxName {
+		return name
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hashedPrefix + hex.EncodeToString(sum[:])
+}
+
+func percentEncode(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '_', c == '-', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%")
+			b.WriteString(strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+func notFound(err error) error {
+	if os.IsNotExist(err) {
+		return lgpd.ErrNotFound
+	}
+	return err
+}
+
+// ctxReader fails reads once ctx is done, so copies of large objects stop
+// when the caller goes away.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
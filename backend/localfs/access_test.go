@@ -0,0 +1,18 @@
+package localfs
+
+import (
+	"testing"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/lgpd/lgpdtest"
+)
+
+func TestConformance(t *testing.T) {
+	lgpdtest.RunConformance(t, func(t *testing.T) lgpd.LGPD {
+		lfs, err := NewLocalFSBackend(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lfs
+	})
+}
@@ -0,0 +1,210 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+var errFull = errors.New("memory backend is full")
+
+// MemoryBackend keeps objects in a map. It suits tests and buckets whose
+// content does not need to outlive the process.
+type MemoryBackend struct {
+	lock    sync.RWMutex
+	objects map[string]*object
+	used    int64
+	maxsize int64
+	ttl     time.Duration
+}
+
+type object struct {
+	content []byte
+	mark    string
+	stored  time.Time
+	meta    lgpd.Metadata
+}
+
+// NewMemoryBackend creates an empty backend holding at most maxsize bytes
+// of content, each object living for ttl after it was written. A zero
+// maxsize or ttl lifts the respective limit.
+func NewMemoryBackend(maxsize int64, ttl time.Duration) *MemoryBackend {
+	return &MemoryBackend{objects: make(map[string]*object), maxsize: maxsize, ttl: ttl}
+}
+
+func (mb *MemoryBackend) Put(ctx context.Context, key string, value []byte) error {
+	return mb.PutS(ctx, key, bytes.NewReader(value), int64(len(value)), lgpd.Metadata{})
+}
+
+func (mb *MemoryBackend) PutS(ctx context.Context, key string, value io.Reader, size int64, meta lgpd.Metadata) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if mb.maxsize > 0 {
+		if size > mb.maxsize {
+			return errFull
+		}
+		// read one byte past the cap to tell an oversized value apart
+		value = io.LimitReader(value, mb.maxsize+1)
+	}
+	content, err := ioutil.ReadAll(value)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && int64(len(content)) != size {
+		return io.ErrUnexpectedEOF
+	}
+	hash := md5.Sum(content)
+	now := time.Now()
+	if meta.ModTime.IsZero() {
+		meta.ModTime = now
+	}
+	if meta.UserMeta != nil {
+		usermeta := make(map[string]string, len(meta.UserMeta))
+		for k, v := range meta.UserMeta {
+			usermeta[k] = v
+		}
+		meta.UserMeta = usermeta
+	}
+
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	mb.expire()
+	used := mb.used + int64(len(content))
+	if old, ok := mb.objects[key]; ok {
+		used -= int64(len(old.content))
+	}
+	if mb.maxsize > 0 && used > mb.maxsize {
+		return errFull
+	}
+	mb.objects[key] = &object{content: content, mark: hex.EncodeToString(hash[:]), stored: now, meta: meta}
+	mb.used = used
+	return nil
+}
+
+func (mb *MemoryBackend) Get(ctx context.Context, key string, nofetch bool) ([]byte, lgpd.File, error) {
+	obj, ret, err := mb.lookup(key)
+	if err != nil || nofetch {
+		return nil, ret, err
+	}
+	return append([]byte(nil), obj.content...), ret, nil
+}
+
+func (mb *MemoryBackend) GetS(ctx context.Context, key string, nofetch bool) (io.ReadCloser, lgpd.File, error) {
+	obj, ret, err := mb.lookup(key)
+	if err != nil || nofetch {
+		return nil, ret, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(obj.content)), ret, nil
+}
+
+func (mb *MemoryBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, lgpd.File, error) {
+	obj, ret, err := mb.lookup(key)
+	if err != nil {
+		return nil, ret, err
+	}
+	if offset < 0 {
+		return nil, ret, errors.New("invalid range")
+	}
+	content := obj.content
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	content = content[offset:]
+	if length >= 0 && length < int64(len(content)) {
+		content = content[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), ret, nil
+}
+
+func (mb *MemoryBackend) List(ctx context.Context, perfix string) ([]lgpd.File, error) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	mb.expire()
+	var ret []lgpd.File
+	for key, obj := range mb.objects {
+		if strings.HasPrefix(key, perfix) {
+			ret = append(ret, describe(key, obj))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+func (mb *MemoryBackend) Stat(ctx context.Context, key string) (lgpd.File, error) {
+	_, ret, err := mb.lookup(key)
+	return ret, err
+}
+
+func (mb *MemoryBackend) Delete(ctx context.Context, key string) error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	mb.expire()
+	obj, ok := mb.objects[key]
+	if !ok {
+		return lgpd.ErrNotFound
+	}
+	mb.used -= int64(len(obj.content))
+	delete(mb.objects, key)
+	return nil
+}
+
+func (mb *MemoryBackend) Rename(ctx context.Context, oldkey, newkey string) error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	mb.expire()
+	obj, ok := mb.objects[oldkey]
+	if !ok {
+		return lgpd.ErrNotFound
+	}
+	if oldkey == newkey {
+		return nil
+	}
+	if replaced, ok := mb.objects[newkey]; ok {
+		mb.used -= int64(len(replaced.content))
+	}
+	delete(mb.objects, oldkey)
+	mb.objects[newkey] = obj
+	return nil
+}
+
+func (mb *MemoryBackend) lookup(key string) (*object, lgpd.File, error) {
+	mb.lock.RLock()
+	defer mb.lock.RUnlock()
+	obj, ok := mb.objects[key]
+	if !ok || mb.expired(obj) {
+		return nil, lgpd.File{Name: key}, lgpd.ErrNotFound
+	}
+	return obj, describe(key, obj), nil
+}
+
+// expire drops every object past its ttl. The caller holds the write lock.
+func (mb *MemoryBackend) expire() {
+	if mb.ttl <= 0 {
+		return
+	}
+	for key, obj := range mb.objects {
+		if mb.expired(obj) {
+			mb.used -= int64(len(obj.content))
+			delete(mb.objects, key)
+		}
+	}
+}
+
+func (mb *MemoryBackend) expired(obj *object) bool {
+	return mb.ttl > 0 && time.Since(obj.stored) > mb.ttl
+}
+
+func describe(key string, obj *object) lgpd.File {
+	return lgpd.File{Name: key, Length: len(obj.content), Mark: obj.mark, Metadata: obj.meta}
+}
@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/lgpd/lgpdtest"
+)
+
+func TestConformance(t *testing.T) {
+	lgpdtest.RunConformance(t, func(t *testing.T) lgpd.LGPD {
+		return NewMemoryBackend(0, 0)
+	})
+}
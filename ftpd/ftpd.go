@@ -1,12 +1,17 @@
 package ftpd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"mime"
+	"net"
 	"os"
+	"path"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/goftp/server"
@@ -14,7 +19,20 @@ import (
 )
 
 type Ftpd struct {
-	access map[string]lgpd.LGPD
+	access     map[string]lgpd.LGPD
+	accessLock sync.RWMutex
+	ctx        context.Context
+	// accepted holds the contexts of the connections accepted through
+	// Listener that NewDriver has not yet been asked for, oldest first.
+	acceptLock sync.Mutex
+	accepted   []context.Context
+}
+
+// driver serves one FTP connection. Its storage calls use ctx, so they are
+// abandoned once the connection is gone.
+type driver struct {
+	*Ftpd
+	ctx context.Context
 }
 
 type Fileinfo struct {
@@ -50,109 +68,131 @@ func (fi Fileinfo) Sys() interface{} {
 func (fi Fileinfo) Owner() string { return "root" }
 func (fi Fileinfo) Group() string { return "root" }
 
-func (td Ftpd) Init(*server.Conn) {}
-func (td Ftpd) Stat(s string) (server.FileInfo, error) {
-	bucket := td.bucket(s)
-	filename := td.filename(s)
+func (d *driver) Init(*server.Conn) {}
+func (d *driver) Stat(s string) (server.FileInfo, error) {
+	bucket := d.bucket(s)
+	filename := d.filename(s)
 	fmt.Printf("stat %v %v\n", bucket, filename)
 	if bucket == "" {
 		return &Fileinfo{isDir: true, name: "/"}, nil
 	}
-	access, ok := td.access[bucket]
+	access, ok := d.source(bucket)
 	if !ok {
 		return nil, errors.New("bucket not found")
 	}
 	if filename == "" {
 		return &Fileinfo{isDir: true, name: bucket}, nil
 	}
-	_, file, err := access.Get(filename, true)
+	file, err := access.Stat(d.ctx, filename)
 
 	if err != nil {
 		return nil, err
 	}
-	return &Fileinfo{isDir: false, name: filename, size: int64(file.Length)}, nil
+	return &Fileinfo{isDir: false, name: filename, size: int64(file.Length), modtime: file.ModTime}, nil
 }
-func (td Ftpd) ChangeDir(s string) error {
+func (d *driver) ChangeDir(s string) error {
 	return nil
 }
-func (td Ftpd) ListDir(s string, o func(server.FileInfo) error) error {
+func (d *driver) ListDir(s string, o func(server.FileInfo) error) error {
 	if s == "/" {
 		fmt.Printf("list /\n")
-		for key := range td.access {
+		for _, key := range d.buckets() {
 			println(o(Fileinfo{isDir: true, name: key}))
 		}
 		return nil
 	}
-	bucket := td.bucket(s)
+	bucket := d.bucket(s)
 	fmt.Printf("list %v", bucket)
 
-	access, ok := td.access[bucket]
+	access, ok := d.source(bucket)
 	if !ok {
 		return errors.New("bucket not found")
 	}
 
-	list := access.List("")
+	list, err := access.List(d.ctx, "")
+	if err != nil {
+		return err
+	}
 	for _, listv := range list {
-		o(Fileinfo{isDir: false, name: listv.Name, size: int64(listv.Length)})
+		o(Fileinfo{isDir: false, name: listv.Name, size: int64(listv.Length), modtime: listv.ModTime})
 	}
 	return nil
 }
-func (td Ftpd) DeleteDir(s string) error {
+func (d *driver) DeleteDir(s string) error {
 	return nil
 }
-func (td Ftpd) DeleteFile(s string) error {
-	return nil
+func (d *driver) DeleteFile(s string) error {
+	bucket := d.bucket(s)
+	filename := d.filename(s)
+	fmt.Printf("delete %v %v\n", bucket, filename)
+	access, ok := d.source(bucket)
+	if !ok {
+		return errors.New("bucket not found")
+	}
+	return access.Delete(d.ctx, filename)
 }
-func (td Ftpd) Rename(s string, s2 string) error {
-	return nil
+func (d *driver) Rename(s string, s2 string) error {
+	bucket := d.bucket(s)
+	filename := d.filename(s)
+	newfilename := d.filename(s2)
+	fmt.Printf("rename %v %v -> %v\n", bucket, filename, newfilename)
+	if d.bucket(s2) != bucket {
+		return errors.New("Not Supported")
+	}
+	access, ok := d.source(bucket)
+	if !ok {
+		return errors.New("bucket not found")
+	}
+	return access.Rename(d.ctx, filename, newfilename)
 }
-func (td Ftpd) MakeDir(s string) error {
+func (d *driver) MakeDir(s string) error {
 	return nil
 }
-func (td Ftpd) GetFile(s string, s2 int64) (int64, io.ReadCloser, error) {
-	if s2 != 0 {
-		return 0, nil, errors.New("Not Supported")
-	}
-	bucket := td.bucket(s)
-	filename := td.filename(s)
+func (d *driver) GetFile(s string, s2 int64) (int64, io.ReadCloser, error) {
+	bucket := d.bucket(s)
+	filename := d.filename(s)
 	fmt.Printf("get %v %v\n", bucket, filename)
-	access, ok := td.access[bucket]
+	access, ok := d.source(bucket)
 	if !ok {
 		return 0, nil, errors.New("bucket not found")
 	}
-	body, file, err := access.GetS(filename, false)
+	// goftp closes the reader once the data connection is done with it,
+	// which is the only end-of-transfer signal it gives us.
+	ctx, cancel := context.WithCancel(d.ctx)
+	// A non-zero offset comes from REST, resuming an earlier transfer.
+	body, file, err := access.GetRange(ctx, filename, s2, -1)
 	if err != nil {
+		cancel()
 		return 0, nil, err
 	}
 
-	return int64(file.Length), body, nil
+	return int64(file.Length) - s2, &cancelOnClose{ReadCloser: body, cancel: cancel}, nil
 
 }
-func (td Ftpd) PutFile(s string, r io.Reader, o bool) (i int64, ret error) {
+func (d *driver) PutFile(s string, r io.Reader, o bool) (i int64, ret error) {
 	defer func() {
-		recover()
-		ret = errors.New("Unexpected Error")
-		i = 0
+		if recover() != nil {
+			ret = errors.New("Unexpected Error")
+			i = 0
+		}
 	}()
 	if o {
 		return 0, errors.New("Not Supported")
 	}
-	bucket := td.bucket(s)
-	filename := td.filename(s)
+	bucket := d.bucket(s)
+	filename := d.filename(s)
 	fmt.Printf("put %v %v\n", bucket, filename)
-	access, ok := td.access[bucket]
+	access, ok := d.source(bucket)
 	if !ok {
 		return 0, errors.New("bucket not found")
 	}
-	by, err := ioutil.ReadAll(r)
-	if err != nil {
-		return 0, err
-	}
-	err = access.Put(filename, by)
+	counter := &countingReader{Reader: r, ctx: d.ctx}
+	meta := lgpd.Metadata{ContentType: mime.TypeByExtension(path.Ext(filename))}
+	err := access.PutS(d.ctx, filename, counter, -1, meta)
 	if err != nil {
 		return 0, err
 	}
-	return int64(len(by)), nil
+	return counter.n, nil
 }
 func (td *Ftpd) bucket(s string) string {
 	defer func() {
@@ -167,9 +207,135 @@ func (td *Ftpd) filename(s string) string {
 	return strings.Split(s, "/")[2]
 }
 
+// SetContext bounds every storage call made on behalf of FTP clients;
+// cancelling ctx aborts transfers still in progress.
+func (td *Ftpd) SetContext(ctx context.Context) {
+	td.ctx = ctx
+}
+
+// Listener wraps l so that each connection accepted through it gives the
+// driver made for it a context of its own, cancelled once the connection
+// closes. Serve the FTP server on it with td as its DriverFactory.
+func (td *Ftpd) Listener(l net.Listener) net.Listener {
+	return &listener{Listener: l, td: td}
+}
+
+// NewDriver makes the driver of the oldest connection accepted through the
+// listener that has none yet. goftp tells NewDriver nothing of the
+// connection, but asks for its driver right after accepting it, on the
+// goroutine that accepts the next one, so the connections and drivers
+// pair up in order however many clients connect at once. Without the
+// listener, the driver lasts as long as the server.
+func (td *Ftpd) NewDriver() (server.Driver, error) {
+	var ctx context.Context
+	td.acceptLock.Lock()
+	if len(td.accepted) > 0 {
+		ctx = td.accepted[0]
+		td.accepted = td.accepted[1:]
+	}
+	td.acceptLock.Unlock()
+	if ctx == nil {
+		ctx = td.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+	}
+	return &driver{Ftpd: td, ctx: ctx}, nil
+}
+
+// SetSource serves hd as the bucket bk. Buckets may be added and removed
+// while the server is running.
 func (td *Ftpd) SetSource(bk string, hd lgpd.LGPD) {
+	td.accessLock.Lock()
+	defer td.accessLock.Unlock()
 	if td.access == nil {
 		td.access = make(map[string]lgpd.LGPD)
 	}
 	td.access[bk] = hd
 }
+
+// RemoveSource stops serving the bucket bk.
+func (td *Ftpd) RemoveSource(bk string) {
+	td.accessLock.Lock()
+	defer td.accessLock.Unlock()
+	delete(td.access, bk)
+}
+
+func (td *Ftpd) source(bk string) (lgpd.LGPD, bool) {
+	td.accessLock.RLock()
+	defer td.accessLock.RUnlock()
+	hd, ok := td.access[bk]
+	return hd, ok
+}
+
+// buckets names the buckets being served, in order.
+func (td *Ftpd) buckets() []string {
+	td.accessLock.RLock()
+	defer td.accessLock.RUnlock()
+	names := make([]string, 0, len(td.access))
+	for bk := range td.access {
+		names = append(names, bk)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// listener hands the context of each connection it accepts to NewDriver.
+type listener struct {
+	net.Listener
+	td *Ftpd
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	parent := l.td.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	l.td.acceptLock.Lock()
+	l.td.accepted = append(l.td.accepted, ctx)
+	l.td.acceptLock.Unlock()
+	return &conn{Conn: c, cancel: cancel}, nil
+}
+
+// conn cancels the context of its connection when goftp closes it.
+type conn struct {
+	net.Conn
+	cancel context.CancelFunc
+}
+
+func (c *conn) Close() error {
+	defer c.cancel()
+	return c.Conn.Close()
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// countingReader counts the bytes of an upload, and stops it once ctx is
+// done, as the data connection may outlive the control connection.
+type countingReader struct {
+	io.Reader
+	ctx context.Context
+	n   int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
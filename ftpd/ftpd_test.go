@@ -0,0 +1,191 @@
+package ftpd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/goftp/server"
+	"github.com/xiaokangwang/s3emu/backend/memory"
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+func newTestDriver(t *testing.T) (*driver, lgpd.LGPD) {
+	td := &Ftpd{}
+	store := memory.NewMemoryBackend(0, 0)
+	td.SetSource("bucket", store)
+	d, err := td.NewDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.(*driver), store
+}
+
+func TestPutGetFile(t *testing.T) {
+	d, store := newTestDriver(t)
+	n, err := d.PutFile("/bucket/page.html", strings.NewReader("<p>hello</p>"), false)
+	if err != nil || n != 12 {
+		t.Fatalf("PutFile = %v, %v", n, err)
+	}
+	file, err := store.Stat(context.Background(), "page.html")
+	if err != nil || file.ContentType != "text/html; charset=utf-8" {
+		t.Fatalf("stored %+v, %v", file, err)
+	}
+
+	// an offset resumes a transfer
+	size, body, err := d.GetFile("/bucket/page.html", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil || string(got) != "hello</p>" || size != 9 {
+		t.Fatalf("GetFile from 3 = %v, %q, %v", size, got, err)
+	}
+
+	if _, err := d.PutFile("/bucket/page.html", strings.NewReader("more"), true); err == nil {
+		t.Error("appending to a file succeeded")
+	}
+	if _, err := d.PutFile("/nobucket/a", strings.NewReader("x"), false); err == nil {
+		t.Error("PutFile into a missing bucket succeeded")
+	}
+	if _, _, err := d.GetFile("/bucket/missing", 0); !errors.Is(err, lgpd.ErrNotFound) {
+		t.Errorf("GetFile of a missing file: %v, want lgpd.ErrNotFound", err)
+	}
+}
+
+func TestStatListDir(t *testing.T) {
+	d, store := newTestDriver(t)
+	ctx := context.Background()
+	store.Put(ctx, "a", []byte("1"))
+	store.Put(ctx, "b", []byte("22"))
+
+	info, err := d.Stat("/bucket/b")
+	if err != nil || info.IsDir() || info.Size() != 2 {
+		t.Fatalf("Stat = %+v, %v", info, err)
+	}
+	if info, err := d.Stat("/bucket"); err != nil || !info.IsDir() {
+		t.Fatalf("Stat of the bucket = %+v, %v", info, err)
+	}
+	if _, err := d.Stat("/nobucket/a"); err == nil {
+		t.Error("Stat in a missing bucket succeeded")
+	}
+
+	var names []string
+	collect := func(info server.FileInfo) error {
+		names = append(names, info.Name())
+		return nil
+	}
+	if err := d.ListDir("/", collect); err != nil || len(names) != 1 || names[0] != "bucket" {
+		t.Fatalf("ListDir(/) = %v, %v", names, err)
+	}
+	names = nil
+	if err := d.ListDir("/bucket", collect); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "a,b" {
+		t.Fatalf("ListDir(/bucket) = %v", names)
+	}
+}
+
+func TestRenameDelete(t *testing.T) {
+	d, store := newTestDriver(t)
+	ctx := context.Background()
+	store.Put(ctx, "a", []byte("1"))
+	d.SetSource("other", memory.NewMemoryBackend(0, 0))
+
+	if err := d.Rename("/bucket/a", "/other/a"); err == nil {
+		t.Error("Rename across buckets succeeded")
+	}
+	if err := d.Rename("/bucket/a", "/bucket/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(ctx, "b"); err != nil {
+		t.Fatalf("renamed file: %v", err)
+	}
+	if err := d.DeleteFile("/bucket/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(ctx, "b"); !errors.Is(err, lgpd.ErrNotFound) {
+		t.Fatalf("deleted file: %v, want lgpd.ErrNotFound", err)
+	}
+}
+
+func TestConnectionContext(t *testing.T) {
+	td := &Ftpd{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			defer c.Close()
+		}
+	}()
+	c, err := td.Listener(l).Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := td.NewDriver()
+	ctx := d.(*driver).ctx
+	if ctx.Err() != nil {
+		t.Fatal("the context of a new connection is done")
+	}
+	c.Close()
+	if ctx.Err() == nil {
+		t.Fatal("closing the connection left its context going")
+	}
+
+	// a driver made without a connection lasts as long as the server
+	d, _ = td.NewDriver()
+	if d.(*driver).ctx.Err() != nil {
+		t.Fatal("the server context is done")
+	}
+}
+
+func TestConcurrentConnections(t *testing.T) {
+	td := &Ftpd{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	wrapped := td.Listener(l)
+	accept := func() net.Conn {
+		t.Helper()
+		go func() {
+			if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+				defer c.Close()
+			}
+		}()
+		c, err := wrapped.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// both connections are accepted before either driver is made
+	first, second := accept(), accept()
+	d1, _ := td.NewDriver()
+	d2, _ := td.NewDriver()
+	ctx1, ctx2 := d1.(*driver).ctx, d2.(*driver).ctx
+
+	second.Close()
+	if ctx2.Err() == nil {
+		t.Fatal("closing the second connection left the context of its driver going")
+	}
+	if ctx1.Err() != nil {
+		t.Fatal("closing the second connection ended the first")
+	}
+	first.Close()
+	if ctx1.Err() == nil {
+		t.Fatal("closing the first connection left the context of its driver going")
+	}
+}
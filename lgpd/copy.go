@@ -0,0 +1,28 @@
+package lgpd
+
+import "context"
+
+// Copier is implemented by backends that can copy an object themselves,
+// without its content passing through the caller.
+type Copier interface {
+	// Copy stores the content of src under dst, described by meta. Like a
+	// put, it replaces whatever dst held before.
+	Copy(ctx context.Context, src, dst string, meta Metadata) error
+}
+
+// Copy copies src in from to dst in to, described by meta. Within one
+// backend that is a Copier the backend does the work; otherwise the content
+// is streamed from one to the other.
+func Copy(ctx context.Context, from LGPD, src string, to LGPD, dst string, meta Metadata) error {
+	if from == to {
+		if copier, ok := from.(Copier); ok {
+			return copier.Copy(ctx, src, dst, meta)
+		}
+	}
+	body, file, err := from.GetS(ctx, src, false)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return to.PutS(ctx, dst, body, int64(file.Length), meta)
+}
@@ -1,16 +1,58 @@
 package lgpd
 
-import "io"
+import (
+	"context"
+	"io"
+	"time"
+)
 
+// LGPD is the storage a bucket is served from. Every call takes a context so
+// that a caller going away (a disconnected client, a shutdown) can abandon
+// work still in flight at the backend.
+//
+// Get, GetS, GetRange, Stat, Delete and Rename fail with ErrNotFound for a
+// key that does not exist. With nofetch set, Get and GetS only describe the
+// object and return no content. List returns each key starting with perfix
+// once. Putting an existing key replaces it, as does renaming onto one.
+// Every File returned carries the Metadata the object was written with and
+// a ModTime, and renaming keeps both. Package lgpdtest checks an
+// implementation against these rules.
 type LGPD interface {
-	Get(key string, nofetch bool) ([]byte, File, error)
-	GetS(key string, nofetch bool) (io.ReadCloser, File, error)
-	Put(key string, value []byte) error
-	List(perfix string) []File
+	Get(ctx context.Context, key string, nofetch bool) ([]byte, File, error)
+	GetS(ctx context.Context, key string, nofetch bool) (io.ReadCloser, File, error)
+	// GetRange streams length bytes of key starting at offset. A negative
+	// length reads to the end. The returned File describes the whole object.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, File, error)
+	Put(ctx context.Context, key string, value []byte) error
+	// PutS stores size bytes read from value under key, described by meta.
+	// A negative size means the length is not known in advance.
+	PutS(ctx context.Context, key string, value io.Reader, size int64, meta Metadata) error
+	List(ctx context.Context, perfix string) ([]File, error)
+	Stat(ctx context.Context, key string) (File, error)
+	Delete(ctx context.Context, key string) error
+	Rename(ctx context.Context, oldkey, newkey string) error
 }
 
 type File struct {
 	Name   string
 	Length int
-	Mark   string
+	// Mark is the hex encoded MD5 of the content.
+	Mark string
+	// VersionID names the version of the object described, when the store
+	// keeps earlier versions as package versioning does; backends leave it
+	// empty.
+	VersionID string
+	Metadata
+}
+
+// Metadata is what the writer of an object says about it besides its
+// content.
+type Metadata struct {
+	ContentType string
+	// ModTime is when the object was written. Left zero on a put, the
+	// backend uses the time it stores the object.
+	ModTime time.Time
+	// UserMeta holds the user supplied x-amz-meta-* pairs, keyed by the
+	// lower case name without the prefix.
+	UserMeta map[string]string
 }
@@ -0,0 +1,45 @@
+package lgpd
+
+import (
+	"context"
+	"sync"
+)
+
+// batchDeleteWorkers bounds how many deletes DeleteBatch has in flight on a
+// backend that does not batch them itself.
+const batchDeleteWorkers = 8
+
+// BatchDeleter is implemented by backends that can delete many objects in
+// one go, or that must order such a delete against other work.
+type BatchDeleter interface {
+	// DeleteBatch deletes keys, returning the error of each in the same
+	// order; an object that was not there reports ErrNotFound.
+	DeleteBatch(ctx context.Context, keys []string) []error
+}
+
+// DeleteBatch deletes keys from store, returning the error of each in the
+// same order. A BatchDeleter does the work itself; otherwise the keys are
+// deleted in parallel.
+func DeleteBatch(ctx context.Context, store LGPD, keys []string) []error {
+	if deleter, ok := store.(BatchDeleter); ok {
+		return deleter.DeleteBatch(ctx, keys)
+	}
+	errs := make([]error, len(keys))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < batchDeleteWorkers && n < len(keys); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = store.Delete(ctx, keys[i])
+			}
+		}()
+	}
+	for i := range keys {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return errs
+}
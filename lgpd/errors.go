@@ -0,0 +1,23 @@
+package lgpd
+
+import "errors"
+
+// Errors a backend reports so that frontends can tell the common failures
+// apart. A backend may wrap them to add detail; test with errors.Is.
+var (
+	// ErrNotFound means the key does not exist.
+	ErrNotFound = errors.New("lgpd: file not found")
+	// ErrExists means the operation would have replaced something that
+	// must be kept.
+	ErrExists = errors.New("lgpd: file already exists")
+	// ErrNotEmpty means a container, such as a bucket, cannot be removed
+	// as it still holds objects.
+	ErrNotEmpty = errors.New("lgpd: not empty")
+	// ErrBackendUnavailable means the storage behind the backend could not
+	// be reached or refused the call for now; the same call may succeed
+	// later.
+	ErrBackendUnavailable = errors.New("lgpd: backend unavailable")
+	// ErrMetadataTooLarge means the metadata of an object is more than the
+	// backend can keep with it.
+	ErrMetadataTooLarge = errors.New("lgpd: metadata too large")
+)
@@ -0,0 +1,482 @@
+// Package lgpdtest checks that an lgpd.LGPD implementation keeps the
+// contract the frontends rely on. A backend or wrapper validates itself by
+// calling RunConformance from one of its own tests.
+package lgpdtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+// Factory returns an empty store. It is called once per check, and may
+// register cleanup on t.
+type Factory func(t *testing.T) lgpd.LGPD
+
+// RunConformance runs every check against stores made by factory.
+func RunConformance(t *testing.T, factory Factory) {
+	checks := []struct {
+		name  string
+		check func(t *testing.T, store lgpd.LGPD)
+	}{
+		{"Missing", testMissing},
+		{"PutGet", testPutGet},
+		{"NoFetch", testNoFetch},
+		{"GetS", testGetS},
+		{"GetRange", testGetRange},
+		{"PutS", testPutS},
+		{"List", testList},
+		{"ListPrefix", testListPrefix},
+		{"Overwrite", testOverwrite},
+		{"Delete", testDelete},
+		{"Rename", testRename},
+		{"Metadata", testMetadata},
+		{"Copy", testCopy},
+		{"LargeValue", testLargeValue},
+		{"UnicodeKey", testUnicodeKey},
+		{"ConcurrentWriters", testConcurrentWriters},
+	}
+	for _, c := range checks {
+		check := c.check
+		t.Run(c.name, func(t *testing.T) {
+			check(t, factory(t))
+		})
+	}
+}
+
+func mark(value []byte) string {
+	hash := md5.Sum(value)
+	return hex.EncodeToString(hash[:])
+}
+
+func put(t *testing.T, store lgpd.LGPD, key string, value []byte) {
+	t.Helper()
+	if err := store.Put(context.Background(), key, value); err != nil {
+		t.Fatalf("Put(%q): %v", key, err)
+	}
+}
+
+// expect asserts that key holds exactly value, through Get and Stat.
+func expect(t *testing.T, store lgpd.LGPD, key string, value []byte) {
+	t.Helper()
+	ctx := context.Background()
+	got, file, err := store.Get(ctx, key, false)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatalf("Get(%q) returned %d bytes, want %d bytes", key, len(got), len(value))
+	}
+	checkFile(t, "Get", file, key, value)
+	file, err = store.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat(%q): %v", key, err)
+	}
+	checkFile(t, "Stat", file, key, value)
+}
+
+func checkFile(t *testing.T, op string, file lgpd.File, key string, value []byte) {
+	t.Helper()
+	if file.Name != key {
+		t.Errorf("%s(%q) Name = %q", op, key, file.Name)
+	}
+	if file.Length != len(value) {
+		t.Errorf("%s(%q) Length = %d, want %d", op, key, file.Length, len(value))
+	}
+	if file.Mark != mark(value) {
+		t.Errorf("%s(%q) Mark = %q, want MD5 %q", op, key, file.Mark, mark(value))
+	}
+}
+
+func names(t *testing.T, store lgpd.LGPD, prefix string) map[string]lgpd.File {
+	t.Helper()
+	list, err := store.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatalf("List(%q): %v", prefix, err)
+	}
+	ret := make(map[string]lgpd.File)
+	for _, file := range list {
+		if _, dup := ret[file.Name]; dup {
+			t.Errorf("List(%q) returned %q twice", prefix, file.Name)
+		}
+		ret[file.Name] = file
+	}
+	return ret
+}
+
+func testMissing(t *testing.T, store lgpd.LGPD) {
+	ctx := context.Background()
+	missing := func(op string, err error) {
+		if err == nil {
+			t.Errorf("%v of a missing key succeeded", op)
+		} else if !errors.Is(err, lgpd.ErrNotFound) {
+			t.Errorf("%v of a missing key: got %v, want lgpd.ErrNotFound", op, err)
+		}
+	}
+	_, _, err := store.Get(ctx, "missing", false)
+	missing("Get", err)
+	_, _, err = store.Get(ctx, "missing", true)
+	missing("Get with nofetch", err)
+	_, _, err = store.GetS(ctx, "missing", false)
+	missing("GetS", err)
+	_, _, err = store.GetRange(ctx, "missing", 0, -1)
+	missing("GetRange", err)
+	_, err = store.Stat(ctx, "missing")
+	missing("Stat", err)
+	missing("Delete", store.Delete(ctx, "missing"))
+	missing("Rename", store.Rename(ctx, "missing", "other"))
+}
+
+func testPutGet(t *testing.T, store lgpd.LGPD) {
+	put(t, store, "key", []byte("value"))
+	expect(t, store, "key", []byte("value"))
+	put(t, store, "empty", []byte{})
+	expect(t, store, "empty", []byte{})
+}
+
+func testNoFetch(t *testing.T, store lgpd.LGPD) {
+	value := []byte("not to be fetched")
+	put(t, store, "key", value)
+	got, file, err := store.Get(context.Background(), "key", true)
+	if err != nil {
+		t.Fatalf("Get with nofetch: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Get with nofetch returned %d bytes of content", len(got))
+	}
+	checkFile(t, "Get", file, "key", value)
+	body, file, err := store.GetS(context.Background(), "key", true)
+	if err != nil {
+		t.Fatalf("GetS with nofetch: %v", err)
+	}
+	if body != nil {
+		t.Error("GetS with nofetch returned a body")
+		body.Close()
+	}
+	checkFile(t, "GetS", file, "key", value)
+}
+
+func testGetS(t *testing.T, store lgpd.LGPD) {
+	value := []byte("streamed value")
+	put(t, store, "key", value)
+	body, file, err := store.GetS(context.Background(), "key", false)
+	if err != nil {
+		t.Fatalf("GetS: %v", err)
+	}
+	defer body.Close()
+	got, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("reading GetS body: %v", err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("GetS returned %q, want %q", got, value)
+	}
+	checkFile(t, "GetS", file, "key", value)
+}
+
+func testGetRange(t *testing.T, store lgpd.LGPD) {
+	value := []byte("0123456789")
+	put(t, store, "key", value)
+	cases := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, "0123456789"},
+		{3, -1, "3456789"},
+		{3, 4, "3456"},
+		{0, 1, "0"},
+		{9, 1, "9"},
+		{5, 0, ""},
+	}
+	for _, c := range cases {
+		body, file, err := store.GetRange(context.Background(), "key", c.offset, c.length)
+		if err != nil {
+			t.Errorf("GetRange(%d, %d): %v", c.offset, c.length, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Errorf("reading GetRange(%d, %d): %v", c.offset, c.length, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("GetRange(%d, %d) = %q, want %q", c.offset, c.length, got, c.want)
+		}
+		checkFile(t, "GetRange", file, "key", value)
+	}
+}
+
+func testPutS(t *testing.T, store lgpd.LGPD) {
+	ctx := context.Background()
+	value := []byte("sized stream")
+	if err := store.PutS(ctx, "sized", bytes.NewReader(value), int64(len(value)), lgpd.Metadata{}); err != nil {
+		t.Fatalf("PutS with size: %v", err)
+	}
+	expect(t, store, "sized", value)
+	if err := store.PutS(ctx, "unsized", bytes.NewReader(value), -1, lgpd.Metadata{}); err != nil {
+		t.Fatalf("PutS without size: %v", err)
+	}
+	expect(t, store, "unsized", value)
+	if err := store.PutS(ctx, "short", bytes.NewReader(value), int64(len(value))+1, lgpd.Metadata{}); err == nil {
+		t.Error("PutS of a stream shorter than its size succeeded")
+	}
+}
+
+func testList(t *testing.T, store lgpd.LGPD) {
+	if got := names(t, store, ""); len(got) != 0 {
+		t.Errorf("List of an empty store returned %d files", len(got))
+	}
+	put(t, store, "a", []byte("1"))
+	put(t, store, "b", []byte("22"))
+	put(t, store, "c/d", []byte("333"))
+	got := names(t, store, "")
+	want := map[string]int{"a": 1, "b": 2, "c/d": 3}
+	if len(got) != len(want) {
+		t.Errorf("List returned %d files, want %d", len(got), len(want))
+	}
+	for name, length := range want {
+		file, ok := got[name]
+		if !ok {
+			t.Errorf("List is missing %q", name)
+			continue
+		}
+		if file.Length != length {
+			t.Errorf("List Length of %q = %d, want %d", name, file.Length, length)
+		}
+	}
+}
+
+func testListPrefix(t *testing.T, store lgpd.LGPD) {
+	put(t, store, "dir/a", []byte("1"))
+	put(t, store, "dir/b", []byte("2"))
+	put(t, store, "dirt", []byte("3"))
+	put(t, store, "other/dir/c", []byte("4"))
+	got := names(t, store, "dir/")
+	if len(got) != 2 {
+		t.Errorf("List(%q) returned %d files, want 2", "dir/", len(got))
+	}
+	for _, name := range []string{"dir/a", "dir/b"} {
+		if _, ok := got[name]; !ok {
+			t.Errorf("List(%q) is missing %q", "dir/", name)
+		}
+	}
+	if got := names(t, store, "nothing"); len(got) != 0 {
+		t.Errorf("List(%q) returned %d files, want 0", "nothing", len(got))
+	}
+}
+
+func testOverwrite(t *testing.T, store lgpd.LGPD) {
+	put(t, store, "key", []byte("first"))
+	put(t, store, "key", []byte("second value"))
+	expect(t, store, "key", []byte("second value"))
+	got := names(t, store, "")
+	if len(got) != 1 {
+		t.Errorf("List after overwrite returned %d files, want 1", len(got))
+	}
+	if got["key"].Length != len("second value") {
+		t.Errorf("List after overwrite has Length %d, want %d", got["key"].Length, len("second value"))
+	}
+}
+
+func testDelete(t *testing.T, store lgpd.LGPD) {
+	ctx := context.Background()
+	put(t, store, "gone", []byte("value"))
+	put(t, store, "kept", []byte("value"))
+	if err := store.Delete(ctx, "gone"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Stat(ctx, "gone"); err == nil {
+		t.Error("Stat after Delete succeeded")
+	}
+	got := names(t, store, "")
+	if _, ok := got["gone"]; ok {
+		t.Error("List still returns a deleted key")
+	}
+	expect(t, store, "kept", []byte("value"))
+}
+
+func testRename(t *testing.T, store lgpd.LGPD) {
+	ctx := context.Background()
+	put(t, store, "old", []byte("moved"))
+	put(t, store, "target", []byte("replaced"))
+	if err := store.Rename(ctx, "old", "target"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, err := store.Stat(ctx, "old"); err == nil {
+		t.Error("Stat of the old key after Rename succeeded")
+	}
+	expect(t, store, "target", []byte("moved"))
+	got := names(t, store, "")
+	if len(got) != 1 {
+		t.Errorf("List after Rename returned %d files, want 1", len(got))
+	}
+}
+
+func testMetadata(t *testing.T, store lgpd.LGPD) {
+	ctx := context.Background()
+	meta := lgpd.Metadata{
+		ContentType: "text/plain; charset=utf-8",
+		ModTime:     time.Date(2019, 4, 1, 12, 30, 15, 0, time.UTC),
+		UserMeta:    map[string]string{"color": "blue", "owner": "someone"},
+	}
+	value := []byte("described")
+	if err := store.PutS(ctx, "described", bytes.NewReader(value), int64(len(value)), meta); err != nil {
+		t.Fatalf("PutS with metadata: %v", err)
+	}
+	same := func(op string, got lgpd.File) {
+		t.Helper()
+		if got.ContentType != meta.ContentType {
+			t.Errorf("%v: ContentType %q, want %q", op, got.ContentType, meta.ContentType)
+		}
+		if !got.ModTime.Equal(meta.ModTime) {
+			t.Errorf("%v: ModTime %v, want %v", op, got.ModTime, meta.ModTime)
+		}
+		if !reflect.DeepEqual(got.UserMeta, meta.UserMeta) {
+			t.Errorf("%v: UserMeta %v, want %v", op, got.UserMeta, meta.UserMeta)
+		}
+	}
+	file, err := store.Stat(ctx, "described")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	same("Stat", file)
+	_, file, err = store.Get(ctx, "described", false)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	same("Get", file)
+	same("List", names(t, store, "")["described"])
+
+	if err := store.Rename(ctx, "described", "renamed"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	file, err = store.Stat(ctx, "renamed")
+	if err != nil {
+		t.Fatalf("Stat after Rename: %v", err)
+	}
+	same("Stat after Rename", file)
+
+	before := time.Now().Add(-time.Minute)
+	put(t, store, "plain", []byte("plain"))
+	file, err = store.Stat(ctx, "plain")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if file.ModTime.Before(before) {
+		t.Errorf("ModTime of a fresh Put is %v, want the time of writing", file.ModTime)
+	}
+}
+
+// testCopy goes through lgpd.Copy, so it covers a backend's own Copier as
+// well as the streamed fallback.
+func testCopy(t *testing.T, store lgpd.LGPD) {
+	ctx := context.Background()
+	value := []byte("copied")
+	original := lgpd.Metadata{ContentType: "text/plain", UserMeta: map[string]string{"a": "1", "b": "2"}}
+	if err := store.PutS(ctx, "src", bytes.NewReader(value), int64(len(value)), original); err != nil {
+		t.Fatalf("PutS: %v", err)
+	}
+	put(t, store, "dst", []byte("replaced"))
+	replaced := lgpd.Metadata{ContentType: "application/json", UserMeta: map[string]string{"a": "3"}}
+	if err := lgpd.Copy(ctx, store, "src", store, "dst", replaced); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	expect(t, store, "dst", value)
+	expect(t, store, "src", value)
+	file, err := store.Stat(ctx, "dst")
+	if err != nil {
+		t.Fatalf("Stat of the copy: %v", err)
+	}
+	if file.ContentType != replaced.ContentType || !reflect.DeepEqual(file.UserMeta, replaced.UserMeta) {
+		t.Errorf("copy has metadata %q %v, want %q %v", file.ContentType, file.UserMeta, replaced.ContentType, replaced.UserMeta)
+	}
+	file, err = store.Stat(ctx, "src")
+	if err != nil {
+		t.Fatalf("Stat of the source: %v", err)
+	}
+	if file.ContentType != original.ContentType || !reflect.DeepEqual(file.UserMeta, original.UserMeta) {
+		t.Errorf("source has metadata %q %v after Copy, want %q %v", file.ContentType, file.UserMeta, original.ContentType, original.UserMeta)
+	}
+	if got := names(t, store, ""); len(got) != 2 {
+		t.Errorf("List after Copy returned %d files, want 2", len(got))
+	}
+	if err := lgpd.Copy(ctx, store, "missing", store, "other", lgpd.Metadata{}); !errors.Is(err, lgpd.ErrNotFound) {
+		t.Errorf("Copy of a missing key: got %v, want lgpd.ErrNotFound", err)
+	}
+}
+
+func testLargeValue(t *testing.T, store lgpd.LGPD) {
+	value := make([]byte, 8<<20+13)
+	rand.New(rand.NewSource(1)).Read(value)
+	put(t, store, "large", value)
+	expect(t, store, "large", value)
+}
+
+func testUnicodeKey(t *testing.T, store lgpd.LGPD) {
+	keys := []string{"日本語/ファイル.txt", "emoji-😀", "spaces and 'quotes'", "percent%20sign", "back\\slash"}
+	for i, key := range keys {
+		put(t, store, key, []byte(fmt.Sprint(i)))
+	}
+	for i, key := range keys {
+		expect(t, store, key, []byte(fmt.Sprint(i)))
+	}
+	got := names(t, store, "")
+	for _, key := range keys {
+		if _, ok := got[key]; !ok {
+			t.Errorf("List is missing %q", key)
+		}
+	}
+}
+
+func testConcurrentWriters(t *testing.T, store lgpd.LGPD) {
+	const writers = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*2)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := context.Background()
+			errs <- store.Put(ctx, fmt.Sprintf("own-%d", i), []byte(fmt.Sprint(i)))
+			errs <- store.Put(ctx, "shared", []byte(fmt.Sprintf("writer %d", i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent Put: %v", err)
+		}
+	}
+	for i := 0; i < writers; i++ {
+		expect(t, store, fmt.Sprintf("own-%d", i), []byte(fmt.Sprint(i)))
+	}
+	shared, _, err := store.Get(context.Background(), "shared", false)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", "shared", err)
+	}
+	found := false
+	for i := 0; i < writers; i++ {
+		if string(shared) == fmt.Sprintf("writer %d", i) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("concurrent writers left %q under a shared key", shared)
+	}
+	if got := names(t, store, ""); len(got) != writers+1 {
+		t.Errorf("List returned %d files, want %d", len(got), writers+1)
+	}
+}
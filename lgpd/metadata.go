@@ -0,0 +1,19 @@
+package lgpd
+
+// MetadataChecker is implemented by backends that cannot keep every
+// Metadata with an object, so that a frontend can turn a put down before it
+// takes in the content.
+type MetadataChecker interface {
+	// CheckMetadata fails with ErrMetadataTooLarge if meta cannot be kept
+	// with an object.
+	CheckMetadata(meta Metadata) error
+}
+
+// CheckMetadata reports whether store can keep meta with an object. A store
+// that is not a MetadataChecker takes any.
+func CheckMetadata(store LGPD, meta Metadata) error {
+	if checker, ok := store.(MetadataChecker); ok {
+		return checker.CheckMetadata(meta)
+	}
+	return nil
+}
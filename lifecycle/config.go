@@ -0,0 +1,240 @@
+// Package lifecycle expires objects the way S3 lifecycle rules do. Each
+// bucket may be given a Configuration, and a Scanner goes through the
+// buckets from time to time, deleting what the rules say has expired: the
+// current versions of old objects, versions that have long stopped being
+// current, delete markers left on their own and multipart uploads that
+// were never completed.
+package lifecycle
+
+import (
+	"encoding/xml"
+	"strings"
+	"time"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+// The states a Rule can be in. Disabled rules are kept but not acted on.
+const (
+	Enabled  = "Enabled"
+	Disabled = "Disabled"
+)
+
+// maxRules and maxIDLength are the limits S3 puts on a configuration.
+const (
+	maxRules    = 1000
+	maxIDLength = 255
+)
+
+// ConfigError is why Validate turns a configuration down.
+type ConfigError struct {
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return "lifecycle: " + e.Reason
+}
+
+// Configuration is the lifecycle configuration of a bucket, as in a
+// PutBucketLifecycleConfiguration request.
+type Configuration struct {
+	XMLName xml.Name `xml:"LifecycleConfiguration"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	Rules   []Rule   `xml:"Rule"`
+}
+
+// Rule applies its actions to the objects its Filter selects. Prefix is
+// the filter of rules written before S3 had filters, and is only used
+// when Filter is nil.
+type Rule struct {
+	ID                             string                          `xml:"ID,omitempty"`
+	Status                         string                          `xml:"Status"`
+	Prefix                         string                          `xml:"Prefix,omitempty"`
+	Filter                         *Filter                         `xml:"Filter"`
+	Expiration                     *Expiration                     `xml:"Expiration"`
+	NoncurrentVersionExpiration    *NoncurrentVersionExpiration    `xml:"NoncurrentVersionExpiration"`
+	AbortIncompleteMultipartUpload *AbortIncompleteMultipartUpload `xml:"AbortIncompleteMultipartUpload"`
+}
+
+// Filter selects objects by key prefix, by a tag, or by both through And.
+// The emulator keeps no object tags, so a tag is matched against the user
+// metadata of the same name, which is lower case.
+type Filter struct {
+	Prefix string `xml:"Prefix,omitempty"`
+	Tag    *Tag   `xml:"Tag"`
+	And    *And   `xml:"And"`
+}
+
+type And struct {
+	Prefix string `xml:"Prefix,omitempty"`
+	Tags   []Tag  `xml:"Tag"`
+}
+
+type Tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+// Expiration deletes the current version of an object Days after it was
+// written, or every one on and after Date. ExpiredObjectDeleteMarker
+// instead deletes delete markers that no version is left behind.
+type Expiration struct {
+	Days                      int    `xml:"Days,omitempty"`
+	Date                      string `xml:"Date,omitempty"`
+	ExpiredObjectDeleteMarker bool   `xml:"ExpiredObjectDeleteMarker,omitempty"`
+}
+
+// NoncurrentVersionExpiration deletes a version for good NoncurrentDays
+// after a newer one took its place.
+type NoncurrentVersionExpiration struct {
+	NoncurrentDays int `xml:"NoncurrentDays"`
+}
+
+// AbortIncompleteMultipartUpload aborts a multipart upload that is still
+// open DaysAfterInitiation after it was started.
+type AbortIncompleteMultipartUpload struct {
+	DaysAfterInitiation int `xml:"DaysAfterInitiation"`
+}
+
+// Validate checks c the way S3 checks a PutBucketLifecycleConfiguration
+// body, returning a *ConfigError for the first problem found.
+func (c *Configuration) Validate() error {
+	if len(c.Rules) == 0 {
+		return &ConfigError{"a lifecycle configuration needs at least one rule"}
+	}
+	if len(c.Rules) > maxRules {
+		return &ConfigError{"a lifecycle configuration cannot have more than 1000 rules"}
+	}
+	ids := make(map[string]bool)
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.ID != "" {
+			if len(rule.ID) > maxIDLength {
+				return &ConfigError{"the ID of a rule cannot be longer than 255 characters"}
+			}
+			if ids[rule.ID] {
+				return &ConfigError{"rule ID " + rule.ID + " is used more than once"}
+			}
+			ids[rule.ID] = true
+		}
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rule *Rule) validate() error {
+	if rule.Status != Enabled && rule.Status != Disabled {
+		return &ConfigError{"the Status of a rule must be Enabled or Disabled"}
+	}
+	if rule.Expiration == nil && rule.NoncurrentVersionExpiration == nil && rule.AbortIncompleteMultipartUpload == nil {
+		return &ConfigError{"a rule must have at least one action"}
+	}
+	if rule.Filter != nil {
+		if rule.Prefix != "" {
+			return &ConfigError{"a rule cannot have both a Prefix and a Filter"}
+		}
+		if err := rule.Filter.validate(); err != nil {
+			return err
+		}
+	}
+	tagged := len(rule.tags()) != 0
+	if e := rule.Expiration; e != nil {
+		set := 0
+		if e.Days != 0 {
+			set++
+		}
+		if e.Date != "" {
+			set++
+		}
+		if e.ExpiredObjectDeleteMarker {
+			set++
+		}
+		if set != 1 {
+			return &ConfigError{"an Expiration must have exactly one of Days, Date and ExpiredObjectDeleteMarker"}
+		}
+		if e.Days < 0 {
+			return &ConfigError{"the Days of an Expiration must be a positive integer"}
+		}
+		if e.Date != "" {
+			date, err := time.Parse(time.RFC3339, e.Date)
+			if err != nil || !date.Equal(date.UTC().Truncate(day)) {
+				return &ConfigError{"the Date of an Expiration must be midnight UTC in ISO 8601 format"}
+			}
+		}
+		if e.ExpiredObjectDeleteMarker && tagged {
+			return &ConfigError{"ExpiredObjectDeleteMarker cannot be used with a tag filter"}
+		}
+	}
+	if n := rule.NoncurrentVersionExpiration; n != nil && n.NoncurrentDays <= 0 {
+		return &ConfigError{"NoncurrentDays must be a positive integer"}
+	}
+	if a := rule.AbortIncompleteMultipartUpload; a != nil {
+		if a.DaysAfterInitiation <= 0 {
+			return &ConfigError{"DaysAfterInitiation must be a positive integer"}
+		}
+		if tagged {
+			return &ConfigError{"AbortIncompleteMultipartUpload cannot be used with a tag filter"}
+		}
+	}
+	return nil
+}
+
+func (f *Filter) validate() error {
+	set := 0
+	if f.Prefix != "" {
+		set++
+	}
+	if f.Tag != nil {
+		set++
+	}
+	if f.And != nil {
+		set++
+	}
+	if set > 1 {
+		return &ConfigError{"a Filter must have only one of Prefix, Tag and And"}
+	}
+	if f.And != nil && len(f.And.Tags) == 0 {
+		return &ConfigError{"an And filter must have at least one Tag"}
+	}
+	return nil
+}
+
+// prefix is the key prefix of the objects rule applies to.
+func (rule *Rule) prefix() string {
+	switch {
+	case rule.Filter == nil:
+		return rule.Prefix
+	case rule.Filter.And != nil:
+		return rule.Filter.And.Prefix
+	}
+	return rule.Filter.Prefix
+}
+
+// tags are the tags an object must carry for rule to apply to it.
+func (rule *Rule) tags() []Tag {
+	switch {
+	case rule.Filter == nil:
+		return nil
+	case rule.Filter.And != nil:
+		return rule.Filter.And.Tags
+	case rule.Filter.Tag != nil:
+		return []Tag{*rule.Filter.Tag}
+	}
+	return nil
+}
+
+// matches reports whether rule applies to file.
+func (rule *Rule) matches(file lgpd.File) bool {
+	if !strings.HasPrefix(file.Name, rule.prefix()) {
+		return false
+	}
+	for _, tag := range rule.tags() {
+		value, ok := file.UserMeta[strings.ToLower(tag.Key)]
+		if !ok || value != tag.Value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,290 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/versioning"
+)
+
+// day is what rules count in. As in S3, objects expire at the first
+// midnight UTC after their time is up.
+const day = 24 * time.Hour
+
+// DefaultInterval is how long a Scanner waits between passes unless told
+// otherwise.
+const DefaultInterval = time.Hour
+
+// Uploads is implemented by the frontend holding multipart uploads, so
+// that a Scanner can abort the ones left incomplete.
+type Uploads interface {
+	// AbortUploads aborts the uploads into bucket, of keys starting with
+	// prefix, that were started no later than before, returning how many
+	// it aborted.
+	AbortUploads(bucket, prefix string, before time.Time) int
+}
+
+// Scanner applies the lifecycle configuration of each bucket to the
+// lgpd.LGPD it is served from. Noncurrent versions and delete markers are
+// only found in buckets served from a versioning.Store.
+type Scanner struct {
+	lock     sync.Mutex
+	interval time.Duration
+	sources  map[string]lgpd.LGPD
+	configs  map[string]*Configuration
+	uploads  Uploads
+	now      func() time.Time
+}
+
+// NewScanner returns a Scanner that makes a pass every interval, or every
+// DefaultInterval if interval is not positive.
+func NewScanner(interval time.Duration) *Scanner {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Scanner{
+		interval: interval,
+		sources:  make(map[string]lgpd.LGPD),
+		configs:  make(map[string]*Configuration),
+		now:      time.Now,
+	}
+}
+
+// SetSource makes source the storage of bucket.
+func (s *Scanner) SetSource(bucket string, source lgpd.LGPD) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sources[bucket] = source
+}
+
+// RemoveSource stops scanning bucket. Its configuration is kept.
+func (s *Scanner) RemoveSource(bucket string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sources, bucket)
+}
+
+// SetUploads lets s abort the incomplete multipart uploads held by u.
+func (s *Scanner) SetUploads(u Uploads) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.uploads = u
+}
+
+// SetConfiguration validates c and makes it the lifecycle configuration
+// of bucket. A nil configuration removes the one bucket had.
+func (s *Scanner) SetConfiguration(bucket string, c *Configuration) error {
+	if c != nil {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if c == nil {
+		delete(s.configs, bucket)
+		return nil
+	}
+	s.configs[bucket] = c
+	return nil
+}
+
+// Configuration returns the lifecycle configuration of bucket, or nil if it
+// has none.
+func (s *Scanner) Configuration(bucket string) *Configuration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.configs[bucket]
+}
+
+// Start makes a pass right away and then every interval, until quitctx is
+// done. quit is held until the pass under way has stopped.
+func (s *Scanner) Start(quitctx context.Context, quit *sync.WaitGroup) {
+	quit.Add(1)
+	go func() {
+		defer quit.Done()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			s.Scan(quitctx)
+			select {
+			case <-quitctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// bucketScan is what a pass needs to know of one bucket.
+type bucketScan struct {
+	name   string
+	source lgpd.LGPD
+	config *Configuration
+}
+
+// Scan makes one pass over the buckets that have both a source and a
+// configuration. Errors are logged, and leave the rest of a bucket to the
+// next pass.
+func (s *Scanner) Scan(ctx context.Context) {
+	s.lock.Lock()
+	var buckets []bucketScan
+	for name, config := range s.configs {
+		if source, ok := s.sources[name]; ok {
+			buckets = append(buckets, bucketScan{name, source, config})
+		}
+	}
+	uploads := s.uploads
+	now := s.now()
+	s.lock.Unlock()
+
+	for _, bucket := range buckets {
+		for i := range bucket.config.Rules {
+			if ctx.Err() != nil {
+				return
+			}
+			rule := &bucket.config.Rules[i]
+			if rule.Status != Enabled {
+				continue
+			}
+			if err := s.apply(ctx, bucket, rule, uploads, now); err != nil {
+				log.Printf("lifecycle: bucket %s, rule %q: %v", bucket.name, rule.ID, err)
+			}
+		}
+	}
+}
+
+// apply carries out the actions of rule on bucket.
+func (s *Scanner) apply(ctx context.Context, bucket bucketScan, rule *Rule, uploads Uploads, now time.Time) error {
+	if e := rule.Expiration; e != nil && !e.ExpiredObjectDeleteMarker {
+		if err := expireCurrent(ctx, bucket, rule, now); err != nil {
+			return err
+		}
+	}
+	store, versioned := bucket.source.(*versioning.Store)
+	markers := rule.Expiration != nil && rule.Expiration.ExpiredObjectDeleteMarker
+	if versioned && (rule.NoncurrentVersionExpiration != nil || markers) {
+		if err := expireVersions(ctx, bucket.name, store, rule, now); err != nil {
+			return err
+		}
+	}
+	if a := rule.AbortIncompleteMultipartUpload; a != nil && uploads != nil {
+		if n := uploads.AbortUploads(bucket.name, rule.prefix(), cutoff(now, a.DaysAfterInitiation)); n != 0 {
+			log.Printf("lifecycle: aborted %d incomplete uploads in bucket %s", n, bucket.name)
+		}
+	}
+	return nil
+}
+
+// cutoff is the latest time something can date from to have been around
+// for days by now.
+func cutoff(now time.Time, days int) time.Time {
+	return now.UTC().Truncate(day).AddDate(0, 0, -days)
+}
+
+// expireCurrent deletes the current versions rule has expired. In a
+// versioned bucket, that leaves a delete marker in their place.
+func expireCurrent(ctx context.Context, bucket bucketScan, rule *Rule, now time.Time) error {
+	due := func(file lgpd.File) bool {
+		return !file.ModTime.IsZero() && !file.ModTime.After(cutoff(now, rule.Expiration.Days))
+	}
+	if rule.Expiration.Date != "" {
+		date, _ := time.Parse(time.RFC3339, rule.Expiration.Date)
+		due = func(lgpd.File) bool { return !now.Before(date) }
+	}
+	files, err := bucket.source.List(ctx, rule.prefix())
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !rule.matches(file) || !due(file) {
+			continue
+		}
+		// a key written since the listing is not the object that expired
+		listed := file
+		unchanged := func(current lgpd.File) bool {
+			return current.ModTime.Equal(listed.ModTime) && current.Mark == listed.Mark
+		}
+		expired, err := expire(ctx, bucket.source, file.Name, unchanged)
+		if err != nil && !errors.Is(err, lgpd.ErrNotFound) {
+			return err
+		}
+		if expired {
+			log.Printf("lifecycle: %s/%s expired", bucket.name, file.Name)
+		}
+	}
+	return nil
+}
+
+// expire deletes key from source if match holds for what is there now,
+// reporting whether it did. A versioning.Store asks match under the lock of
+// key, so that no write slips in before the delete; other sources are only
+// checked just before it.
+func expire(ctx context.Context, source lgpd.LGPD, key string, match func(lgpd.File) bool) (bool, error) {
+	if store, ok := source.(*versioning.Store); ok {
+		return store.DeleteIf(ctx, key, match)
+	}
+	current, err := source.Stat(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if !match(current) {
+		return false, nil
+	}
+	return true, source.Delete(ctx, key)
+}
+
+// expireVersions deletes for good the noncurrent versions rule has
+// expired, and with ExpiredObjectDeleteMarker the delete markers that have
+// no versions left behind them.
+func expireVersions(ctx context.Context, bucket string, store *versioning.Store, rule *Rule, now time.Time) error {
+	versions, err := store.Versions(ctx, rule.prefix())
+	if err != nil {
+		return err
+	}
+	markers := rule.Expiration != nil && rule.Expiration.ExpiredObjectDeleteMarker
+	for start := 0; start < len(versions); {
+		end := start + 1
+		for end < len(versions) && versions[end].Name == versions[start].Name {
+			end++
+		}
+		// the versions of one key, newest first
+		key := versions[start:end]
+		start = end
+
+		left := len(key)
+		if n := rule.NoncurrentVersionExpiration; n != nil {
+			before := cutoff(now, n.NoncurrentDays)
+			for i := 1; i < len(key); i++ {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				// a version stopped being current when the one after
+				// it was written
+				v, superseded := key[i], key[i-1].ModTime
+				if v.VersionID == "" || superseded.IsZero() || superseded.After(before) || !rule.matches(v.File) {
+					continue
+				}
+				if _, err := store.Remove(ctx, v.Name, v.VersionID); err != nil && !errors.Is(err, lgpd.ErrNotFound) {
+					return err
+				}
+				left--
+				log.Printf("lifecycle: %s/%s version %s expired", bucket, v.Name, v.VersionID)
+			}
+		}
+		if latest := key[0]; markers && left == 1 && latest.DeleteMarker && latest.IsLatest && rule.matches(latest.File) {
+			if _, err := store.Remove(ctx, latest.Name, latest.VersionID); err != nil && !errors.Is(err, lgpd.ErrNotFound) {
+				return err
+			}
+			log.Printf("lifecycle: %s/%s delete marker expired", bucket, latest.Name)
+		}
+	}
+	return nil
+}
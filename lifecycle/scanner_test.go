@@ -0,0 +1,52 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/xiaokangwang/s3emu/backend/memory"
+	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/versioning"
+)
+
+func TestExpireSkipsRewrites(t *testing.T) {
+	ctx := context.Background()
+	for name, source := range map[string]lgpd.LGPD{
+		"memory":     memory.NewMemoryBackend(0, 0),
+		"versioning": versioning.New(memory.NewMemoryBackend(0, 0)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := source.Put(ctx, "a", []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+			listed, err := source.Stat(ctx, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			unchanged := func(current lgpd.File) bool {
+				return current.ModTime.Equal(listed.ModTime) && current.Mark == listed.Mark
+			}
+
+			// written again after the scan listed it
+			if err := source.Put(ctx, "a", []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+			if expired, err := expire(ctx, source, "a", unchanged); expired || err != nil {
+				t.Fatalf("expire of a rewritten key = %v, %v", expired, err)
+			}
+			value, _, err := source.Get(ctx, "a", false)
+			if err != nil || string(value) != "new" {
+				t.Fatalf("Get after expire = %q, %v", value, err)
+			}
+
+			listed, _ = source.Stat(ctx, "a")
+			if expired, err := expire(ctx, source, "a", unchanged); !expired || err != nil {
+				t.Fatalf("expire of an unchanged key = %v, %v", expired, err)
+			}
+			if _, err := source.Stat(ctx, "a"); !errors.Is(err, lgpd.ErrNotFound) {
+				t.Fatalf("Stat after expire: %v, want lgpd.ErrNotFound", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/xiaokangwang/s3emu/accessqueue"
+	"github.com/xiaokangwang/s3emu/backend/gdrive"
+	"github.com/xiaokangwang/s3emu/ftpd"
+	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/lifecycle"
+	"github.com/xiaokangwang/s3emu/s3in"
+	"github.com/xiaokangwang/s3emu/versioning"
+)
+
+// driveBuckets serves every folder inside a Drive folder as a bucket of
+// the same name, behind an AccessQueue of its own, and creates and removes
+// such folders when clients create and delete buckets.
+type driveBuckets struct {
+	lock    sync.Mutex
+	parent  *gdrive.GDriveBackend
+	conf    *BackupConfigure
+	quitctx context.Context
+	quit    *sync.WaitGroup
+	s3      *s3in.GoFakeS3
+	ftp     *ftpd.Ftpd
+	scanner *lifecycle.Scanner
+	buckets map[string]*driveBucket
+}
+
+type driveBucket struct {
+	folder *gdrive.GDriveBackend
+	queue  *accessqueue.AccessQueue
+	store  *versioning.Store
+	// stop ends the upload workers of queue.
+	stop context.CancelFunc
+}
+
+// load serves the folders already in the parent folder, leaving alone
+// those named like a bucket from the configuration.
+func (d *driveBuckets) load(ctx context.Context, configured map[string]lgpd.LGPD) error {
+	folders, err := d.parent.Folders(ctx)
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for name, folder := range folders {
+		if _, ok := configured[name]; ok {
+			log.Printf("folder %q is shadowed by the configured bucket of that name", name)
+			continue
+		}
+		d.serve(name, folder)
+	}
+	return nil
+}
+
+// serve puts folder behind a new AccessQueue and a versioning Store, and
+// registers it with both frontends and the lifecycle scanner. The caller
+// holds d.lock.
+func (d *driveBuckets) serve(name string, folder *gdrive.GDriveBackend) {
+	working, stop := context.WithCancel(d.quitctx)
+	queue := accessqueue.NewAccessQueue(d.conf.UploadWorker, d.conf.UploadBacklog, folder, working, d.quit, name, d.conf.StagingDir)
+	store := versioning.New(queue)
+	d.buckets[name] = &driveBucket{folder: folder, queue: queue, store: store, stop: stop}
+	d.s3.SetSource(name, store)
+	d.ftp.SetSource(name, store)
+	d.scanner.SetSource(name, store)
+}
+
+func (d *driveBuckets) CreateBucket(ctx context.Context, name string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.buckets[name]; ok {
+		return lgpd.ErrExists
+	}
+	folder, err := d.parent.CreateFolder(ctx, name)
+	if err != nil {
+		return err
+	}
+	d.serve(name, folder)
+	return nil
+}
+
+// DeleteBucket takes the bucket off both frontends before looking into
+// it, so nothing new can be written while it is found empty and removed.
+// A bucket that turns out not to be empty is put back.
+func (d *driveBuckets) DeleteBucket(ctx context.Context, name string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	bucket, ok := d.buckets[name]
+	if !ok {
+		return s3in.ErrBucketConfigured
+	}
+	d.s3.RemoveSource(name)
+	d.ftp.RemoveSource(name)
+	restore := func() {
+		d.s3.SetSource(name, bucket.store)
+		d.ftp.SetSource(name, bucket.store)
+	}
+
+	if err := bucket.queue.Flush(ctx); err != nil {
+		restore()
+		return err
+	}
+	// earlier versions and delete markers keep a bucket from being empty
+	versions, err := bucket.store.Versions(ctx, "")
+	if err != nil {
+		restore()
+		return err
+	}
+	if len(versions) != 0 {
+		restore()
+		return lgpd.ErrNotEmpty
+	}
+	if err := bucket.folder.RemoveFolder(ctx); err != nil {
+		restore()
+		return err
+	}
+	d.scanner.RemoveSource(name)
+	bucket.stop()
+	delete(d.buckets, name)
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xiaokangwang/s3emu/s3in"
+)
+
+const presignUsage = `usage: s3emu presign [flags] <config> <bucket>/<key>
+
+Prints a presigned URL for the object, signed with a key pair from the S3
+section of the configuration. The key may also be given as s3://bucket/key.
+
+`
+
+// presign runs the presign subcommand with args, the command line after
+// "presign".
+func presign(args []string) {
+	flags := flag.NewFlagSet("presign", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), presignUsage)
+		flags.PrintDefaults()
+	}
+	method := flags.String("method", "GET", "`method` the URL is good for, GET or PUT")
+	expires := flags.Duration("expires", time.Hour, "how long the URL stays valid, at most a week")
+	accessKey := flags.String("access-key", "", "access key to sign with; defaults to the first configured one")
+	region := flags.String("region", "us-east-1", "region to put in the signature")
+	endpoint := flags.String("endpoint", "", "base URL clients reach the server at; defaults to http:// and the S3 listen address")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	*method = strings.ToUpper(*method)
+	if *method != "GET" && *method != "PUT" {
+		fatalf("presign: unsupported method %s", *method)
+	}
+
+	conffile, err := loadConfig(flags.Arg(0))
+	if err != nil {
+		fatalf("presign: %v", err)
+	}
+	cred, ok := findCredential(conffile.S3.Credentials, *accessKey)
+	if !ok {
+		fatalf("presign: no such key pair in the S3 section of %s", flags.Arg(0))
+	}
+	base := *endpoint
+	if base == "" {
+		base, err = listenURL(conffile.S3.Listen)
+		if err != nil {
+			fatalf("presign: %v", err)
+		}
+	}
+	bucket, key, ok := splitObject(flags.Arg(1))
+	if !ok {
+		fatalf("presign: %q does not name an object as bucket/key", flags.Arg(1))
+	}
+
+	rawurl := strings.TrimSuffix(base, "/") + "/" + url.PathEscape(bucket) + "/" + escapeKey(key)
+	signed, err := s3in.Presign(*method, rawurl, cred.AccessKey, cred.SecretKey, *region, *expires, time.Now())
+	if err != nil {
+		fatalf("presign: %v", err)
+	}
+	fmt.Println(signed)
+}
+
+// findCredential picks the key pair with accessKey, or the first one when
+// accessKey is empty.
+func findCredential(creds []CredentialConfigure, accessKey string) (CredentialConfigure, bool) {
+	for _, cred := range creds {
+		if accessKey == "" || cred.AccessKey == accessKey {
+			return cred, true
+		}
+	}
+	return CredentialConfigure{}, false
+}
+
+// listenURL is the URL a local client reaches an S3 listen address at.
+func listenURL(listen string) (string, error) {
+	if listen == "" {
+		return "", fmt.Errorf("S3 is not configured to listen; give -endpoint")
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port), nil
+}
+
+// splitObject splits "bucket/key" or "s3://bucket/key".
+func splitObject(object string) (bucket, key string, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(object, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// escapeKey escapes each path segment of key, keeping the slashes.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestFindCredential(t *testing.T) {
+	creds := []CredentialConfigure{{AccessKey: "first", SecretKey: "1"}, {AccessKey: "second", SecretKey: "2"}}
+	if cred, ok := findCredential(creds, ""); !ok || cred.AccessKey != "first" {
+		t.Errorf("findCredential without a key = %+v, %v", cred, ok)
+	}
+	if cred, ok := findCredential(creds, "second"); !ok || cred.SecretKey != "2" {
+		t.Errorf("findCredential(second) = %+v, %v", cred, ok)
+	}
+	if _, ok := findCredential(creds, "third"); ok {
+		t.Error("findCredential found a key that is not configured")
+	}
+	if _, ok := findCredential(nil, ""); ok {
+		t.Error("findCredential found a key with none configured")
+	}
+}
+
+func TestListenURL(t *testing.T) {
+	for listen, want := range map[string]string{
+		":9000":          "http://127.0.0.1:9000",
+		"0.0.0.0:9000":   "http://127.0.0.1:9000",
+		"[::]:9000":      "http://127.0.0.1:9000",
+		"10.0.0.2:9000":  "http://10.0.0.2:9000",
+		"[::1]:9000":     "http://[::1]:9000",
+		"localhost:8080": "http://localhost:8080",
+	} {
+		if got, err := listenURL(listen); err != nil || got != want {
+			t.Errorf("listenURL(%q) = %q, %v, want %q", listen, got, err, want)
+		}
+	}
+	for _, listen := range []string{"", "9000"} {
+		if _, err := listenURL(listen); err == nil {
+			t.Errorf("listenURL(%q) succeeded", listen)
+		}
+	}
+}
+
+func TestSplitObject(t *testing.T) {
+	for object, want := range map[string][2]string{
+		"bucket/key":          {"bucket", "key"},
+		"bucket/dir/key":      {"bucket", "dir/key"},
+		"s3://bucket/dir/key": {"bucket", "dir/key"},
+	} {
+		bucket, key, ok := splitObject(object)
+		if !ok || bucket != want[0] || key != want[1] {
+			t.Errorf("splitObject(%q) = %q, %q, %v", object, bucket, key, ok)
+		}
+	}
+	for _, object := range []string{"bucket", "bucket/", "/key", "s3://bucket"} {
+		if _, _, ok := splitObject(object); ok {
+			t.Errorf("splitObject(%q) succeeded", object)
+		}
+	}
+}
+
+func TestEscapeKey(t *testing.T) {
+	if got, want := escapeKey("dir/a b?c#d/e"), "dir/a%20b%3Fc%23d/e"; got != want {
+		t.Errorf("escapeKey = %q, want %q", got, want)
+	}
+}
@@ -10,13 +10,21 @@ import (
 	"os/signal"
 	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	fserver "github.com/goftp/server"
 	"github.com/ld9999999999/go-interfacetools"
 	"github.com/nahanni/go-ucl"
 	"github.com/xiaokangwang/s3emu/accessqueue"
 	"github.com/xiaokangwang/s3emu/backend/gdrive"
+	"github.com/xiaokangwang/s3emu/backend/localfs"
+	"github.com/xiaokangwang/s3emu/backend/memory"
 	"github.com/xiaokangwang/s3emu/ftpd"
+	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/lifecycle"
+	"github.com/xiaokangwang/s3emu/s3in"
+	"github.com/xiaokangwang/s3emu/versioning"
 )
 
 type GDriveConfigure struct {
@@ -24,80 +32,383 @@ type GDriveConfigure struct {
 	Bucket  string `json:"Bucket"`
 }
 
+// GDriveBucketsConfigure serves each folder inside the Drive folder Parent
+// as a bucket of the same name. Clients creating or deleting a bucket
+// create or remove such a folder.
+type GDriveBucketsConfigure struct {
+	Parent string `json:"Parent"`
+}
+
+type LocalfsConfigure struct {
+	Root   string `json:"Root"`
+	Bucket string `json:"Bucket"`
+}
+
+// MemoryConfigure describes a bucket held in memory. MaxSize is in bytes
+// and TTL in seconds; zero means unlimited.
+type MemoryConfigure struct {
+	Bucket  string `json:"Bucket"`
+	MaxSize int    `json:"MaxSize"`
+	TTL     int    `json:"TTL"`
+}
+
+// BackendConfigure lists the buckets and where each is stored. Every bucket
+// is served through a versioning.Store, whether or not versioning is ever
+// enabled on it, and the store keeps the keys under .s3emu/ for itself:
+// objects stored there before are no longer listed, and reading or writing
+// them fails.
 type BackendConfigure struct {
-	Gdrive []GDriveConfigure `json:"Gdrive"`
+	Gdrive        []GDriveConfigure      `json:"Gdrive"`
+	GdriveBuckets GDriveBucketsConfigure `json:"GdriveBuckets"`
+	Localfs       []LocalfsConfigure     `json:"Localfs"`
+	Memory        []MemoryConfigure      `json:"Memory"`
+}
+
+// FrontendConfigure enables a frontend when Listen is set. For FTP, Listen
+// may be a bare port, which binds to 127.0.0.1 as ListenAddress always has.
+type FrontendConfigure struct {
+	Listen string `json:"Listen"`
+}
+
+type CredentialConfigure struct {
+	AccessKey string `json:"AccessKey"`
+	SecretKey string `json:"SecretKey"`
+}
+
+// CORSRuleConfigure is one CORS rule, as in a PutBucketCors request.
+// MaxAgeSeconds is how long browsers may cache a preflight answer.
+type CORSRuleConfigure struct {
+	AllowedOrigins []string `json:"AllowedOrigins"`
+	AllowedMethods []string `json:"AllowedMethods"`
+	AllowedHeaders []string `json:"AllowedHeaders"`
+	ExposeHeaders  []string `json:"ExposeHeaders"`
+	MaxAgeSeconds  int      `json:"MaxAgeSeconds"`
+}
+
+// BucketCORSConfigure is the CORS configuration Bucket starts with. A
+// client may replace it through ?cors until the server restarts.
+type BucketCORSConfigure struct {
+	Bucket string              `json:"Bucket"`
+	Rules  []CORSRuleConfigure `json:"Rules"`
+}
+
+// S3Configure is the S3 frontend. Without Credentials every request is
+// accepted unsigned, which is only fit for localhost. BaseDomains are the
+// domains buckets are served under virtual-hosted-style, such as
+// s3.example.com for bucket.s3.example.com; without any, bucket.localhost
+// is. TrustForwardedHost takes the host from X-Forwarded-Host, for use
+// behind a reverse proxy that sets it. Browsers are only let at buckets
+// given CORS rules.
+type S3Configure struct {
+	Listen             string                `json:"Listen"`
+	Credentials        []CredentialConfigure `json:"Credentials"`
+	BaseDomains        []string              `json:"BaseDomains"`
+	TrustForwardedHost bool                  `json:"TrustForwardedHost"`
+	CORS               []BucketCORSConfigure `json:"CORS"`
+}
+
+// LifecycleTagConfigure is a tag a lifecycle rule selects objects by. As
+// objects carry no tags, it is matched against their user metadata.
+type LifecycleTagConfigure struct {
+	Key   string `json:"Key"`
+	Value string `json:"Value"`
+}
+
+// LifecycleRuleConfigure is one lifecycle rule, for the objects under
+// Prefix that carry all of Tags. Each action is taken once its number of
+// days is set: ExpirationDays deletes current versions, NoncurrentDays
+// earlier versions and AbortIncompleteDays unfinished multipart uploads.
+// ExpiredObjectDeleteMarker removes delete markers left on their own.
+type LifecycleRuleConfigure struct {
+	ID                        string                  `json:"ID"`
+	Prefix                    string                  `json:"Prefix"`
+	Tags                      []LifecycleTagConfigure `json:"Tags"`
+	Disabled                  bool                    `json:"Disabled"`
+	ExpirationDays            int                     `json:"ExpirationDays"`
+	ExpiredObjectDeleteMarker bool                    `json:"ExpiredObjectDeleteMarker"`
+	NoncurrentDays            int                     `json:"NoncurrentDays"`
+	AbortIncompleteDays       int                     `json:"AbortIncompleteDays"`
+}
+
+// BucketLifecycleConfigure is the lifecycle configuration Bucket starts
+// with. A client may replace it through ?lifecycle until the server
+// restarts.
+type BucketLifecycleConfigure struct {
+	Bucket string                   `json:"Bucket"`
+	Rules  []LifecycleRuleConfigure `json:"Rules"`
+}
+
+// LifecycleConfigure has the lifecycle rules of every bucket applied each
+// Interval seconds, hourly if it is not set.
+type LifecycleConfigure struct {
+	Interval int                        `json:"Interval"`
+	Buckets  []BucketLifecycleConfigure `json:"Buckets"`
 }
 
 type BackupConfigure struct {
-	ListenAddress string           `json:"ListenAddress"`
-	UploadWorker  int              `json:"UploadWorker"`
-	UploadBacklog int              `json:"UploadBacklog"`
-	Backend       BackendConfigure `json:"Backend"`
+	// ListenAddress is the FTP port, kept for configurations that predate
+	// the FTP section.
+	ListenAddress string             `json:"ListenAddress"`
+	UploadWorker  int                `json:"UploadWorker"`
+	UploadBacklog int                `json:"UploadBacklog"`
+	StagingDir    string             `json:"StagingDir"`
+	S3            S3Configure        `json:"S3"`
+	FTP           FrontendConfigure  `json:"FTP"`
+	Backend       BackendConfigure   `json:"Backend"`
+	Lifecycle     LifecycleConfigure `json:"Lifecycle"`
 }
 
-func main() {
-	var conffile BackupConfigure
-	cfg, err := os.Open(os.Args[1])
-	if err != nil {
-		panic(err)
+// redacted is conf with the secret keys blanked out, fit for the log.
+func (conf BackupConfigure) redacted() BackupConfigure {
+	credentials := make([]CredentialConfigure, len(conf.S3.Credentials))
+	for i, cred := range conf.S3.Credentials {
+		credentials[i] = CredentialConfigure{AccessKey: cred.AccessKey, SecretKey: "REDACTED"}
 	}
+	conf.S3.Credentials = credentials
+	return conf
+}
 
-	p := ucl.NewParser(cfg)
-	result, err := p.Ucl()
+// shutdownTimeout is how long open S3 requests get to finish on shutdown.
+const shutdownTimeout = 30 * time.Second
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "presign" {
+		presign(os.Args[2:])
+		return
+	}
+	conffile, err := loadConfig(os.Args[1])
 	if err != nil {
 		panic(err)
 	}
-	interfacetools.CopyOut(result, &conffile)
-	fmt.Println(conffile)
+	fmt.Println(conffile.redacted())
 	var quitwaitgroup sync.WaitGroup
 	b := context.Background()
 	quitctx, cancel := context.WithCancel(b)
-	emu := ftpd.Ftpd{}
+	if conffile.StagingDir != "" {
+		if err := os.MkdirAll(conffile.StagingDir, 0700); err != nil {
+			panic(err)
+		}
+	}
+
+	// Both frontends serve the same sources, so an upload through one is
+	// ordered against reads through the other by the shared AccessQueue.
+	sources := make(map[string]lgpd.LGPD)
 	for _, conf := range conffile.Backend.Gdrive {
 		gaccess := gdrive.NewGDriveBackend(conf.Basedir)
-		accessQueue := accessqueue.NewAccessQueue(conffile.UploadWorker, conffile.UploadBacklog, gaccess, quitctx, &quitwaitgroup, conf.Bucket)
-		emu.SetSource(conf.Bucket, accessQueue)
+		sources[conf.Bucket] = accessqueue.NewAccessQueue(conffile.UploadWorker, conffile.UploadBacklog, gaccess, quitctx, &quitwaitgroup, conf.Bucket, conffile.StagingDir)
 	}
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	for _, conf := range conffile.Backend.Localfs {
+		laccess, err := localfs.NewLocalFSBackend(conf.Root)
+		if err != nil {
+			panic(err)
+		}
+		sources[conf.Bucket] = accessqueue.NewAccessQueue(conffile.UploadWorker, conffile.UploadBacklog, laccess, quitctx, &quitwaitgroup, conf.Bucket, conffile.StagingDir)
+	}
+	for _, conf := range conffile.Backend.Memory {
+		sources[conf.Bucket] = memory.NewMemoryBackend(int64(conf.MaxSize), time.Duration(conf.TTL)*time.Second)
+	}
+
+	emu := &ftpd.Ftpd{}
+	emu.SetContext(quitctx)
+	s3 := s3in.New()
+	s3.SetStagingDir(conffile.StagingDir)
+	scanner := lifecycle.NewScanner(time.Duration(conffile.Lifecycle.Interval) * time.Second)
+	scanner.SetUploads(s3)
+	s3.SetLifecycle(scanner)
+	for bucket, source := range sources {
+		// both frontends write through the same Store, so an FTP upload
+		// keeps the version it replaces as an S3 one does
+		store := versioning.New(source)
+		emu.SetSource(bucket, store)
+		s3.SetSource(bucket, store)
+		scanner.SetSource(bucket, store)
+	}
+	if parent := conffile.Backend.GdriveBuckets.Parent; parent != "" {
+		buckets := &driveBuckets{
+			parent:  gdrive.NewGDriveBackend(parent),
+			conf:    &conffile,
+			quitctx: quitctx,
+			quit:    &quitwaitgroup,
+			s3:      s3,
+			ftp:     emu,
+			scanner: scanner,
+			buckets: make(map[string]*driveBucket),
+		}
+		if err := buckets.load(quitctx, sources); err != nil {
+			panic(err)
+		}
+		s3.SetBucketManager(buckets)
+	}
+	for _, cred := range conffile.S3.Credentials {
+		s3.SetCredential(cred.AccessKey, cred.SecretKey)
+	}
+	if len(conffile.S3.BaseDomains) != 0 {
+		s3.SetBaseDomains(conffile.S3.BaseDomains...)
+	}
+	s3.SetTrustForwardedHost(conffile.S3.TrustForwardedHost)
+	for _, conf := range conffile.S3.CORS {
+		cors := &s3in.CORSConfiguration{}
+		for _, rule := range conf.Rules {
+			cors.Rules = append(cors.Rules, s3in.CORSRule{
+				AllowedOrigins: rule.AllowedOrigins,
+				AllowedMethods: rule.AllowedMethods,
+				AllowedHeaders: rule.AllowedHeaders,
+				ExposeHeaders:  rule.ExposeHeaders,
+				MaxAgeSeconds:  rule.MaxAgeSeconds,
+			})
+		}
+		if err := s3.SetBucketCORS(conf.Bucket, cors); err != nil {
+			log.Fatalf("CORS for bucket %s: %v", conf.Bucket, err)
+		}
+	}
+	for _, conf := range conffile.Lifecycle.Buckets {
+		rules := &lifecycle.Configuration{}
+		for _, rule := range conf.Rules {
+			rules.Rules = append(rules.Rules, lifecycleRule(rule))
+		}
+		if err := scanner.SetConfiguration(conf.Bucket, rules); err != nil {
+			log.Fatalf("lifecycle rules for bucket %s: %v", conf.Bucket, err)
+		}
+	}
+	scanner.Start(quitctx, &quitwaitgroup)
+
+	ftplisten := conffile.FTP.Listen
+	if ftplisten == "" {
+		ftplisten = conffile.ListenAddress
+	}
+	if conffile.S3.Listen == "" && ftplisten == "" {
+		log.Fatal("neither S3 nor FTP is configured to listen")
+	}
+
+	var serving sync.WaitGroup
+	var httpServer *http.Server
+	var ftpServer *fserver.Server
+	if conffile.S3.Listen != "" {
+		httpServer = &http.Server{Addr: conffile.S3.Listen, Handler: s3.Server()}
+		serving.Add(1)
+		go func() {
+			defer serving.Done()
+			listenAndServe(httpServer)
+		}()
+	}
+	if ftplisten != "" {
+		ftpServer = newFTPServer(ftplisten, emu)
+		serving.Add(1)
+		go func() {
+			defer serving.Done()
+			log.Println("ftp:", serveFTP(ftpServer, emu))
+		}()
+	}
+	stopped := make(chan struct{})
 	go func() {
-		<-c
-		cancel()
-		quitwaitgroup.Wait()
-		os.Exit(0)
+		serving.Wait()
+		close(stopped)
 	}()
-	listenAndServeFTP(conffile.ListenAddress, emu)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-c:
+	case <-stopped:
+	}
+
+	// Stop taking new requests, let the ones in flight finish, then let
+	// the queues drain before exiting.
+	if httpServer != nil {
+		shutdownctx, done := context.WithTimeout(b, shutdownTimeout)
+		httpServer.Shutdown(shutdownctx)
+		done()
+	}
+	if ftpServer != nil {
+		ftpServer.Shutdown()
+	}
+	cancel()
+	quitwaitgroup.Wait()
+}
+
+// loadConfig reads the UCL configuration file at path.
+func loadConfig(path string) (BackupConfigure, error) {
+	var conffile BackupConfigure
+	cfg, err := os.Open(path)
+	if err != nil {
+		return conffile, err
+	}
+	defer cfg.Close()
+
+	p := ucl.NewParser(cfg)
+	result, err := p.Ucl()
+	if err != nil {
+		return conffile, err
+	}
+	interfacetools.CopyOut(result, &conffile)
+	return conffile, nil
+}
+
+// lifecycleRule turns conf into the rule a PutBucketLifecycleConfiguration
+// request would have given.
+func lifecycleRule(conf LifecycleRuleConfigure) lifecycle.Rule {
+	rule := lifecycle.Rule{ID: conf.ID, Status: lifecycle.Enabled}
+	if conf.Disabled {
+		rule.Status = lifecycle.Disabled
+	}
+	var tags []lifecycle.Tag
+	for _, tag := range conf.Tags {
+		tags = append(tags, lifecycle.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	switch {
+	case len(tags) == 0:
+		rule.Filter = &lifecycle.Filter{Prefix: conf.Prefix}
+	case len(tags) == 1 && conf.Prefix == "":
+		rule.Filter = &lifecycle.Filter{Tag: &tags[0]}
+	default:
+		rule.Filter = &lifecycle.Filter{And: &lifecycle.And{Prefix: conf.Prefix, Tags: tags}}
+	}
+	if conf.ExpirationDays != 0 || conf.ExpiredObjectDeleteMarker {
+		rule.Expiration = &lifecycle.Expiration{Days: conf.ExpirationDays, ExpiredObjectDeleteMarker: conf.ExpiredObjectDeleteMarker}
+	}
+	if conf.NoncurrentDays != 0 {
+		rule.NoncurrentVersionExpiration = &lifecycle.NoncurrentVersionExpiration{NoncurrentDays: conf.NoncurrentDays}
+	}
+	if conf.AbortIncompleteDays != 0 {
+		rule.AbortIncompleteMultipartUpload = &lifecycle.AbortIncompleteMultipartUpload{DaysAfterInitiation: conf.AbortIncompleteDays}
+	}
+	return rule
 }
 
-func listenAndServe(addr string, handler http.Handler) {
-	listener, err := net.Listen("tcp", addr)
+func listenAndServe(server *http.Server) {
+	listener, err := net.Listen("tcp", server.Addr)
 	if err != nil {
 		log.Println("failed to listen:", err)
 		return
 	}
 
 	log.Println("using port:", listener.Addr().(*net.TCPAddr).Port)
-	server := &http.Server{Addr: addr, Handler: handler}
 	server.Serve(listener)
 }
 
-type Single struct {
-	r fserver.Driver
-}
-
-func (s *Single) NewDriver() (fserver.Driver, error) {
-	return s.r, nil
-}
+// openAuth lets every FTP user in.
+type openAuth struct{}
 
-func (s *Single) CheckPasswd(string, string) (bool, error) {
+func (openAuth) CheckPasswd(string, string) (bool, error) {
 	return true, nil
 }
 
-func listenAndServeFTP(addr string, handler ftpd.Ftpd) {
+func newFTPServer(addr string, handler *ftpd.Ftpd) *fserver.Server {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = "127.0.0.1", addr
+	}
+	i, _ := strconv.Atoi(port)
+	server := &fserver.ServerOpts{Hostname: host, Port: i, Factory: handler, Auth: openAuth{}}
+	return fserver.NewServer(server)
+}
 
-	i, _ := strconv.Atoi(addr)
-	fac := &Single{r: handler}
-	server := &fserver.ServerOpts{Hostname: "127.0.0.1", Port: i, Factory: fac, Auth: fac}
-	sins := fserver.NewServer(server)
-	sins.ListenAndServe()
+// serveFTP serves server on the address it was made for, through the
+// listener of handler, so that each connection has a context of its own.
+func serveFTP(server *fserver.Server, handler *ftpd.Ftpd) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(server.Hostname, strconv.Itoa(server.Port)))
+	if err != nil {
+		return err
+	}
+	return server.Serve(handler.Listener(listener))
 }
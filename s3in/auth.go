@@ -0,0 +1,364 @@
+package s3in
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signV4Algorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat   = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// maxClockSkew is how far the signing time of a header-signed request
+	// may be from our clock.
+	maxClockSkew = 15 * time.Minute
+	// maxPresignExpiry is the longest validity AWS allows a presigned URL.
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+var (
+	errAccessDenied = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errUnknownKey   = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records."}
+	errSignature    = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided. Check your key and signing method."}
+	errSkewed       = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the current time is too large."}
+	errExpired      = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errMalformed    = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	errQueryAuth    = &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "Query-string authentication version 4 requires the X-Amz-Algorithm, X-Amz-Credential, X-Amz-Signature, X-Amz-Date, X-Amz-SignedHeaders, and X-Amz-Expires parameters."}
+	errExpiresNaN   = &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires should be a number"}
+	errExpiresRange = &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be less than a week (in seconds) that is 604800"}
+	errExpiresSign  = &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be non-negative"}
+	errNotYetValid  = &s3Error{http.StatusForbidden, "AccessDenied", "Request is not valid yet"}
+	errHostUnsigned = &s3Error{http.StatusForbidden, "AccessDenied", "The host header must be signed."}
+	errTwoAuth      = &s3Error{http.StatusBadRequest, "InvalidArgument", "Only one auth mechanism allowed; only the X-Amz-Algorithm query parameter or the Authorization header should be specified"}
+	errPayloadHash  = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+	errStreaming    = &s3Error{http.StatusNotImplemented, "NotImplemented", "Only HMAC-SHA256 signatures are supported for streaming uploads."}
+)
+
+// signature holds the parts of a SigV4 signature, whether they came from
+// the Authorization header or from a presigned URL.
+type signature struct {
+	accessKey     string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	payloadHash   string
+}
+
+// SetCredential adds a key pair that may sign requests. As long as none is
+// set, every request is served anonymously.
+func (g *GoFakeS3) SetCredential(accessKey, secretKey string) {
+	if g.credentials == nil {
+		g.credentials = make(map[string]string)
+	}
+	g.credentials[accessKey] = secretKey
+}
+
+// authenticate checks the SigV4 signature of r against the configured
+// credentials. It must see the request as the client sent it, before any
+// path rewriting. An aws-chunked body is decoded, its chunk signatures
+// checked against the seed signature of a signed stream; those of
+// anonymous clients are not checked.
+func (g *GoFakeS3) authenticate(r *http.Request) *s3Error {
+	if len(g.credentials) == 0 {
+		return decodeChunked(r, nil)
+	}
+	if isFormPost(r) {
+		// a browser upload is signed through its policy instead, which
+		// CreateObjectBrowserUpload checks
+		return nil
+	}
+	var sig *signature
+	var serr *s3Error
+	switch {
+	case r.Header.Get("Authorization") != "" && r.URL.Query().Get("X-Amz-Algorithm") != "":
+		return errTwoAuth
+	case r.Header.Get("Authorization") != "":
+		sig, serr = parseAuthorizationHeader(r, g.timeNow())
+	case r.URL.Query().Get("X-Amz-Algorithm") != "":
+		sig, serr = parsePresigned(r, g.timeNow())
+	default:
+		return errAccessDenied
+	}
+	if serr != nil {
+		return serr
+	}
+
+	secret, ok := g.credentials[sig.accessKey]
+	if !ok {
+		return errUnknownKey
+	}
+	if sig.service != "s3" || sig.amzDate.Format("20060102") != sig.date {
+		return errMalformed
+	}
+	if !signsHost(sig.signedHeaders) {
+		return errHostUnsigned
+	}
+	expected := sig.sign(secret, canonicalRequest(r, sig))
+	if !hmac.Equal([]byte(expected), []byte(sig.signature)) {
+		return errSignature
+	}
+
+	switch sig.payloadHash {
+	case streamingSigned, streamingSignedTrailer:
+		return decodeChunked(r, &chunkSigner{
+			key:      sig.signingKey(secret),
+			amzDate:  sig.amzDate.UTC().Format(amzDateFormat),
+			scope:    sig.scope(),
+			previous: sig.signature,
+			trailer:  sig.payloadHash == streamingSignedTrailer,
+		})
+	case streamingUnsignedTrailer, unsignedPayload:
+		return decodeChunked(r, nil)
+	}
+	if strings.HasPrefix(sig.payloadHash, streamingPrefix) {
+		return errStreaming
+	}
+	want, err := hex.DecodeString(sig.payloadHash)
+	if err != nil || len(want) != sha256.Size {
+		return errPayloadHash
+	}
+	// the hash is of the body as sent, aws-chunked or not
+	r.Body = &verifyingReader{r: r.Body, hash: sha256.New(), want: want, mismatch: errPayloadHash}
+	return decodeChunked(r, nil)
+}
+
+func parseAuthorizationHeader(r *http.Request, now time.Time) (*signature, *s3Error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, signV4Algorithm+" ") {
+		return nil, &s3Error{http.StatusBadRequest, "InvalidRequest", "Please use " + signV4Algorithm + "."}
+	}
+	sig := &signature{}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(auth, signV4Algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, errMalformed
+		}
+		fields[kv[0]] = kv[1]
+	}
+	if !sig.parseCredential(fields["Credential"]) || fields["SignedHeaders"] == "" || fields["Signature"] == "" {
+		return nil, errMalformed
+	}
+	sig.signedHeaders = strings.Split(fields["SignedHeaders"], ";")
+	sig.signature = fields["Signature"]
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	var err error
+	if amzDate != "" {
+		sig.amzDate, err = time.Parse(amzDateFormat, amzDate)
+	} else {
+		sig.amzDate, err = http.ParseTime(r.Header.Get("Date"))
+	}
+	if err != nil {
+		return nil, &s3Error{http.StatusForbidden, "AccessDenied", "AWS authentication requires a valid Date or x-amz-date header"}
+	}
+	if skew := now.Sub(sig.amzDate); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, errSkewed
+	}
+
+	sig.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if sig.payloadHash == "" {
+		return nil, &s3Error{http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256"}
+	}
+	return sig, nil
+}
+
+func parsePresigned(r *http.Request, now time.Time) (*signature, *s3Error) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != signV4Algorithm {
+		return nil, errQueryAuth
+	}
+	sig := &signature{}
+	if !sig.parseCredential(query.Get("X-Amz-Credential")) {
+		return nil, errQueryAuth
+	}
+	var err error
+	sig.amzDate, err = time.Parse(amzDateFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errQueryAuth
+	}
+	if query.Get("X-Amz-SignedHeaders") == "" || query.Get("X-Amz-Signature") == "" || query.Get("X-Amz-Expires") == "" {
+		return nil, errQueryAuth
+	}
+	expires, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+	switch {
+	case err != nil:
+		return nil, errExpiresNaN
+	case expires < 0:
+		return nil, errExpiresSign
+	case expires > int64(maxPresignExpiry/time.Second):
+		return nil, errExpiresRange
+	}
+	if now.Before(sig.amzDate.Add(-maxClockSkew)) {
+		return nil, errNotYetValid
+	}
+	if now.After(sig.amzDate.Add(time.Duration(expires) * time.Second)) {
+		return nil, errExpired
+	}
+	sig.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	sig.signature = query.Get("X-Amz-Signature")
+	// A presigned URL leaves the payload unsigned unless it pins the hash.
+	sig.payloadHash = query.Get("X-Amz-Content-Sha256")
+	if sig.payloadHash == "" {
+		sig.payloadHash = unsignedPayload
+	}
+	return sig, nil
+}
+
+// signsHost reports whether host is among the signed headers, as SigV4
+// requires.
+func signsHost(signedHeaders []string) bool {
+	for _, name := range signedHeaders {
+		if name == "host" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCredential splits "AKID/20060102/region/s3/aws4_request".
+func (sig *signature) parseCredential(credential string) bool {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return false
+	}
+	sig.accessKey, sig.date, sig.region, sig.service = parts[0], parts[1], parts[2], parts[3]
+	return true
+}
+
+func (sig *signature) scope() string {
+	return strings.Join([]string{sig.date, sig.region, sig.service, "aws4_request"}, "/")
+}
+
+// sign computes the hex signature of canonical with secret.
+func (sig *signature) sign(secret, canonical string) string {
+	hashed := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{
+		signV4Algorithm,
+		sig.amzDate.UTC().Format(amzDateFormat),
+		sig.scope(),
+		hex.EncodeToString(hashed[:]),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(sig.signingKey(secret), stringToSign))
+}
+
+// signingKey derives the key for the scope of sig from secret.
+func (sig *signature) signingKey(secret string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), sig.date)
+	key = hmacSHA256(key, sig.region)
+	key = hmacSHA256(key, sig.service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalRequest(r *http.Request, sig *signature) string {
+	var headers strings.Builder
+	for _, name := range sig.signedHeaders {
+		headers.WriteString(name)
+		headers.WriteString(":")
+		headers.WriteString(headerValue(r, name))
+		headers.WriteString("\n")
+	}
+	return strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		canonicalQuery(r.URL.Query()),
+		headers.String(),
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payloadHash,
+	}, "\n")
+}
+
+// headerValue returns the trimmed, comma joined values of header name,
+// with runs of spaces collapsed as SigV4 requires.
+func headerValue(r *http.Request, name string) string {
+	var values []string
+	switch name {
+	case "host":
+		values = []string{r.Host}
+	case "content-length":
+		values = r.Header[http.CanonicalHeaderKey(name)]
+		if len(values) == 0 && r.ContentLength >= 0 {
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		}
+	default:
+		values = r.Header[http.CanonicalHeaderKey(name)]
+	}
+	for i, v := range values {
+		values[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(values, ",")
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes s the way SigV4 expects: every byte but the
+// unreserved characters, and '/' too when encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	const hexdigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexdigits[c>>4])
+		b.WriteByte(hexdigits[c&15])
+	}
+	return b.String()
+}
+
+// verifyingReader fails the final read of a body whose hash is not the one
+// the client declared, such as the signed SHA-256, with mismatch. A
+// corrupted upload is thereby never stored.
+type verifyingReader struct {
+	r        io.ReadCloser
+	hash     hash.Hash
+	want     []byte
+	mismatch *s3Error
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(v.hash.Sum(nil), v.want) {
+		return n, v.mismatch
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.r.Close()
+}
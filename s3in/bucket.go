@@ -0,0 +1,75 @@
+package s3in
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+// BucketManager creates and removes buckets on behalf of CreateBucket and
+// DeleteBucket. It registers a bucket it creates with every frontend, this
+// one included through SetSource, and unregisters one it removes likewise.
+type BucketManager interface {
+	// CreateBucket makes a new, empty bucket called name. It fails with
+	// lgpd.ErrExists if the storage for name is already there.
+	CreateBucket(ctx context.Context, name string) error
+	// DeleteBucket removes the bucket name. It fails with lgpd.ErrNotEmpty
+	// while the bucket holds objects, and with ErrBucketConfigured for a
+	// bucket it did not create.
+	DeleteBucket(ctx context.Context, name string) error
+}
+
+// ErrBucketConfigured is what a BucketManager reports for a bucket that
+// comes from the server configuration and so cannot be removed.
+var ErrBucketConfigured error = &s3Error{http.StatusForbidden, "AccessDenied", "Buckets configured on the server cannot be deleted through the API."}
+
+var (
+	errBucketNotEmpty    = &s3Error{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty"}
+	errInvalidBucketName = &s3Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid."}
+	errBucketsFixed      = &s3Error{http.StatusNotImplemented, "NotImplemented", "Buckets are configured on the server and cannot be created through the API."}
+)
+
+// bucketNamePattern is the S3 rule for the name of a new bucket: 3 to 63
+// lower case letters, digits, dots and hyphens, starting and ending with a
+// letter or digit.
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+func validBucketName(name string) bool {
+	return bucketNamePattern.MatchString(name) && !strings.Contains(name, "..")
+}
+
+// SetBucketManager lets clients create and delete buckets through m.
+// Without one, the buckets are those given to SetSource.
+func (g *GoFakeS3) SetBucketManager(m BucketManager) {
+	g.manager = m
+}
+
+// RemoveSource stops serving the bucket bk.
+func (g *GoFakeS3) RemoveSource(bk string) {
+	g.accessLock.Lock()
+	defer g.accessLock.Unlock()
+	delete(g.access, bk)
+}
+
+func (g *GoFakeS3) source(bk string) (lgpd.LGPD, bool) {
+	g.accessLock.RLock()
+	defer g.accessLock.RUnlock()
+	hd, ok := g.access[bk]
+	return hd, ok
+}
+
+// buckets names the buckets being served, in order.
+func (g *GoFakeS3) buckets() []string {
+	g.accessLock.RLock()
+	defer g.accessLock.RUnlock()
+	names := make([]string, 0, len(g.access))
+	for bk := range g.access {
+		names = append(names, bk)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,100 @@
+package s3in
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/xiaokangwang/s3emu/backend/memory"
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+// memoryManager keeps the buckets it creates in memory. The buckets it did
+// not create count as configured.
+type memoryManager struct {
+	g       *GoFakeS3
+	created map[string]lgpd.LGPD
+}
+
+func (m *memoryManager) CreateBucket(ctx context.Context, name string) error {
+	if _, ok := m.created[name]; ok {
+		return lgpd.ErrExists
+	}
+	m.created[name] = memory.NewMemoryBackend(0, 0)
+	m.g.SetSource(name, m.created[name])
+	return nil
+}
+
+func (m *memoryManager) DeleteBucket(ctx context.Context, name string) error {
+	bucket, ok := m.created[name]
+	if !ok {
+		return ErrBucketConfigured
+	}
+	files, err := bucket.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return lgpd.ErrNotEmpty
+	}
+	delete(m.created, name)
+	m.g.RemoveSource(name)
+	return nil
+}
+
+func TestCreateDeleteBucket(t *testing.T) {
+	g, h := newTestServer(t)
+	g.SetBucketManager(&memoryManager{g: g, created: make(map[string]lgpd.LGPD)})
+
+	w := do(t, h, "PUT", "/new-bucket", nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Location") != "/new-bucket" {
+		t.Fatalf("PUT bucket: %v %v %s", w.Code, w.Header(), w.Body)
+	}
+	if w := do(t, h, "HEAD", "/new-bucket", nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("HEAD of the new bucket: %v", w.Code)
+	}
+	if w := do(t, h, "GET", "/", nil, nil); !strings.Contains(w.Body.String(), "<Name>new-bucket</Name>") {
+		t.Errorf("the new bucket is not listed: %s", w.Body)
+	}
+	if w := do(t, h, "PUT", "/new-bucket", nil, nil); w.Code != http.StatusConflict || errorCode(w) != "BucketAlreadyExists" {
+		t.Errorf("PUT of an existing bucket: %v %s", w.Code, w.Body)
+	}
+
+	do(t, h, "PUT", "/new-bucket/a", strings.NewReader("a"), nil)
+	if w := do(t, h, "DELETE", "/new-bucket", nil, nil); w.Code != http.StatusConflict || errorCode(w) != "BucketNotEmpty" {
+		t.Errorf("DELETE of a bucket holding an object: %v %s", w.Code, w.Body)
+	}
+	do(t, h, "DELETE", "/new-bucket/a", nil, nil)
+	if w := do(t, h, "DELETE", "/new-bucket", nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE of an empty bucket: %v %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "HEAD", "/new-bucket", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a deleted bucket: %v", w.Code)
+	}
+
+	if w := do(t, h, "DELETE", "/bucket", nil, nil); w.Code != http.StatusForbidden || errorCode(w) != "AccessDenied" {
+		t.Errorf("DELETE of a configured bucket: %v %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "DELETE", "/nobucket", nil, nil); w.Code != http.StatusNotFound || errorCode(w) != "NoSuchBucket" {
+		t.Errorf("DELETE of a missing bucket: %v %s", w.Code, w.Body)
+	}
+	for _, name := range []string{"ab", "Upper", "a..b", "-leading"} {
+		if w := do(t, h, "PUT", "/"+name, nil, nil); w.Code != http.StatusBadRequest || errorCode(w) != "InvalidBucketName" {
+			t.Errorf("PUT bucket %q: %v %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestBucketsFixed(t *testing.T) {
+	_, h := newTestServer(t)
+	if w := do(t, h, "PUT", "/new-bucket", nil, nil); w.Code != http.StatusNotImplemented {
+		t.Errorf("PUT bucket without a manager: %v %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "PUT", "/bucket", nil, nil); errorCode(w) != "BucketAlreadyExists" {
+		t.Errorf("PUT of a configured bucket: %v %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "DELETE", "/bucket", nil, nil); w.Code != http.StatusForbidden {
+		t.Errorf("DELETE bucket without a manager: %v %s", w.Code, w.Body)
+	}
+}
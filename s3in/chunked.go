@@ -0,0 +1,271 @@
+package s3in
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// streamingPrefix starts every x-amz-content-sha256 value that
+	// announces an aws-chunked body, signed chunk by chunk or not.
+	streamingPrefix = "STREAMING-"
+	// The x-amz-content-sha256 values of the streams taken: chunks signed
+	// with HMAC-SHA256, with or without signed trailers, and unsigned
+	// chunks whose trailers carry a checksum.
+	streamingSigned          = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingSignedTrailer   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	chunkAlgorithm   = "AWS4-HMAC-SHA256-PAYLOAD"
+	trailerAlgorithm = "AWS4-HMAC-SHA256-TRAILER"
+	// emptySHA256 is the hex SHA-256 of nothing, which stands for the
+	// chunk headers in the string a chunk signature signs.
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var (
+	errChunkedLength = &s3Error{http.StatusLengthRequired, "MissingContentLength", "You must provide the x-amz-decoded-content-length HTTP header."}
+	errChunkedBody   = &s3Error{http.StatusBadRequest, "IncompleteBody", "The request body is not valid aws-chunked encoding."}
+)
+
+// isAWSChunked reports whether the body of r is in the aws-chunked encoding
+// the SDKs use for streaming uploads, rather than the object itself.
+func isAWSChunked(r *http.Request) bool {
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), streamingPrefix) {
+		return true
+	}
+	for _, coding := range strings.Split(r.Header.Get("Content-Encoding"), ",") {
+		if strings.TrimSpace(coding) == "aws-chunked" {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeChunked replaces an aws-chunked body of r with the object it
+// carries, so that it is not stored encoded. With a nil signer the chunk
+// signatures are not checked, which is only right for anonymous requests
+// and unsigned streams.
+func decodeChunked(r *http.Request, signer *chunkSigner) *s3Error {
+	if !isAWSChunked(r) {
+		return nil
+	}
+	length, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return errChunkedLength
+	}
+	chunked := &chunkedReader{r: bufio.NewReader(r.Body), body: r.Body, want: length, signer: signer}
+	if signer != nil {
+		chunked.hash = sha256.New()
+	}
+	r.Body = chunked
+	r.ContentLength = length
+	r.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+
+	// aws-chunked describes the transfer, not the stored object
+	var codings []string
+	for _, coding := range strings.Split(r.Header.Get("Content-Encoding"), ",") {
+		if coding = strings.TrimSpace(coding); coding != "" && coding != "aws-chunked" {
+			codings = append(codings, coding)
+		}
+	}
+	if len(codings) == 0 {
+		r.Header.Del("Content-Encoding")
+	} else {
+		r.Header.Set("Content-Encoding", strings.Join(codings, ","))
+	}
+	return nil
+}
+
+// chunkSigner checks the chunk signatures of a signed stream. Each chunk
+// signs its data and the signature of the chunk before it, the first one
+// the seed signature of the request, so chunks can be neither altered nor
+// reordered or dropped.
+type chunkSigner struct {
+	key      []byte
+	amzDate  string
+	scope    string
+	previous string
+	// trailer is set when the trailers are signed as well
+	trailer bool
+}
+
+// check reports whether claimed is the signature of the next chunk, whose
+// data hashes to sum.
+func (cs *chunkSigner) check(claimed string, sum []byte) bool {
+	return cs.chain(claimed, chunkAlgorithm, emptySHA256, hex.EncodeToString(sum))
+}
+
+// checkTrailer reports whether claimed is the signature of the canonical
+// trailers.
+func (cs *chunkSigner) checkTrailer(claimed string, trailers string) bool {
+	sum := sha256.Sum256([]byte(trailers))
+	return cs.chain(claimed, trailerAlgorithm, hex.EncodeToString(sum[:]))
+}
+
+func (cs *chunkSigner) chain(claimed, algorithm string, hashes ...string) bool {
+	stringToSign := strings.Join(append([]string{algorithm, cs.amzDate, cs.scope, cs.previous}, hashes...), "\n")
+	expected := hex.EncodeToString(hmacSHA256(cs.key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(claimed)) {
+		return false
+	}
+	cs.previous = expected
+	return true
+}
+
+// chunkedReader reads the data out of an aws-chunked body: chunks of
+// "hex-size[;chunk-signature=...]\r\n", the data and "\r\n", ended by a
+// chunk of size zero and the trailers, if any. It fails with
+// errChunkedBody if the encoding is broken or the data is not want bytes,
+// and with errSignature if a signer is given and a signature is wrong. A
+// chunk is checked once it has been read whole, so a bad one fails the
+// upload rather than being kept from the reader.
+type chunkedReader struct {
+	r    *bufio.Reader
+	body io.Closer
+	want int64
+	read int64
+	// left is what remains of the current chunk
+	left int64
+	done bool
+
+	signer *chunkSigner
+	// hash and claimed are the hash of the current chunk so far and the
+	// signature it came with
+	hash    hash.Hash
+	claimed string
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	c.read += int64(n)
+	if c.hash != nil {
+		c.hash.Write(p[:n])
+	}
+	if c.read > c.want {
+		return n, errChunkedBody
+	}
+	if c.left == 0 {
+		if crlf, err := c.line(); err != nil || len(crlf) != 0 {
+			return n, errChunkedBody
+		}
+		if c.signer != nil && !c.signer.check(c.claimed, c.hash.Sum(nil)) {
+			return n, errSignature
+		}
+	} else if err == io.EOF {
+		return n, errChunkedBody
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// next reads the header of the following chunk, and the trailers after the
+// last one.
+func (c *chunkedReader) next() error {
+	header, err := c.line()
+	if err != nil {
+		return errChunkedBody
+	}
+	c.claimed = ""
+	if i := bytes.IndexByte(header, ';'); i >= 0 {
+		for _, ext := range strings.Split(string(header[i+1:]), ";") {
+			if kv := strings.SplitN(strings.TrimSpace(ext), "=", 2); len(kv) == 2 && kv[0] == "chunk-signature" {
+				c.claimed = kv[1]
+			}
+		}
+		header = header[:i]
+	}
+	size, err := strconv.ParseInt(string(bytes.TrimSpace(header)), 16, 64)
+	if err != nil || size < 0 {
+		return errChunkedBody
+	}
+	if c.hash != nil {
+		c.hash.Reset()
+	}
+	if size > 0 {
+		c.left = size
+		return nil
+	}
+	if c.signer != nil && !c.signer.check(c.claimed, c.hash.Sum(nil)) {
+		return errSignature
+	}
+	// the trailers run up to an empty line, or to the end of the body
+	var trailers strings.Builder
+	trailerSignature := ""
+	for {
+		trailer, err := c.line()
+		if err == io.EOF || err == nil && len(trailer) == 0 {
+			break
+		}
+		if err != nil {
+			return errChunkedBody
+		}
+		kv := strings.SplitN(string(trailer), ":", 2)
+		if len(kv) != 2 {
+			return errChunkedBody
+		}
+		name, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		if name == "x-amz-trailer-signature" {
+			trailerSignature = value
+			continue
+		}
+		trailers.WriteString(name + ":" + value + "\n")
+	}
+	if c.signer != nil && c.signer.trailer && !c.signer.checkTrailer(trailerSignature, trailers.String()) {
+		return errSignature
+	}
+	c.done = true
+	if c.read != c.want {
+		return errChunkedBody
+	}
+	// nothing may follow; reading up to the end also lets a
+	// verifyingReader underneath check the body as sent
+	if _, err := c.r.Peek(1); err != io.EOF {
+		if err == nil {
+			return errChunkedBody
+		}
+		return err
+	}
+	return nil
+}
+
+// line reads up to the next "\r\n", returning what came before it.
+func (c *chunkedReader) line() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		if err == io.EOF && len(line) == 0 {
+			return nil, io.EOF
+		}
+		return nil, errChunkedBody
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errChunkedBody
+	}
+	return line[:len(line)-2], nil
+}
+
+func (c *chunkedReader) Close() error {
+	return c.body.Close()
+}
@@ -0,0 +1,127 @@
+package s3in
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+var (
+	errPreconditionFailed  = &s3Error{http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold"}
+	errInvalidDigest       = &s3Error{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified was invalid."}
+	errBadDigest           = &s3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received."}
+	errConditionalConflict = &s3Error{http.StatusConflict, "ConditionalRequestConflict", "A conflicting conditional operation is currently in progress against this resource. Please try again."}
+)
+
+// checkPreconditions evaluates the RFC 7232 preconditions of a GET or HEAD
+// against file, in the order the RFC gives: If-Match, else
+// If-Unmodified-Since, then If-None-Match, else If-Modified-Since. When the
+// request must not go on it answers 304 or 412 itself and reports false.
+func (g *GoFakeS3) checkPreconditions(w http.ResponseWriter, r *http.Request, file lgpd.File) bool {
+	modified := g.modTime(file).Truncate(time.Second)
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !etagMatches(match, entityTag(file), false) {
+			writeError(w, r, errPreconditionFailed)
+			return false
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil {
+		if modified.After(since) {
+			writeError(w, r, errPreconditionFailed)
+			return false
+		}
+	}
+
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if etagMatches(match, entityTag(file), true) {
+			g.notModified(w, file)
+			return false
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		if !modified.After(since) {
+			g.notModified(w, file)
+			return false
+		}
+	}
+	return true
+}
+
+// notModified answers 304, still naming the current version of file.
+func (g *GoFakeS3) notModified(w http.ResponseWriter, file lgpd.File) {
+	w.Header().Del("Content-Type")
+	w.Header().Set("ETag", "\""+entityTag(file)+"\"")
+	w.Header().Set("Last-Modified", g.modTime(file).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// etagMatches reports whether the entity tag list of an If-Match or
+// If-None-Match header names mark. Weak tags only match when weak is set,
+// as If-None-Match uses the weak comparison and If-Match the strong one.
+func etagMatches(header, mark string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if strings.Trim(tag, "\"") == mark {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyContentMD5 makes the body of r fail with BadDigest when it does not
+// hash to the Content-MD5 the client sent, so the object is never stored.
+func verifyContentMD5(r *http.Request) *s3Error {
+	header := r.Header.Get("Content-MD5")
+	if header == "" {
+		return nil
+	}
+	want, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || len(want) != md5.Size {
+		return errInvalidDigest
+	}
+	r.Body = &verifyingReader{r: r.Body, hash: md5.New(), want: want, mismatch: errBadDigest}
+	return nil
+}
+
+// createOnly carries out a PUT with If-None-Match: * by calling put only
+// when key is absent. Two such PUTs of one key racing each other cannot
+// both see it absent: the later one fails with ConditionalRequestConflict.
+func (g *GoFakeS3) createOnly(r *http.Request, access lgpd.LGPD, bucket, key string, put func() error) error {
+	name := bucket + "/" + key
+	g.conditional.Lock()
+	if g.creating[name] {
+		g.conditional.Unlock()
+		return errConditionalConflict
+	}
+	if g.creating == nil {
+		g.creating = make(map[string]bool)
+	}
+	g.creating[name] = true
+	g.conditional.Unlock()
+	defer func() {
+		g.conditional.Lock()
+		delete(g.creating, name)
+		g.conditional.Unlock()
+	}()
+
+	_, err := access.Stat(r.Context(), key)
+	if err == nil {
+		return errPreconditionFailed
+	}
+	if !errors.Is(err, lgpd.ErrNotFound) {
+		return err
+	}
+	return put()
+}
@@ -0,0 +1,140 @@
+package s3in
+
+import (
+	"context"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/versioning"
+)
+
+type CopyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+// CopyObject copies the object named by x-amz-copy-source, possibly from
+// another bucket. With x-amz-metadata-directive COPY, the default, the copy
+// keeps the metadata of the source; with REPLACE it takes that of the
+// request.
+func (g *GoFakeS3) CopyObject(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucketName := vars["BucketName"]
+	key := vars["ObjectName"]
+
+	srcBucket, srcKey, srcVersion, ok := parseCopySource(r.Header.Get("x-amz-copy-source"))
+	if !ok {
+		writeError(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey"})
+		return
+	}
+	log.Println("COPY OBJECT:", srcBucket, srcKey, "->", bucketName, key)
+
+	access, ok := g.source(bucketName)
+	if !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	srcAccess, ok := g.source(srcBucket)
+	if !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	srcAccess, err := atVersion(srcAccess, srcVersion)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	directive := r.Header.Get("x-amz-metadata-directive")
+	if directive != "" && directive != "COPY" && directive != "REPLACE" {
+		writeError(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "Unknown metadata directive."})
+		return
+	}
+	if srcBucket == bucketName && srcKey == key && srcVersion == "" && directive != "REPLACE" {
+		writeError(w, r, &s3Error{http.StatusBadRequest, "InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata, storage class, website redirect location or encryption attributes."})
+		return
+	}
+
+	source, err := srcAccess.Stat(r.Context(), srcKey)
+	if err != nil {
+		objectError(w, r, source, err)
+		return
+	}
+	meta := withoutETag(source.Metadata)
+	if directive == "REPLACE" {
+		meta = collectMetadata(r.Header)
+	}
+	meta.ModTime = g.timeNow()
+	if err := checkMetadata(access, meta); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	versionID, err := copyObject(r.Context(), srcAccess, srcKey, access, key, meta)
+	if err != nil {
+		log.Println("error while copying:", err)
+		writeError(w, r, err)
+		return
+	}
+
+	if versionID != "" {
+		w.Header().Set("x-amz-version-id", versionID)
+	}
+	if source.VersionID != "" {
+		w.Header().Set("x-amz-copy-source-version-id", source.VersionID)
+	}
+	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
+	w.Header().Set("Server", "AmazonS3")
+	g.writeXML(w, r, &CopyObjectResult{
+		Xmlns:        "http://s3.amazonaws.com/doc/2006-03-01/",
+		LastModified: meta.ModTime.UTC().Format(listTimeFormat),
+		ETag:         "\"" + entityTag(lgpd.File{Mark: source.Mark, Metadata: meta}) + "\"",
+	})
+}
+
+// copyObject copies src in from to dst in to as lgpd.Copy does, returning
+// the version ID of the copy when to keeps versions.
+func copyObject(ctx context.Context, from lgpd.LGPD, src string, to lgpd.LGPD, dst string, meta lgpd.Metadata) (string, error) {
+	store, ok := to.(*versioning.Store)
+	if !ok {
+		return "", lgpd.Copy(ctx, from, src, to, dst, meta)
+	}
+	if from == to {
+		return store.CopyVersion(ctx, src, dst, meta)
+	}
+	body, file, err := from.GetS(ctx, src, false)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	return putObject(ctx, store, dst, body, int64(file.Length), meta)
+}
+
+// parseCopySource splits an x-amz-copy-source of the form
+// [/]bucket/key[?versionId=...], whose key is URL encoded.
+func parseCopySource(header string) (bucket, key, versionID string, ok bool) {
+	if i := strings.Index(header, "?"); i >= 0 {
+		query, err := url.ParseQuery(header[i+1:])
+		if err != nil {
+			return "", "", "", false
+		}
+		versionID = query.Get("versionId")
+		header = header[:i]
+	}
+	source, err := url.PathUnescape(strings.TrimPrefix(header, "/"))
+	if err != nil {
+		return "", "", "", false
+	}
+	parts := strings.SplitN(source, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], versionID, true
+}
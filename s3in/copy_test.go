@@ -0,0 +1,161 @@
+package s3in
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xiaokangwang/s3emu/backend/memory"
+	"github.com/xiaokangwang/s3emu/versioning"
+)
+
+// copyRequest copies source, "bucket/key[?versionId=...]", to target,
+// with header on top of x-amz-copy-source.
+func copyRequest(t *testing.T, h http.Handler, source, target string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("X-Amz-Copy-Source", source)
+	return do(t, h, "PUT", target, nil, header)
+}
+
+func md5Tag(s string) string {
+	sum := md5.Sum([]byte(s))
+	return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
+
+func TestCopyObject(t *testing.T) {
+	g, h := newTestServer(t)
+	g.SetSource("other", memory.NewMemoryBackend(0, 0))
+	do(t, h, "PUT", "/bucket/a", strings.NewReader("hello"), http.Header{
+		"Content-Type":     {"text/plain"},
+		"X-Amz-Meta-Color": {"blue"},
+	})
+
+	// COPY, the default, keeps the metadata of the source
+	w := copyRequest(t, h, "/bucket/a", "/bucket/b", nil)
+	var result CopyObjectResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK || result.ETag != md5Tag("hello") {
+		t.Fatalf("CopyObject: %v %s", w.Code, w.Body)
+	}
+	w = do(t, h, "GET", "/bucket/b", nil, nil)
+	if w.Body.String() != "hello" || w.Header().Get("Content-Type") != "text/plain" || w.Header().Get("X-Amz-Meta-Color") != "blue" {
+		t.Errorf("GET of the copy: %q %v", w.Body, w.Header())
+	}
+
+	// REPLACE takes that of the request
+	w = copyRequest(t, h, "/bucket/a", "/bucket/c", http.Header{
+		"X-Amz-Metadata-Directive": {"REPLACE"},
+		"Content-Type":             {"text/html"},
+		"X-Amz-Meta-Size":          {"large"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("CopyObject with REPLACE: %v %s", w.Code, w.Body)
+	}
+	w = do(t, h, "HEAD", "/bucket/c", nil, nil)
+	if w.Header().Get("Content-Type") != "text/html" || w.Header().Get("X-Amz-Meta-Size") != "large" || w.Header().Get("X-Amz-Meta-Color") != "" {
+		t.Errorf("HEAD of the copy with REPLACE: %v", w.Header())
+	}
+
+	// across buckets the content is streamed from one to the other; the
+	// key may need escaping in the header
+	do(t, h, "PUT", "/bucket/dir/with%20space", strings.NewReader("spaced"), nil)
+	if w := copyRequest(t, h, "bucket/dir/with%20space", "/other/copied", nil); w.Code != http.StatusOK {
+		t.Fatalf("CopyObject across buckets: %v %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "GET", "/other/copied", nil, nil); w.Body.String() != "spaced" {
+		t.Errorf("GET of the copy across buckets: %v %q", w.Code, w.Body)
+	}
+
+	// onto itself, only changing the metadata is allowed
+	w = copyRequest(t, h, "/bucket/a", "/bucket/a", nil)
+	if w.Code != http.StatusBadRequest || errorCode(w) != "InvalidRequest" {
+		t.Errorf("CopyObject onto itself: %v %s", w.Code, w.Body)
+	}
+	w = copyRequest(t, h, "/bucket/a", "/bucket/a", http.Header{"X-Amz-Metadata-Directive": {"REPLACE"}, "X-Amz-Meta-Color": {"red"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("CopyObject onto itself with REPLACE: %v %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "GET", "/bucket/a", nil, nil); w.Body.String() != "hello" || w.Header().Get("X-Amz-Meta-Color") != "red" {
+		t.Errorf("GET after copying onto itself: %q %v", w.Body, w.Header())
+	}
+
+	for _, c := range []struct {
+		source string
+		header http.Header
+		status int
+		code   string
+	}{
+		{"/bucket/missing", nil, http.StatusNotFound, "NoSuchKey"},
+		{"/nobucket/a", nil, http.StatusNotFound, "NoSuchBucket"},
+		{"/bucket", nil, http.StatusBadRequest, "InvalidArgument"},
+		{"/bucket/a", http.Header{"X-Amz-Metadata-Directive": {"MERGE"}}, http.StatusBadRequest, "InvalidArgument"},
+		{"/bucket/a?versionId=0000000000000001", nil, http.StatusNotFound, "NoSuchVersion"},
+	} {
+		w := copyRequest(t, h, c.source, "/bucket/d", c.header)
+		if w.Code != c.status || errorCode(w) != c.code {
+			t.Errorf("CopyObject from %v: %v %s, want %v %v", c.source, w.Code, w.Body, c.status, c.code)
+		}
+	}
+}
+
+func TestCopyMultipartObject(t *testing.T) {
+	_, h := newTestServer(t)
+	completeUpload(t, h, "bucket", "a", "hello")
+
+	// the copy is a single object of its own, whose ETag is its MD5
+	w := copyRequest(t, h, "/bucket/a", "/bucket/b", nil)
+	var result CopyObjectResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || result.ETag != md5Tag("hello") {
+		t.Fatalf("CopyObject: %v %s", w.Code, w.Body)
+	}
+	w = do(t, h, "HEAD", "/bucket/b", nil, nil)
+	if w.Header().Get("ETag") != md5Tag("hello") || w.Header().Get("X-Amz-Meta-Color") != "blue" {
+		t.Errorf("HEAD of the copy: %v", w.Header())
+	}
+}
+
+func TestCopyVersioned(t *testing.T) {
+	g, h := newTestServer(t)
+	store := versioning.New(memory.NewMemoryBackend(0, 0))
+	if err := store.SetStatus(context.Background(), versioning.Enabled); err != nil {
+		t.Fatal(err)
+	}
+	g.SetSource("versioned", store)
+
+	first := do(t, h, "PUT", "/versioned/a", strings.NewReader("first"), nil).Header().Get("x-amz-version-id")
+	do(t, h, "PUT", "/versioned/a", strings.NewReader("second"), nil)
+
+	// within the store, and from an older version
+	for _, source := range []string{"/versioned/a", "/versioned/a?versionId=" + first} {
+		w := copyRequest(t, h, source, "/versioned/b", nil)
+		if w.Code != http.StatusOK || w.Header().Get("x-amz-version-id") == "" {
+			t.Fatalf("CopyObject from %v: %v %v", source, w.Code, w.Header())
+		}
+		version := w.Header().Get("x-amz-version-id")
+		if w := do(t, h, "HEAD", "/versioned/b?versionId="+version, nil, nil); w.Code != http.StatusOK {
+			t.Errorf("HEAD of the copied version: %v", w.Code)
+		}
+	}
+	if w := do(t, h, "GET", "/versioned/b", nil, nil); w.Body.String() != "first" {
+		t.Errorf("GET of the copy of the older version = %q", w.Body)
+	}
+	w := copyRequest(t, h, "/versioned/a?versionId="+first, "/bucket/c", nil)
+	if w.Code != http.StatusOK || w.Header().Get("x-amz-copy-source-version-id") != first || w.Header().Get("x-amz-version-id") != "" {
+		t.Errorf("CopyObject into an unversioned bucket: %v %v", w.Code, w.Header())
+	}
+
+	// an object may be copied onto itself from an older version
+	if w := copyRequest(t, h, "/versioned/a?versionId="+first, "/versioned/a", nil); w.Code != http.StatusOK {
+		t.Fatalf("CopyObject of an older version onto its key: %v %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "GET", "/versioned/a", nil, nil); w.Body.String() != "first" {
+		t.Errorf("GET after restoring the older version = %q", w.Body)
+	}
+}
@@ -0,0 +1,321 @@
+package s3in
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxCORSRules and maxCORSConfigSize are the limits S3 puts on a bucket's
+// CORS configuration.
+const (
+	maxCORSRules      = 100
+	maxCORSConfigSize = 64 << 10
+)
+
+var (
+	errNoSuchCORS       = &s3Error{http.StatusNotFound, "NoSuchCORSConfiguration", "The CORS configuration does not exist"}
+	errCORSNotEnabled   = &s3Error{http.StatusForbidden, "AccessForbidden", "CORSResponse: CORS is not enabled for this bucket."}
+	errCORSForbidden    = &s3Error{http.StatusForbidden, "AccessForbidden", "CORSResponse: This CORS request is not allowed. This is usually because the evalution of Origin, request method / Access-Control-Request-Method or Access-Control-Request-Headers are not whitelisted by the resource's CORS spec."}
+	errCORSNoOrigin     = &s3Error{http.StatusBadRequest, "BadRequest", "Insufficient information. Origin request header needed."}
+	errCORSNoMethod     = &s3Error{http.StatusBadRequest, "BadRequest", "Invalid Access-Control-Request-Method: null"}
+	errCORSWildcards    = &s3Error{http.StatusBadRequest, "InvalidRequest", "AllowedOrigin and AllowedHeader can not have more than one wildcard."}
+	errCORSTooManyRules = &s3Error{http.StatusBadRequest, "InvalidRequest", "The number of CORS rules should not exceed allowed limit of 100 rules."}
+)
+
+type CORSConfiguration struct {
+	XMLName xml.Name   `xml:"CORSConfiguration"`
+	Xmlns   string     `xml:"xmlns,attr,omitempty"`
+	Rules   []CORSRule `xml:"CORSRule"`
+}
+
+type CORSRule struct {
+	ID             string   `xml:"ID,omitempty"`
+	AllowedOrigins []string `xml:"AllowedOrigin"`
+	AllowedMethods []string `xml:"AllowedMethod"`
+	AllowedHeaders []string `xml:"AllowedHeader"`
+	ExposeHeaders  []string `xml:"ExposeHeader"`
+	MaxAgeSeconds  int      `xml:"MaxAgeSeconds,omitempty"`
+}
+
+// validate checks c the way S3 checks a PutBucketCors body: every rule
+// names at least one origin and one method, methods are ones CORS can
+// allow, and origins and headers hold one wildcard at most.
+func (c *CORSConfiguration) validate() error {
+	if len(c.Rules) == 0 {
+		return errMalformedXML
+	}
+	if len(c.Rules) > maxCORSRules {
+		return errCORSTooManyRules
+	}
+	for _, rule := range c.Rules {
+		if len(rule.AllowedOrigins) == 0 || len(rule.AllowedMethods) == 0 || rule.MaxAgeSeconds < 0 {
+			return errMalformedXML
+		}
+		for _, method := range rule.AllowedMethods {
+			switch method {
+			case "GET", "PUT", "HEAD", "POST", "DELETE":
+			default:
+				return &s3Error{http.StatusBadRequest, "InvalidRequest", "Found unsupported HTTP method in CORS config. Unsupported method is " + method}
+			}
+		}
+		if manyWildcards(rule.AllowedOrigins) || manyWildcards(rule.AllowedHeaders) {
+			return errCORSWildcards
+		}
+	}
+	return nil
+}
+
+// match returns the first rule letting origin make a method request
+// carrying headers, which are lower case.
+func (c *CORSConfiguration) match(origin, method string, headers []string) (*CORSRule, string) {
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		allowed, ok := rule.origin(origin)
+		if !ok || !contains(rule.AllowedMethods, method) || !rule.allowsHeaders(headers) {
+			continue
+		}
+		return rule, allowed
+	}
+	return nil, ""
+}
+
+// origin finds the AllowedOrigin of the rule that origin matches.
+func (rule *CORSRule) origin(origin string) (string, bool) {
+	for _, pattern := range rule.AllowedOrigins {
+		if wildcardMatch(pattern, origin) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+func (rule *CORSRule) allowsHeaders(headers []string) bool {
+next:
+	for _, header := range headers {
+		for _, pattern := range rule.AllowedHeaders {
+			if wildcardMatch(strings.ToLower(pattern), header) {
+				continue next
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// wildcardMatch reports whether s matches pattern, in which a single *
+// stands for any run of characters.
+func wildcardMatch(pattern, s string) bool {
+	i := strings.IndexByte(pattern, '*')
+	if i < 0 {
+		return pattern == s
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	return len(s) >= len(prefix)+len(suffix) && strings.HasPrefix(s, prefix) && strings.HasSuffix(s, suffix)
+}
+
+// manyWildcards reports whether a pattern in patterns has more than one *.
+func manyWildcards(patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.Count(pattern, "*") > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SetBucketCORS sets the CORS configuration browsers are held to for
+// bucket, replacing any set before through the API. A nil configuration
+// turns CORS off for bucket, which is where every bucket starts.
+func (g *GoFakeS3) SetBucketCORS(bucket string, c *CORSConfiguration) error {
+	if c != nil {
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+	g.corsLock.Lock()
+	defer g.corsLock.Unlock()
+	if c == nil {
+		delete(g.cors, bucket)
+		return nil
+	}
+	if g.cors == nil {
+		g.cors = make(map[string]*CORSConfiguration)
+	}
+	g.cors[bucket] = c
+	return nil
+}
+
+func (g *GoFakeS3) bucketCORS(bucket string) *CORSConfiguration {
+	g.corsLock.RLock()
+	defer g.corsLock.RUnlock()
+	return g.cors[bucket]
+}
+
+// requestBucket names the bucket r is for: the one from the host for a
+// virtual-hosted-style request, else the first segment of the path.
+func requestBucket(r *http.Request, virtual string) string {
+	if virtual != "" {
+		return virtual
+	}
+	return strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+}
+
+// preflight answers a CORS preflight OPTIONS request for bucket.
+func (g *GoFakeS3) preflight(w http.ResponseWriter, r *http.Request, bucket string) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		writeError(w, r, errCORSNoOrigin)
+		return
+	}
+	method := r.Header.Get("Access-Control-Request-Method")
+	if method == "" {
+		writeError(w, r, errCORSNoMethod)
+		return
+	}
+	var headers []string
+	for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if header = strings.ToLower(strings.TrimSpace(header)); header != "" {
+			headers = append(headers, header)
+		}
+	}
+
+	c := g.bucketCORS(bucket)
+	if c == nil {
+		writeError(w, r, errCORSNotEnabled)
+		return
+	}
+	rule, allowed := c.match(origin, method, headers)
+	if rule == nil {
+		writeError(w, r, errCORSForbidden)
+		return
+	}
+	setCORSHeaders(w, rule, allowed, origin)
+	if len(headers) != 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+	if rule.MaxAgeSeconds > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(rule.MaxAgeSeconds))
+	}
+}
+
+// applyCORS adds the CORS headers that let the browser behind r read the
+// response, when a rule of bucket allows it.
+func (g *GoFakeS3) applyCORS(w http.ResponseWriter, r *http.Request, bucket string) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	c := g.bucketCORS(bucket)
+	if c == nil {
+		return
+	}
+	if rule, allowed := c.match(origin, r.Method, nil); rule != nil {
+		setCORSHeaders(w, rule, allowed, origin)
+	}
+}
+
+func setCORSHeaders(w http.ResponseWriter, rule *CORSRule, allowed, origin string) {
+	h := w.Header()
+	h.Set("Vary", "Origin, Access-Control-Request-Headers, Access-Control-Request-Method")
+	if allowed == "*" {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(rule.AllowedMethods, ", "))
+	if len(rule.ExposeHeaders) != 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(rule.ExposeHeaders, ", "))
+	}
+}
+
+// GetBucketCors returns the CORS configuration of a bucket.
+func (g *GoFakeS3) GetBucketCors(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["BucketName"]
+	log.Println("GET BUCKET CORS:", bucketName)
+
+	if _, ok := g.source(bucketName); !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	c := g.bucketCORS(bucketName)
+	if c == nil {
+		writeError(w, r, errNoSuchCORS)
+		return
+	}
+	g.writeXML(w, r, &CORSConfiguration{Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/", Rules: c.Rules})
+}
+
+// PutBucketCors replaces the CORS configuration of a bucket. It lasts until
+// the server restarts, which brings back the configured one.
+func (g *GoFakeS3) PutBucketCors(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["BucketName"]
+	log.Println("PUT BUCKET CORS:", bucketName)
+
+	if _, ok := g.source(bucketName); !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	if serr := verifyContentMD5(r); serr != nil {
+		writeError(w, r, serr)
+		return
+	}
+
+	var c CORSConfiguration
+	body := io.LimitReader(r.Body, maxCORSConfigSize)
+	err := xml.NewDecoder(body).Decode(&c)
+	if err == nil {
+		// read on so that Content-MD5 is checked against the whole body
+		_, err = io.Copy(ioutil.Discard, body)
+	}
+	if err != nil {
+		var serr *s3Error
+		if errors.As(err, &serr) {
+			writeError(w, r, serr)
+			return
+		}
+		writeError(w, r, errMalformedXML)
+		return
+	}
+	c.Xmlns = ""
+	if err := g.SetBucketCORS(bucketName, &c); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
+	w.Header().Set("Server", "AmazonS3")
+}
+
+// DeleteBucketCors turns CORS off for a bucket.
+func (g *GoFakeS3) DeleteBucketCors(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["BucketName"]
+	log.Println("DELETE BUCKET CORS:", bucketName)
+
+	if _, ok := g.source(bucketName); !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	g.SetBucketCORS(bucketName, nil)
+
+	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
+	w.Header().Set("Server", "AmazonS3")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,170 @@
+package s3in
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/xiaokangwang/s3emu/backend/memory"
+)
+
+const testCORS = `<CORSConfiguration>
+	<CORSRule>
+		<AllowedOrigin>https://app.example.com</AllowedOrigin>
+		<AllowedMethod>GET</AllowedMethod>
+		<AllowedMethod>PUT</AllowedMethod>
+		<AllowedHeader>Content-Type</AllowedHeader>
+		<AllowedHeader>x-amz-*</AllowedHeader>
+		<ExposeHeader>ETag</ExposeHeader>
+		<MaxAgeSeconds>600</MaxAgeSeconds>
+	</CORSRule>
+	<CORSRule>
+		<AllowedOrigin>http://*.example.org</AllowedOrigin>
+		<AllowedMethod>POST</AllowedMethod>
+	</CORSRule>
+	<CORSRule>
+		<AllowedOrigin>*</AllowedOrigin>
+		<AllowedMethod>GET</AllowedMethod>
+	</CORSRule>
+</CORSConfiguration>`
+
+func TestBucketCors(t *testing.T) {
+	_, h := newTestServer(t)
+	if w := do(t, h, "GET", "/bucket?cors", nil, nil); w.Code != http.StatusNotFound || errorCode(w) != "NoSuchCORSConfiguration" {
+		t.Fatalf("GET ?cors before any was set: %v %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "PUT", "/bucket?cors", strings.NewReader(testCORS), nil); w.Code != http.StatusOK {
+		t.Fatalf("PUT ?cors: %v %s", w.Code, w.Body)
+	}
+	w := do(t, h, "GET", "/bucket?cors", nil, nil)
+	var c CORSConfiguration
+	if err := xml.Unmarshal(w.Body.Bytes(), &c); err != nil || len(c.Rules) != 3 || c.Rules[0].MaxAgeSeconds != 600 {
+		t.Fatalf("GET ?cors = %+v, %v", c, err)
+	}
+
+	for name, body := range map[string]string{
+		"unsupported method": `<CORSConfiguration><CORSRule><AllowedOrigin>*</AllowedOrigin><AllowedMethod>PATCH</AllowedMethod></CORSRule></CORSConfiguration>`,
+		"two wildcards":      `<CORSConfiguration><CORSRule><AllowedOrigin>*.*</AllowedOrigin><AllowedMethod>GET</AllowedMethod></CORSRule></CORSConfiguration>`,
+	} {
+		if w := do(t, h, "PUT", "/bucket?cors", strings.NewReader(body), nil); w.Code != http.StatusBadRequest || errorCode(w) != "InvalidRequest" {
+			t.Errorf("PUT ?cors with %s: %v %s", name, w.Code, w.Body)
+		}
+	}
+	if w := do(t, h, "PUT", "/bucket?cors", strings.NewReader("<CORSConfiguration/>"), nil); errorCode(w) != "MalformedXML" {
+		t.Errorf("PUT ?cors without rules: %v %s", w.Code, w.Body)
+	}
+	// the configuration turned down left the one before in place
+	if w := do(t, h, "GET", "/bucket?cors", nil, nil); w.Code != http.StatusOK {
+		t.Errorf("GET ?cors after failed PUTs: %v %s", w.Code, w.Body)
+	}
+
+	if w := do(t, h, "DELETE", "/bucket?cors", nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE ?cors: %v %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "GET", "/bucket?cors", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET ?cors after DELETE: %v %s", w.Code, w.Body)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	g, h := newTestServer(t)
+	g.SetSource("plain", memory.NewMemoryBackend(0, 0))
+	do(t, h, "PUT", "/bucket?cors", strings.NewReader(testCORS), nil)
+	preflight := func(origin, method, headers string) http.Header {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		if method != "" {
+			header.Set("Access-Control-Request-Method", method)
+		}
+		if headers != "" {
+			header.Set("Access-Control-Request-Headers", headers)
+		}
+		return header
+	}
+
+	for _, c := range []struct {
+		name                   string
+		target                 string
+		header                 http.Header
+		origin, methods, allow string
+	}{
+		{"an origin and headers of the first rule", "/bucket/a",
+			preflight("https://app.example.com", "PUT", "Content-Type, X-Amz-Meta-Color"),
+			"https://app.example.com", "GET, PUT", "content-type, x-amz-meta-color"},
+		{"a wildcard origin", "/bucket/a",
+			preflight("http://www.example.org", "POST", ""),
+			"http://www.example.org", "POST", ""},
+		{"any origin", "/bucket/a",
+			preflight("https://elsewhere.example.net", "GET", ""),
+			"*", "GET", ""},
+		{"a virtual-hosted bucket", "http://bucket.localhost/a",
+			preflight("https://app.example.com", "GET", ""),
+			"https://app.example.com", "GET, PUT", ""},
+	} {
+		w := do(t, h, "OPTIONS", c.target, nil, c.header)
+		if w.Code != http.StatusOK {
+			t.Errorf("preflight with %s: %v %s", c.name, w.Code, w.Body)
+			continue
+		}
+		got := w.Header()
+		if got.Get("Access-Control-Allow-Origin") != c.origin || got.Get("Access-Control-Allow-Methods") != c.methods ||
+			got.Get("Access-Control-Allow-Headers") != c.allow {
+			t.Errorf("preflight with %s: headers %v", c.name, got)
+		}
+		if credentials := got.Get("Access-Control-Allow-Credentials") == "true"; credentials != (c.origin != "*") {
+			t.Errorf("preflight with %s: Access-Control-Allow-Credentials %q", c.name, got.Get("Access-Control-Allow-Credentials"))
+		}
+	}
+	w := do(t, h, "OPTIONS", "/bucket/a", nil, preflight("https://app.example.com", "PUT", ""))
+	if w.Header().Get("Access-Control-Max-Age") != "600" || w.Header().Get("Access-Control-Expose-Headers") != "ETag" {
+		t.Errorf("preflight headers %v", w.Header())
+	}
+
+	for _, c := range []struct {
+		name   string
+		target string
+		header http.Header
+		status int
+		code   string
+	}{
+		{"a method no rule allows", "/bucket/a", preflight("https://elsewhere.example.net", "PUT", ""), http.StatusForbidden, "AccessForbidden"},
+		{"a header no rule allows", "/bucket/a", preflight("https://app.example.com", "PUT", "Authorization"), http.StatusForbidden, "AccessForbidden"},
+		{"a bucket without CORS", "/plain/a", preflight("https://app.example.com", "GET", ""), http.StatusForbidden, "AccessForbidden"},
+		{"no origin", "/bucket/a", preflight("", "GET", ""), http.StatusBadRequest, "BadRequest"},
+		{"no method", "/bucket/a", preflight("https://app.example.com", "", ""), http.StatusBadRequest, "BadRequest"},
+	} {
+		w := do(t, h, "OPTIONS", c.target, nil, c.header)
+		if w.Code != c.status || errorCode(w) != c.code {
+			t.Errorf("preflight with %s: %v %s, want %v %v", c.name, w.Code, w.Body, c.status, c.code)
+		}
+		if w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("preflight with %s allowed the origin", c.name)
+		}
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	_, h := newTestServer(t)
+	do(t, h, "PUT", "/bucket?cors", strings.NewReader(testCORS), nil)
+	do(t, h, "PUT", "/bucket/a", strings.NewReader("a"), nil)
+	origin := http.Header{"Origin": {"https://app.example.com"}}
+
+	w := do(t, h, "GET", "/bucket/a", nil, origin)
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || w.Header().Get("Access-Control-Expose-Headers") != "ETag" {
+		t.Errorf("GET with an allowed origin: headers %v", w.Header())
+	}
+	// errors carry them too, so that scripts can read them
+	w = do(t, h, "GET", "/bucket/missing", nil, origin)
+	if w.Code != http.StatusNotFound || w.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Errorf("failed GET with an allowed origin: %v %v", w.Code, w.Header())
+	}
+	if w := do(t, h, "DELETE", "/bucket/a", nil, origin); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("DELETE, which no rule allows, got headers %v", w.Header())
+	}
+	if w := do(t, h, "GET", "/bucket/a", nil, nil); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("GET without an origin got headers %v", w.Header())
+	}
+}
@@ -0,0 +1,170 @@
+package s3in
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/versioning"
+)
+
+// maxDeleteKeys is the most keys one DeleteObjects request may name.
+const maxDeleteKeys = 1000
+
+// removeWorkers bounds how many versioned deletes DeleteObjects has in
+// flight, as lgpd.DeleteBatch does for plain ones.
+const removeWorkers = 8
+
+type DeleteRequest struct {
+	XMLName xml.Name         `xml:"Delete"`
+	Quiet   bool             `xml:"Quiet"`
+	Objects []ObjectToDelete `xml:"Object"`
+}
+
+type ObjectToDelete struct {
+	Key       string `xml:"Key"`
+	VersionId string `xml:"VersionId,omitempty"`
+}
+
+type DeleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []DeletedObject `xml:"Deleted"`
+	Errors  []DeleteError   `xml:"Error"`
+}
+
+type DeletedObject struct {
+	Key                   string `xml:"Key"`
+	VersionId             string `xml:"VersionId,omitempty"`
+	DeleteMarker          bool   `xml:"DeleteMarker,omitempty"`
+	DeleteMarkerVersionId string `xml:"DeleteMarkerVersionId,omitempty"`
+}
+
+type DeleteError struct {
+	Key       string `xml:"Key"`
+	VersionId string `xml:"VersionId,omitempty"`
+	Code      string `xml:"Code"`
+	Message   string `xml:"Message"`
+}
+
+// DeleteObjects deletes every key listed in the request body. Each key
+// succeeds or fails on its own; in quiet mode only the failures are
+// reported back.
+func (g *GoFakeS3) DeleteObjects(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["BucketName"]
+	log.Println("DELETE OBJECTS:", bucketName)
+
+	access, ok := g.source(bucketName)
+	if !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	if serr := verifyContentMD5(r); serr != nil {
+		writeError(w, r, serr)
+		return
+	}
+
+	var request DeleteRequest
+	err := xml.NewDecoder(r.Body).Decode(&request)
+	if err == nil {
+		// the decoder stops at the end of the document; read on so that
+		// Content-MD5 is checked against the whole body
+		_, err = io.Copy(ioutil.Discard, r.Body)
+	}
+	if err != nil {
+		var serr *s3Error
+		if errors.As(err, &serr) {
+			writeError(w, r, serr)
+			return
+		}
+		writeError(w, r, errMalformedXML)
+		return
+	}
+	if len(request.Objects) == 0 || len(request.Objects) > maxDeleteKeys {
+		writeError(w, r, errMalformedXML)
+		return
+	}
+
+	// an Unversioned bucket keeps nothing of what is deleted, so the
+	// backend may take the keys as one batch
+	versioned := false
+	if store, ok := access.(*versioning.Store); ok {
+		status, err := store.Status(r.Context())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		versioned = status != versioning.Unversioned
+	}
+	keys := make([]string, len(request.Objects))
+	for i, object := range request.Objects {
+		keys[i] = object.Key
+		versioned = versioned || object.VersionId != ""
+	}
+	removed := make([]versioning.Version, len(request.Objects))
+	var errs []error
+	if versioned {
+		errs = removeObjects(r.Context(), access, request.Objects, removed)
+	} else {
+		errs = lgpd.DeleteBatch(r.Context(), access, keys)
+	}
+
+	result := &DeleteResult{Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/"}
+	for i, object := range request.Objects {
+		// as with a single delete, a key that is not there counts as deleted
+		if err := errs[i]; err != nil && !errors.Is(err, lgpd.ErrNotFound) {
+			log.Println("can't delete", object.Key, err)
+			serr := toS3Error(err)
+			result.Errors = append(result.Errors, DeleteError{
+				Key:       object.Key,
+				VersionId: object.VersionId,
+				Code:      serr.Code,
+				Message:   serr.Message,
+			})
+			continue
+		}
+		if request.Quiet {
+			continue
+		}
+		deleted := DeletedObject{Key: object.Key, VersionId: object.VersionId}
+		if removed[i].DeleteMarker {
+			deleted.DeleteMarker = true
+			deleted.DeleteMarkerVersionId = removed[i].VersionID
+		}
+		result.Deleted = append(result.Deleted, deleted)
+	}
+
+	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
+	w.Header().Set("Server", "AmazonS3")
+	g.writeXML(w, r, result)
+}
+
+// removeObjects deletes objects from access in parallel, filling in removed
+// with what each delete removed or left behind.
+func removeObjects(ctx context.Context, access lgpd.LGPD, objects []ObjectToDelete, removed []versioning.Version) []error {
+	errs := make([]error, len(objects))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < removeWorkers && n < len(objects); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				removed[i], errs[i] = removeObject(ctx, access, objects[i].Key, objects[i].VersionId)
+			}
+		}()
+	}
+	for i := range objects {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return errs
+}
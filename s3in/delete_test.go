@@ -0,0 +1,150 @@
+package s3in
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/xiaokangwang/s3emu/backend/memory"
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+// lockedBackend fails every delete of the key "locked".
+type lockedBackend struct {
+	lgpd.LGPD
+}
+
+func (l lockedBackend) Delete(ctx context.Context, key string) error {
+	if key == "locked" {
+		return lgpd.ErrBackendUnavailable
+	}
+	return l.LGPD.Delete(ctx, key)
+}
+
+func deleteObjects(t *testing.T, h http.Handler, bucket, body string) DeleteResult {
+	t.Helper()
+	w := do(t, h, "POST", "/"+bucket+"?delete", strings.NewReader(body), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST ?delete: %v %s", w.Code, w.Body)
+	}
+	var result DeleteResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestDeleteObjects(t *testing.T) {
+	g, h := newTestServer(t)
+	store := memory.NewMemoryBackend(0, 0)
+	g.SetSource("locked", lockedBackend{store})
+	for _, key := range []string{"a", "b", "locked"} {
+		store.Put(context.Background(), key, []byte(key))
+	}
+
+	result := deleteObjects(t, h, "locked", `<Delete>
+		<Object><Key>a</Key></Object>
+		<Object><Key>locked</Key></Object>
+		<Object><Key>missing</Key></Object>
+	</Delete>`)
+	if len(result.Deleted) != 2 || result.Deleted[0].Key != "a" || result.Deleted[1].Key != "missing" {
+		t.Errorf("Deleted = %+v, want a and missing", result.Deleted)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Key != "locked" || result.Errors[0].Code != "SlowDown" {
+		t.Errorf("Errors = %+v, want SlowDown for locked", result.Errors)
+	}
+	if _, err := store.Stat(context.Background(), "a"); err == nil {
+		t.Error("a is still there")
+	}
+
+	// quiet mode reports the failures alone
+	result = deleteObjects(t, h, "locked", `<Delete><Quiet>true</Quiet>
+		<Object><Key>b</Key></Object>
+		<Object><Key>locked</Key></Object>
+	</Delete>`)
+	if len(result.Deleted) != 0 || len(result.Errors) != 1 {
+		t.Errorf("quiet result = %+v", result)
+	}
+	if _, err := store.Stat(context.Background(), "b"); err == nil {
+		t.Error("b is still there after a quiet delete")
+	}
+}
+
+func TestDeleteObjectsVersioned(t *testing.T) {
+	h := newVersionedServer(t)
+	first := putVersioned(t, h, "a", "first")
+	putVersioned(t, h, "a", "second")
+
+	result := deleteObjects(t, h, "versioned", `<Delete>
+		<Object><Key>a</Key></Object>
+		<Object><Key>a</Key><VersionId>`+first+`</VersionId></Object>
+	</Delete>`)
+	if len(result.Errors) != 0 || len(result.Deleted) != 2 {
+		t.Fatalf("result = %+v", result)
+	}
+	var marker, version DeletedObject
+	for _, deleted := range result.Deleted {
+		if deleted.VersionId == "" {
+			marker = deleted
+		} else {
+			version = deleted
+		}
+	}
+	if !marker.DeleteMarker || marker.DeleteMarkerVersionId == "" {
+		t.Errorf("deleting the current version gave %+v, want a delete marker", marker)
+	}
+	if version.VersionId != first || version.DeleteMarker {
+		t.Errorf("deleting version %s gave %+v", first, version)
+	}
+
+	versions := listVersions(t, h, "/versioned?versions")
+	if len(versions.Entries) != 2 || versions.Entries[0].XMLName.Local != "DeleteMarker" {
+		t.Errorf("?versions after DeleteObjects = %+v", versions)
+	}
+}
+
+func TestDeleteObjectsMalformed(t *testing.T) {
+	_, h := newTestServer(t)
+	many := strings.Repeat("<Object><Key>k</Key></Object>", maxDeleteKeys+1)
+	for name, body := range map[string]string{
+		"not XML":       "<Delete><Object>",
+		"no keys":       "<Delete></Delete>",
+		"too many keys": "<Delete>" + many + "</Delete>",
+	} {
+		w := do(t, h, "POST", "/bucket?delete", strings.NewReader(body), nil)
+		if w.Code != http.StatusBadRequest || errorCode(w) != "MalformedXML" {
+			t.Errorf("%s: %v %s", name, w.Code, w.Body)
+		}
+	}
+	if w := do(t, h, "POST", "/nobucket?delete", strings.NewReader("<Delete/>"), nil); errorCode(w) != "NoSuchBucket" {
+		t.Errorf("POST ?delete to a missing bucket: %v %s", w.Code, w.Body)
+	}
+}
+
+func TestDeleteObjectsContentMD5(t *testing.T) {
+	_, h := newTestServer(t)
+	do(t, h, "PUT", "/bucket/a", strings.NewReader("a"), nil)
+	body := "<Delete><Object><Key>a</Key></Object></Delete>"
+	sum := md5.Sum([]byte(body))
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+
+	w := do(t, h, "POST", "/bucket?delete", strings.NewReader(body+" "), http.Header{"Content-Md5": {digest}})
+	if w.Code != http.StatusBadRequest || errorCode(w) != "BadDigest" {
+		t.Errorf("POST ?delete with the digest of another body: %v %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "GET", "/bucket/a", nil, nil); w.Code != http.StatusOK {
+		t.Errorf("a body failing its digest deleted a: %v", w.Code)
+	}
+	w = do(t, h, "POST", "/bucket?delete", strings.NewReader(body), http.Header{"Content-Md5": {"bogus"}})
+	if w.Code != http.StatusBadRequest || errorCode(w) != "InvalidDigest" {
+		t.Errorf("POST ?delete with an invalid digest: %v %s", w.Code, w.Body)
+	}
+	w = do(t, h, "POST", "/bucket?delete", strings.NewReader(body), http.Header{"Content-Md5": {digest}})
+	if w.Code != http.StatusOK {
+		t.Errorf("POST ?delete with the digest of its body: %v %s", w.Code, w.Body)
+	}
+}
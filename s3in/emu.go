@@ -5,22 +5,36 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"regexp"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/lifecycle"
 )
 
 type GoFakeS3 struct {
 	access       map[string]lgpd.LGPD
+	accessLock   sync.RWMutex
+	manager      BucketManager
+	baseDomains  []string
+	trustProxy   bool
+	credentials  map[string]string
 	timeLocation *time.Location
+	stagingdir   string
+	multipart    sync.Mutex
+	uploads      map[string]*multipartUpload
+	conditional  sync.Mutex
+	creating     map[string]bool
+	corsLock     sync.RWMutex
+	cors         map[string]*CORSConfiguration
+	lifecycle    *lifecycle.Scanner
+	now          func() time.Time
 }
 type Storage struct {
 	XMLName     xml.Name     `xml:"ListAllMyBucketsResult"`
@@ -41,12 +55,18 @@ type Content struct {
 	StorageClass string `xml:"StorageClass"`
 }
 type Bucket struct {
-	XMLName  xml.Name   `xml:"ListBucketResult"`
-	Xmlns    string     `xml:"xmlns,attr"`
-	Name     string     `xml:"Name"`
-	Prefix   string     `xml:"Prefix"`
-	Marker   string     `xml:"Marker"`
-	Contents []*Content `xml:"Contents"`
+	XMLName        xml.Name        `xml:"ListBucketResult"`
+	Xmlns          string          `xml:"xmlns,attr"`
+	Name           string          `xml:"Name"`
+	Prefix         string          `xml:"Prefix"`
+	Marker         string          `xml:"Marker"`
+	NextMarker     string          `xml:"NextMarker,omitempty"`
+	MaxKeys        int             `xml:"MaxKeys"`
+	Delimiter      string          `xml:"Delimiter,omitempty"`
+	EncodingType   string          `xml:"EncodingType,omitempty"`
+	IsTruncated    bool            `xml:"IsTruncated"`
+	Contents       []*Content      `xml:"Contents"`
+	CommonPrefixes []*CommonPrefix `xml:"CommonPrefixes"`
 }
 type Object struct {
 	Metadata map[string]string
@@ -63,51 +83,77 @@ func New() *GoFakeS3 {
 		log.Fatal(err)
 	}
 
-	return &GoFakeS3{timeLocation: timeLocation}
+	return &GoFakeS3{timeLocation: timeLocation, now: time.Now}
 }
 
 // Create the AWS S3 API
 func (g *GoFakeS3) Server() http.Handler {
 	r := mux.NewRouter()
-	r.Queries("marker", "prefix")
 	// BUCKET
 	r.HandleFunc("/", g.GetBuckets).Methods("GET")
+	r.HandleFunc("/{BucketName}", g.GetBucketVersioning).Methods("GET").Queries("versioning", "")
+	r.HandleFunc("/{BucketName}", g.PutBucketVersioning).Methods("PUT").Queries("versioning", "")
+	r.HandleFunc("/{BucketName}", g.ListObjectVersions).Methods("GET").Queries("versions", "")
+	r.HandleFunc("/{BucketName}", g.GetBucketCors).Methods("GET").Queries("cors", "")
+	r.HandleFunc("/{BucketName}", g.PutBucketCors).Methods("PUT").Queries("cors", "")
+	r.HandleFunc("/{BucketName}", g.DeleteBucketCors).Methods("DELETE").Queries("cors", "")
+	r.HandleFunc("/{BucketName}", g.GetBucketLifecycleConfiguration).Methods("GET").Queries("lifecycle", "")
+	r.HandleFunc("/{BucketName}", g.PutBucketLifecycleConfiguration).Methods("PUT").Queries("lifecycle", "")
+	r.HandleFunc("/{BucketName}", g.DeleteBucketLifecycle).Methods("DELETE").Queries("lifecycle", "")
+	r.HandleFunc("/{BucketName}", g.ListMultipartUploads).Methods("GET").Queries("uploads", "")
 	r.HandleFunc("/{BucketName}", g.GetBucket).Methods("GET")
 	r.HandleFunc("/{BucketName}", g.CreateBucket).Methods("PUT")
 	r.HandleFunc("/{BucketName}", g.DeleteBucket).Methods("DELETE")
 	r.HandleFunc("/{BucketName}", g.HeadBucket).Methods("HEAD")
+	// MULTIPART
+	r.HandleFunc("/{BucketName}/{ObjectName:.{1,}}", g.CreateMultipartUpload).Methods("POST").Queries("uploads", "")
+	r.HandleFunc("/{BucketName}/{ObjectName:.{1,}}", g.UploadPart).Methods("PUT").Queries("partNumber", "", "uploadId", "")
+	r.HandleFunc("/{BucketName}/{ObjectName:.{1,}}", g.CompleteMultipartUpload).Methods("POST").Queries("uploadId", "")
+	r.HandleFunc("/{BucketName}/{ObjectName:.{1,}}", g.AbortMultipartUpload).Methods("DELETE").Queries("uploadId", "")
+	r.HandleFunc("/{BucketName}/{ObjectName:.{1,}}", g.ListParts).Methods("GET").Queries("uploadId", "")
 	// OBJECT
-	r.HandleFunc("/{BucketName}/", g.CreateObjectBrowserUpload).Methods("POST")
+	r.HandleFunc("/{BucketName}/{ObjectName:.{1,}}", g.CopyObject).Methods("PUT").Headers("x-amz-copy-source", "")
+	r.HandleFunc("/{BucketName}", g.DeleteObjects).Methods("POST").Queries("delete", "")
+	r.HandleFunc("/{BucketName}/", g.DeleteObjects).Methods("POST").Queries("delete", "")
+	r.HandleFunc("/{BucketName}", g.CreateObjectBrowserUpload).MatcherFunc(formPost)
+	r.HandleFunc("/{BucketName}/{ObjectName:.{0,}}", g.CreateObjectBrowserUpload).MatcherFunc(formPost)
 	r.HandleFunc("/{BucketName}/{ObjectName:.{1,}}", g.GetObject).Methods("GET")
 	r.HandleFunc("/{BucketName}/{ObjectName:.{1,}}", g.CreateObject).Methods("PUT")
 	r.HandleFunc("/{BucketName}/{ObjectName:.{0,}}", g.CreateObject).Methods("POST")
 	r.HandleFunc("/{BucketName}/{ObjectName:.{1,}}", g.DeleteObject).Methods("DELETE")
 	r.HandleFunc("/{BucketName}/{ObjectName:.{0,}}", g.HeadObject).Methods("HEAD")
 
-	return &WithCORS{r}
+	return &WithCORS{r, g}
 }
 
 type WithCORS struct {
 	r *mux.Router
+	g *GoFakeS3
 }
 
 func (s *WithCORS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, HEAD")
-	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Amz-User-Agent, X-Amz-Date, x-amz-meta-from, x-amz-meta-to, x-amz-meta-filename, x-amz-meta-private")
 	w.Header().Set("Content-Type", "application/xml")
 
+	w.Header().Set("x-amz-request-id", newRequestID())
+
+	r.Host = s.g.requestHost(r)
+	virtual := s.g.virtualBucket(r.Host)
 	if r.Method == "OPTIONS" {
+		s.g.preflight(w, r, requestBucket(r, virtual))
+		return
+	}
+	// CORS headers go on errors too, so that scripts can read them
+	s.g.applyCORS(w, r, requestBucket(r, virtual))
+	if err := s.g.authenticate(r); err != nil {
+		writeError(w, r, err)
 		return
 	}
-	// Bucket name rewriting
-	// this is due to some inconsistencies in the AWS SDKs
-	re := regexp.MustCompile("(127.0.0.1:\\d{1,7})|(.localhost:\\d{1,7})|(localhost:\\d{1,7})")
-	bucket := re.ReplaceAllString(r.Host, "")
-	if len(bucket) > 0 {
-		log.Println("rewrite bucket ->", bucket)
+	// A virtual-hosted-style request names the bucket in the host; turn it
+	// into the path-style request the routes expect.
+	if virtual != "" {
+		log.Println("rewrite bucket ->", virtual)
 		p := r.URL.Path
-		r.URL.Path = "/" + bucket
+		r.URL.Path = "/" + virtual
 		if p != "/" {
 			r.URL.Path += p
 		}
@@ -120,10 +166,9 @@ func (s *WithCORS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // Get a list of all Buckets
 func (g *GoFakeS3) GetBuckets(w http.ResponseWriter, r *http.Request) {
 	var buckets []BucketInfo
-	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>`))
 
-	for bucketname := range g.access {
-		buckets = append(buckets, BucketInfo{string(bucketname), ""})
+	for _, bucketname := range g.buckets() {
+		buckets = append(buckets, BucketInfo{bucketname, ""})
 	}
 
 	s := &Storage{
@@ -134,8 +179,10 @@ func (g *GoFakeS3) GetBuckets(w http.ResponseWriter, r *http.Request) {
 	}
 	x, err := xml.MarshalIndent(s, "", "  ")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
 	}
+	w.Write([]byte(xml.Header))
 	w.Write(x)
 }
 
@@ -148,59 +195,73 @@ func (g *GoFakeS3) GetBucket(w http.ResponseWriter, r *http.Request) {
 	log.Println("bucketname:", bucketName)
 	log.Println("prefix    :", r.URL.Query().Get("prefix"))
 
-	access, ok := g.access[bucketName]
+	access, ok := g.source(bucketName)
 
 	if !ok {
-		http.Error(w, "No bucket", http.StatusNotFound)
+		writeError(w, r, errNoSuchBucket)
 		return
 	}
 
-	bucketc := &Bucket{
-		Xmlns:    "http://s3.amazonaws.com/doc/2006-03-01/",
-		Name:     "crowdpatent.com",
-		Prefix:   r.URL.Query().Get("prefix"),
-		Marker:   "",
-		Contents: []*Content{},
-	}
-
-	list := access.List(r.URL.Query().Get("prefix"))
+	g.listObjects(w, r, bucketName, access)
+}
 
-	for _, filec := range list {
-		if strings.Contains(filec.Name, r.URL.Query().Get("prefix")) {
-			bucketc.Contents = append(bucketc.Contents, &Content{
-				Key:          filec.Name,
-				LastModified: g.timeNow().Format(time.RFC3339),
-				ETag:         "\"" + filec.Mark + "\"",
-				Size:         filec.Length,
-				StorageClass: "STANDARD",
-			})
+// CreateBucket has the BucketManager create a new bucket.
+func (g *GoFakeS3) CreateBucket(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucketName := vars["BucketName"]
+	log.Println("CREATE BUCKET:", bucketName)
 
-		}
+	if _, ok := g.source(bucketName); ok {
+		writeError(w, r, errBucketExists)
+		return
 	}
-	x, err := xml.MarshalIndent(bucketc, "", "  ")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if g.manager == nil {
+		writeError(w, r, errBucketsFixed)
+		return
+	}
+	if !validBucketName(bucketName) {
+		writeError(w, r, errInvalidBucketName)
+		return
+	}
+	if err := g.manager.CreateBucket(r.Context(), bucketName); err != nil {
+		log.Println("can't create bucket:", err)
+		writeError(w, r, err)
 		return
 	}
-	w.Write(x)
 
+	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
+	w.Header().Set("Server", "AmazonS3")
+	w.Header().Set("Location", "/"+bucketName)
+	w.WriteHeader(http.StatusOK)
 }
 
-// CreateBucket creates a new S3 bucket in the BoltDB storage.
-func (g *GoFakeS3) CreateBucket(w http.ResponseWriter, r *http.Request) {
+// DeleteBucket removes an empty bucket.
+func (g *GoFakeS3) DeleteBucket(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucketName := vars["BucketName"]
-	log.Println("CREATE BUCKET:", bucketName)
+	log.Println("DELETE BUCKET:", bucketName)
 
-	//We don't support this
-	http.Error(w, "bucket existed", http.StatusBadRequest)
-	return
-
-}
+	if _, ok := g.source(bucketName); !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	if g.manager == nil {
+		writeError(w, r, ErrBucketConfigured)
+		return
+	}
+	if err := g.manager.DeleteBucket(r.Context(), bucketName); err != nil {
+		log.Println("can't delete bucket:", err)
+		writeError(w, r, err)
+		return
+	}
+	g.SetBucketCORS(bucketName, nil)
+	if g.lifecycle != nil {
+		g.lifecycle.SetConfiguration(bucketName, nil)
+	}
 
-// DeleteBucket creates a new S3 bucket in the BoltDB storage.
-func (g *GoFakeS3) DeleteBucket(w http.ResponseWriter, r *http.Request) {
-	io.WriteString(w, "delete bucket")
+	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
+	w.Header().Set("Server", "AmazonS3")
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // HeadBucket checks whether a bucket exists.
@@ -210,10 +271,10 @@ func (g *GoFakeS3) HeadBucket(w http.ResponseWriter, r *http.Request) {
 	log.Println("HEAD BUCKET", bucketName)
 	log.Println("bucketname:", bucketName)
 
-	_, ok := g.access[bucketName]
+	_, ok := g.source(bucketName)
 
 	if !ok {
-		http.Error(w, "bucket does not exist", http.StatusNotFound)
+		writeError(w, r, errNoSuchBucket)
 		return
 	}
 }
@@ -226,138 +287,148 @@ func (g *GoFakeS3) GetObject(w http.ResponseWriter, r *http.Request) {
 	log.Println("Bucket:", bucketName)
 	log.Println("└── Object:", vars["ObjectName"])
 
-	access, ok := g.access[bucketName]
+	access, ok := g.source(bucketName)
 
 	if !ok {
 		log.Println("no bucket")
-		http.Error(w, "bucket does not exist", http.StatusNotFound)
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	access, err := atVersion(access, r.URL.Query().Get("versionId"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// the preconditions are settled on the metadata alone, so that a 304
+	// or 412 never starts a download
+	meta, err := access.Stat(r.Context(), vars["ObjectName"])
+	if err != nil {
+		log.Println("can't get")
+		objectError(w, r, meta, err)
+		return
+	}
+	if !g.checkPreconditions(w, r, meta) {
 		return
 	}
 
-	data, meta, err := access.Get(vars["ObjectName"], false)
+	if r.Header.Get("Range") != "" && g.getObjectRange(w, r, access, vars["ObjectName"], meta) {
+		return
+	}
 
+	body, file, err := access.GetS(r.Context(), vars["ObjectName"], false)
 	if err != nil {
 		log.Println("can't get")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		objectError(w, r, file, err)
 		return
 	}
+	defer body.Close()
+	// the object was replaced since the Stat; the body is of the new one
+	if entityTag(file) != entityTag(meta) && !g.checkPreconditions(w, r, file) {
+		return
+	}
+	meta = file
 
 	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
-	w.Header().Set("x-amz-request-id", "0A49CE4060975EAC")
 
-	w.Header().Set("Last-Modified", g.timeNow().Format("Mon, 2 Jan 2006 15:04:05 MST"))
-	w.Header().Set("ETag", "\""+meta.Mark+"\"")
+	g.setObjectHeaders(w, meta)
+	overrideResponseHeaders(w, r)
 	w.Header().Set("Server", "AmazonS3")
+	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Content-Length", fmt.Sprintf("%v", meta.Length))
-	w.Header().Set("Connection", "close")
-	w.Write(data)
-
+	w.WriteHeader(http.StatusOK)
+	streamBody(w, body)
 }
 
-// CreateObject (Browser Upload) creates a new S3 object.
-func (g *GoFakeS3) CreateObjectBrowserUpload(w http.ResponseWriter, r *http.Request) {
-	log.Println("CREATE OBJECT THROUGH BROWSER UPLOAD")
-	const _24K = (1 << 20) * 24
-	if err := r.ParseMultipartForm(_24K); nil != err {
-		panic(err)
-	}
+// CreateObject creates a new S3 object.
+func (g *GoFakeS3) CreateObject(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucketName := vars["BucketName"]
-	key := r.MultipartForm.Value["key"][0]
 
-	log.Println("(BUC)", bucketName)
-	log.Println("(KEY)", key)
-	fileHeader := r.MultipartForm.File["file"][0]
-	infile, err := fileHeader.Open()
-	if nil != err {
-		panic(err)
-	}
-	body, err := ioutil.ReadAll(infile)
-	if err != nil {
-		panic(err)
-	}
+	log.Println("CREATE OBJECT:", bucketName, vars["ObjectName"])
 
-	access, ok := g.access[bucketName]
+	access, ok := g.source(bucketName)
 
 	if !ok {
 		log.Println("no bucket")
-		http.Error(w, "bucket does not exist", http.StatusNotFound)
+		writeError(w, r, errNoSuchBucket)
 		return
 	}
 
-	meta := make(map[string]string)
-	log.Println(r.MultipartForm)
-	for hk, hv := range r.MultipartForm.Value {
-		if strings.Contains(hk, "X-Amz-") {
-			meta[hk] = hv[0]
-		}
+	key := vars["ObjectName"]
+	if serr := verifyContentMD5(r); serr != nil {
+		writeError(w, r, serr)
+		return
+	}
+
+	meta := collectMetadata(r.Header)
+	if err := checkMetadata(access, meta); err != nil {
+		writeError(w, r, err)
+		return
 	}
-	meta["Last-Modified"] = g.timeNow().Format("Mon, 2 Jan 2006 15:04:05 MST")
 
-	err = access.Put(key, body)
+	hash := md5.New()
+	versionID := ""
+	put := func() error {
+		var err error
+		versionID, err = putObject(r.Context(), access, key, io.TeeReader(r.Body, hash), r.ContentLength, meta)
+		return err
+	}
+	var err error
+	switch match := r.Header.Get("If-None-Match"); match {
+	case "":
+		err = put()
+	case "*":
+		err = g.createOnly(r, access, bucketName, key, put)
+	default:
+		err = &s3Error{http.StatusNotImplemented, "NotImplemented", "If-None-Match on a PUT only supports *"}
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		fmt.Errorf("error while creating")
+		log.Println("error while creating:", err)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if versionID != "" {
+		w.Header().Set("x-amz-version-id", versionID)
+	}
 	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
-	w.Header().Set("x-amz-request-id", "0A49CE4060975EAC")
-	hash := md5.Sum(body)
-	w.Header().Set("ETag", "\""+hex.EncodeToString(hash[:])+"\"")
+	w.Header().Set("ETag", "\""+hex.EncodeToString(hash.Sum(nil))+"\"")
 	w.Header().Set("Server", "AmazonS3")
 	w.Write([]byte{})
-
 }
 
-// CreateObject creates a new S3 object.
-func (g *GoFakeS3) CreateObject(w http.ResponseWriter, r *http.Request) {
+// DeleteObject deletes a S3 object from the bucket.
+func (g *GoFakeS3) DeleteObject(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucketName := vars["BucketName"]
+	log.Println("DELETE OBJECT:", bucketName, vars["ObjectName"])
 
-	log.Println("CREATE OBJECT:", bucketName, vars["ObjectName"])
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		panic(err)
-	}
-
-	access, ok := g.access[bucketName]
+	access, ok := g.source(bucketName)
 
 	if !ok {
 		log.Println("no bucket")
-		http.Error(w, "bucket does not exist", http.StatusNotFound)
+		writeError(w, r, errNoSuchBucket)
 		return
 	}
 
-	meta := make(map[string]string)
-	for hk, hv := range r.Header {
-		if strings.Contains(hk, "X-Amz-") {
-			meta[hk] = hv[0]
-		}
-	}
-	meta["Last-Modified"] = g.timeNow().Format("Mon, 2 Jan 2006 15:04:05 MST")
-	key := vars["ObjectName"]
-
-	err = access.Put(key, body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		fmt.Errorf("error while creating")
+	// deleting a key that is not there succeeds, as it does on S3
+	removed, err := removeObject(r.Context(), access, vars["ObjectName"], r.URL.Query().Get("versionId"))
+	if err != nil && !errors.Is(err, lgpd.ErrNotFound) {
+		log.Println("can't delete")
+		writeError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if removed.VersionID != "" {
+		w.Header().Set("x-amz-version-id", removed.VersionID)
+	}
+	if removed.DeleteMarker {
+		w.Header().Set("x-amz-delete-marker", "true")
+	}
 	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
-	w.Header().Set("x-amz-request-id", "0A49CE4060975EAC")
-	hash := md5.Sum(body)
-	w.Header().Set("ETag", "\""+hex.EncodeToString(hash[:])+"\"")
 	w.Header().Set("Server", "AmazonS3")
-	w.Write([]byte{})
-}
-
-// DeleteObject deletes a S3 object from the bucket.
-func (g *GoFakeS3) DeleteObject(w http.ResponseWriter, r *http.Request) {
-	io.WriteString(w, "delete object")
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // HeadObject retrieves only meta information of an object and not the whole.
@@ -368,39 +439,47 @@ func (g *GoFakeS3) HeadObject(w http.ResponseWriter, r *http.Request) {
 	log.Println("Bucket:", bucketName)
 	log.Println("└── Object:", vars["ObjectName"])
 
-	access, ok := g.access[bucketName]
+	access, ok := g.source(bucketName)
 
 	if !ok {
 		log.Println("no bucket")
-		http.Error(w, "bucket does not exist", http.StatusNotFound)
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	access, err := atVersion(access, r.URL.Query().Get("versionId"))
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	data, meta, err := access.Get(vars["ObjectName"], true)
-
+	meta, err := access.Stat(r.Context(), vars["ObjectName"])
 	if err != nil {
 		log.Println("can't get")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		objectError(w, r, meta, err)
+		return
+	}
+	if !g.checkPreconditions(w, r, meta) {
 		return
 	}
 
 	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
-	w.Header().Set("x-amz-request-id", "0A49CE4060975EAC")
 
-	w.Header().Set("Last-Modified", g.timeNow().Format("Mon, 2 Jan 2006 15:04:05 MST"))
-	w.Header().Set("ETag", "\""+meta.Mark+"\"")
+	g.setObjectHeaders(w, meta)
+	overrideResponseHeaders(w, r)
 	w.Header().Set("Server", "AmazonS3")
+	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Content-Length", fmt.Sprintf("%v", meta.Length))
-	w.Header().Set("Connection", "close")
-	w.Write(data)
-
 }
 
 func (g *GoFakeS3) timeNow() time.Time {
-	return time.Now().In(g.timeLocation)
+	return g.now().In(g.timeLocation)
 }
 
+// SetSource serves hd as the bucket bk. Buckets may be added and removed
+// while the server is running.
 func (g *GoFakeS3) SetSource(bk string, hd lgpd.LGPD) {
+	g.accessLock.Lock()
+	defer g.accessLock.Unlock()
 	if g.access == nil {
 		g.access = make(map[string]lgpd.LGPD)
 	}
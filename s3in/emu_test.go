@@ -0,0 +1,322 @@
+package s3in
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xiaokangwang/s3emu/backend/memory"
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+// newTestServer serves a GoFakeS3 with one empty bucket, "bucket", kept in
+// memory.
+func newTestServer(t *testing.T) (*GoFakeS3, http.Handler) {
+	g := New()
+	g.SetSource("bucket", memory.NewMemoryBackend(0, 0))
+	return g, g.Server()
+}
+
+func do(t *testing.T, h http.Handler, method, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, body)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// errorCode is the Code of the S3 error in w, or "" if there is none.
+func errorCode(w *httptest.ResponseRecorder) string {
+	var e errorResponse
+	if xml.Unmarshal(w.Body.Bytes(), &e) != nil {
+		return ""
+	}
+	return e.Code
+}
+
+func TestPutGetHead(t *testing.T) {
+	_, h := newTestServer(t)
+	header := http.Header{
+		"Content-Type":     {"text/plain"},
+		"X-Amz-Meta-Color": {"blue"},
+	}
+	w := do(t, h, "PUT", "/bucket/dir/hello.txt", strings.NewReader("hello"), header)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT: %v %s", w.Code, w.Body)
+	}
+	const etag = `"5d41402abc4b2a76b9719d911017c592"`
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Fatalf("PUT ETag = %v, want %v", got, etag)
+	}
+
+	w = do(t, h, "GET", "/bucket/dir/hello.txt", nil, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("GET: %v %q", w.Code, w.Body)
+	}
+	for name, want := range map[string]string{
+		"ETag":             etag,
+		"Content-Type":     "text/plain",
+		"Content-Length":   "5",
+		"X-Amz-Meta-Color": "blue",
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("GET %v = %q, want %q", name, got, want)
+		}
+	}
+	if w.Header().Get("Last-Modified") == "" {
+		t.Error("GET has no Last-Modified")
+	}
+
+	w = do(t, h, "HEAD", "/bucket/dir/hello.txt", nil, nil)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("HEAD: %v %q", w.Code, w.Body)
+	}
+	if w.Header().Get("ETag") != etag || w.Header().Get("Content-Length") != "5" {
+		t.Errorf("HEAD headers %v", w.Header())
+	}
+
+	w = do(t, h, "GET", "/bucket/dir/hello.txt", nil, http.Header{"Range": {"bytes=1-3"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "ell" {
+		t.Errorf("GET with Range: %v %q", w.Code, w.Body)
+	}
+
+	w = do(t, h, "DELETE", "/bucket/dir/hello.txt", nil, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %v %s", w.Code, w.Body)
+	}
+	w = do(t, h, "GET", "/bucket/dir/hello.txt", nil, nil)
+	if w.Code != http.StatusNotFound || errorCode(w) != "NoSuchKey" {
+		t.Errorf("GET after DELETE: %v %s", w.Code, w.Body)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	_, h := newTestServer(t)
+	do(t, h, "PUT", "/bucket/a", strings.NewReader("hello"), nil)
+	const etag = `"5d41402abc4b2a76b9719d911017c592"`
+
+	if w := do(t, h, "GET", "/bucket/a", nil, http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Errorf("GET If-None-Match with the ETag: %v", w.Code)
+	}
+	if w := do(t, h, "HEAD", "/bucket/a", nil, http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Errorf("HEAD If-None-Match with the ETag: %v", w.Code)
+	}
+	w := do(t, h, "GET", "/bucket/a", nil, http.Header{"If-Match": {`"other"`}})
+	if w.Code != http.StatusPreconditionFailed || errorCode(w) != "PreconditionFailed" {
+		t.Errorf("GET If-Match with another ETag: %v %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "GET", "/bucket/a", nil, http.Header{"If-Match": {etag}}); w.Code != http.StatusOK {
+		t.Errorf("GET If-Match with the ETag: %v", w.Code)
+	}
+}
+
+// countingBackend counts the downloads started from it.
+type countingBackend struct {
+	lgpd.LGPD
+	gets int
+}
+
+func (c *countingBackend) GetS(ctx context.Context, key string, nofetch bool) (io.ReadCloser, lgpd.File, error) {
+	c.gets++
+	return c.LGPD.GetS(ctx, key, nofetch)
+}
+
+func (c *countingBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, lgpd.File, error) {
+	c.gets++
+	return c.LGPD.GetRange(ctx, key, offset, length)
+}
+
+func TestConditionalGetFetchesNothing(t *testing.T) {
+	g, h := newTestServer(t)
+	backend := &countingBackend{LGPD: memory.NewMemoryBackend(0, 0)}
+	g.SetSource("counted", backend)
+	do(t, h, "PUT", "/counted/a", strings.NewReader("hello"), nil)
+	const etag = `"5d41402abc4b2a76b9719d911017c592"`
+
+	for _, header := range []http.Header{
+		{"If-None-Match": {etag}},
+		{"If-Match": {`"other"`}},
+		{"If-None-Match": {etag}, "Range": {"bytes=1-3"}},
+		{"If-Match": {`"other"`}, "Range": {"bytes=1-3"}},
+	} {
+		if w := do(t, h, "GET", "/counted/a", nil, header); w.Code != http.StatusNotModified && w.Code != http.StatusPreconditionFailed {
+			t.Errorf("GET with %v: %v %s", header, w.Code, w.Body)
+		}
+	}
+	if backend.gets != 0 {
+		t.Errorf("failed preconditions started %d downloads", backend.gets)
+	}
+	if w := do(t, h, "GET", "/counted/a", nil, http.Header{"If-Match": {etag}}); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("GET If-Match with the ETag: %v %q", w.Code, w.Body)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	_, h := newTestServer(t)
+	for _, key := range []string{"a", "dir/b", "dir/c", "dir/sub/d", "e"} {
+		if w := do(t, h, "PUT", "/bucket/"+key, strings.NewReader(key), nil); w.Code != http.StatusOK {
+			t.Fatalf("PUT %v: %v", key, w.Code)
+		}
+	}
+
+	list := func(query string) Bucket {
+		t.Helper()
+		w := do(t, h, "GET", "/bucket?"+query, nil, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET Bucket?%v: %v %s", query, w.Code, w.Body)
+		}
+		var ret Bucket
+		if err := xml.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+	keys := func(b Bucket) string {
+		var ret []string
+		for _, c := range b.Contents {
+			ret = append(ret, c.Key)
+		}
+		for _, p := range b.CommonPrefixes {
+			ret = append(ret, p.Prefix)
+		}
+		return strings.Join(ret, ",")
+	}
+
+	if got := keys(list("")); got != "a,dir/b,dir/c,dir/sub/d,e" {
+		t.Errorf("listing = %v", got)
+	}
+	if got := keys(list("delimiter=/")); got != "a,e,dir/" {
+		t.Errorf("listing with a delimiter = %v", got)
+	}
+	if got := keys(list("prefix=dir/&delimiter=/")); got != "dir/b,dir/c,dir/sub/" {
+		t.Errorf("listing of dir/ = %v", got)
+	}
+	page := list("max-keys=2")
+	if got := keys(page); got != "a,dir/b" || !page.IsTruncated {
+		t.Errorf("first page = %v, truncated %v", got, page.IsTruncated)
+	}
+	page = list("max-keys=2&marker=dir/b")
+	if got := keys(page); got != "dir/c,dir/sub/d" || !page.IsTruncated {
+		t.Errorf("second page = %v, truncated %v", got, page.IsTruncated)
+	}
+
+	for _, query := range []string{"max-keys=0", "list-type=2&max-keys=0"} {
+		if page := list(query); len(page.Contents) != 0 || page.IsTruncated {
+			t.Errorf("listing with %v = %v, truncated %v", query, keys(page), page.IsTruncated)
+		}
+	}
+
+	w := do(t, h, "GET", "/bucket?list-type=2&max-keys=3", nil, nil)
+	var v2 BucketV2
+	if err := xml.Unmarshal(w.Body.Bytes(), &v2); err != nil {
+		t.Fatal(err)
+	}
+	if v2.KeyCount != 3 || !v2.IsTruncated || v2.NextContinuationToken == "" {
+		t.Fatalf("ListObjectsV2 page = %+v", v2)
+	}
+	w = do(t, h, "GET", "/bucket?list-type=2&continuation-token="+v2.NextContinuationToken, nil, nil)
+	v2 = BucketV2{}
+	if err := xml.Unmarshal(w.Body.Bytes(), &v2); err != nil {
+		t.Fatal(err)
+	}
+	if v2.KeyCount != 2 || v2.IsTruncated || v2.Contents[0].Key != "dir/sub/d" {
+		t.Fatalf("ListObjectsV2 last page = %+v", v2)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, h := newTestServer(t)
+	for _, c := range []struct {
+		method, target string
+		status         int
+		code           string
+	}{
+		{"GET", "/bucket/missing", http.StatusNotFound, "NoSuchKey"},
+		{"GET", "/nobucket/a", http.StatusNotFound, "NoSuchBucket"},
+		{"PUT", "/nobucket/a", http.StatusNotFound, "NoSuchBucket"},
+		{"GET", "/nobucket", http.StatusNotFound, "NoSuchBucket"},
+		{"GET", "/bucket?max-keys=x", http.StatusBadRequest, "InvalidArgument"},
+		{"GET", "/bucket?encoding-type=base64", http.StatusBadRequest, "InvalidArgument"},
+	} {
+		w := do(t, h, c.method, c.target, nil, nil)
+		if w.Code != c.status || errorCode(w) != c.code {
+			t.Errorf("%v %v: %v %s, want %v %v", c.method, c.target, w.Code, w.Body, c.status, c.code)
+		}
+		if w.Header().Get("x-amz-request-id") == "" {
+			t.Errorf("%v %v: no x-amz-request-id", c.method, c.target)
+		}
+	}
+
+	// HEAD answers have no body to carry the error
+	w := do(t, h, "HEAD", "/bucket/missing", nil, nil)
+	if w.Code != http.StatusNotFound || w.Body.Len() != 0 {
+		t.Errorf("HEAD of a missing key: %v %q", w.Code, w.Body)
+	}
+
+	// deleting what is not there succeeds, as it does on S3
+	if w := do(t, h, "DELETE", "/bucket/missing", nil, nil); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE of a missing key: %v %s", w.Code, w.Body)
+	}
+
+	w = do(t, h, "PUT", "/bucket/a", strings.NewReader("hello"), http.Header{"Content-Md5": {"XUFAKrxLKna5cZ2REBfFkg=="}})
+	if w.Code != http.StatusOK {
+		t.Errorf("PUT with the right Content-MD5: %v %s", w.Code, w.Body)
+	}
+	w = do(t, h, "PUT", "/bucket/a", strings.NewReader("hellO"), http.Header{"Content-Md5": {"XUFAKrxLKna5cZ2REBfFkg=="}})
+	if w.Code != http.StatusBadRequest || errorCode(w) != "BadDigest" {
+		t.Errorf("PUT with the wrong Content-MD5: %v %s", w.Code, w.Body)
+	}
+}
+
+// limitedBackend keeps no metadata value longer than limit, as Drive does.
+type limitedBackend struct {
+	lgpd.LGPD
+	limit int
+}
+
+func (l limitedBackend) CheckMetadata(meta lgpd.Metadata) error {
+	for _, value := range meta.UserMeta {
+		if len(value) > l.limit {
+			return lgpd.ErrMetadataTooLarge
+		}
+	}
+	return nil
+}
+
+func TestMetadataTooLarge(t *testing.T) {
+	g, h := newTestServer(t)
+	g.SetSource("limited", limitedBackend{LGPD: memory.NewMemoryBackend(0, 0), limit: 10})
+	tooLarge := func(what string, w *httptest.ResponseRecorder) {
+		t.Helper()
+		if w.Code != http.StatusBadRequest || errorCode(w) != "MetadataTooLarge" {
+			t.Errorf("%v: %v %s", what, w.Code, w.Body)
+		}
+	}
+
+	// S3 takes no more than 2KB of user metadata on any bucket
+	huge := http.Header{"X-Amz-Meta-Huge": {strings.Repeat("x", 2048)}}
+	tooLarge("PUT with 2KB of metadata", do(t, h, "PUT", "/bucket/a", strings.NewReader("hello"), huge))
+
+	long := http.Header{"X-Amz-Meta-Long": {strings.Repeat("x", 11)}}
+	tooLarge("PUT past the backend limit", do(t, h, "PUT", "/limited/a", strings.NewReader("hello"), long))
+	tooLarge("CreateMultipartUpload past the backend limit", do(t, h, "POST", "/limited/a?uploads", nil, long))
+	if w := do(t, h, "GET", "/limited", nil, nil); strings.Contains(w.Body.String(), "<Key>") {
+		t.Errorf("the refused objects were stored: %s", w.Body)
+	}
+
+	if w := do(t, h, "PUT", "/limited/a", strings.NewReader("hello"), http.Header{"X-Amz-Meta-Long": {"short"}}); w.Code != http.StatusOK {
+		t.Fatalf("PUT within the backend limit: %v %s", w.Code, w.Body)
+	}
+	copyHeader := http.Header{"X-Amz-Copy-Source": {"/limited/a"}, "X-Amz-Metadata-Directive": {"REPLACE"}}
+	for k, v := range long {
+		copyHeader[k] = v
+	}
+	tooLarge("CopyObject past the backend limit", do(t, h, "PUT", "/limited/b", nil, copyHeader))
+}
@@ -0,0 +1,110 @@
+package s3in
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/versioning"
+)
+
+// s3Error is an error the way S3 reports it: an HTTP status together with
+// the error code SDKs switch on.
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errNoSuchKey    = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errNoSuchBucket = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errBucketExists = &s3Error{http.StatusConflict, "BucketAlreadyExists", "The requested bucket name is not available. The bucket namespace is shared by all users of the system. Please select a different name and try again."}
+	errSlowDown     = &s3Error{http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate."}
+	errInternal     = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+	errMalformedXML = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema."}
+)
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestId string   `xml:"RequestId"`
+}
+
+// toS3Error finds the S3 error that describes err. Errors from the
+// backends are recognised by the lgpd sentinels they wrap; anything else is
+// an InternalError.
+func toS3Error(err error) *s3Error {
+	var serr *s3Error
+	switch {
+	case errors.As(err, &serr):
+		return serr
+	case errors.Is(err, lgpd.ErrNotFound):
+		return errNoSuchKey
+	case errors.Is(err, lgpd.ErrExists):
+		return errBucketExists
+	case errors.Is(err, lgpd.ErrNotEmpty):
+		return errBucketNotEmpty
+	case errors.Is(err, lgpd.ErrBackendUnavailable):
+		return errSlowDown
+	case errors.Is(err, lgpd.ErrMetadataTooLarge):
+		return errMetadataTooLarge
+	case errors.Is(err, versioning.ErrInvalidVersion):
+		return errInvalidVersionID
+	case errors.Is(err, versioning.ErrDeleteMarker):
+		return errDeleteMarker
+	case errors.Is(err, versioning.ErrReservedKey):
+		return errReservedKey
+	case errors.Is(err, errUnsatisfiable):
+		return &s3Error{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable"}
+	}
+	return errInternal
+}
+
+// newRequestID returns a fresh identifier in the form S3 uses for
+// x-amz-request-id.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return strings.ToUpper(hex.EncodeToString(b[:]))
+}
+
+// writeError renders err as an S3 error document under the request ID
+// already given to the response.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Println("error:", err)
+	serr := toS3Error(err)
+	requestID := w.Header().Get("x-amz-request-id")
+	if requestID == "" {
+		requestID = newRequestID()
+		w.Header().Set("x-amz-request-id", requestID)
+	}
+	x, merr := xml.MarshalIndent(&errorResponse{
+		Code:      serr.Code,
+		Message:   serr.Message,
+		Resource:  r.URL.Path,
+		RequestId: requestID,
+	}, "", "  ")
+	if merr != nil {
+		http.Error(w, merr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(serr.Status)
+	if r.Method != "HEAD" {
+		w.Write([]byte(xml.Header))
+		w.Write(x)
+	}
+}
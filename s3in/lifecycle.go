@@ -0,0 +1,151 @@
+package s3in
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xiaokangwang/s3emu/lifecycle"
+)
+
+// maxLifecycleConfigSize is the limit S3 puts on a lifecycle configuration.
+const maxLifecycleConfigSize = 20 << 10
+
+var (
+	errNoSuchLifecycle = &s3Error{http.StatusNotFound, "NoSuchLifecycleConfiguration", "The lifecycle configuration does not exist"}
+	errLifecycleOff    = &s3Error{http.StatusNotImplemented, "NotImplemented", "Lifecycle rules are not enabled on this server."}
+)
+
+// SetLifecycle has lifecycle rules set through the API kept and acted on
+// by s. Without it, the ?lifecycle requests are not implemented.
+func (g *GoFakeS3) SetLifecycle(s *lifecycle.Scanner) {
+	g.lifecycle = s
+}
+
+// AbortUploads aborts the multipart uploads into bucket, of keys starting
+// with prefix, that were initiated no later than before. It is how a
+// lifecycle.Scanner gets rid of incomplete uploads.
+func (g *GoFakeS3) AbortUploads(bucket, prefix string, before time.Time) int {
+	g.multipart.Lock()
+	var expired []*multipartUpload
+	for _, upload := range g.uploads {
+		if upload.bucket == bucket && strings.HasPrefix(upload.key, prefix) && !upload.initiated.After(before) {
+			expired = append(expired, upload)
+		}
+	}
+	g.multipart.Unlock()
+
+	aborted := 0
+	for _, upload := range expired {
+		upload.lock.Lock()
+		// it may have been completed or aborted while unlocked
+		g.multipart.Lock()
+		_, ok := g.uploads[upload.id]
+		g.multipart.Unlock()
+		if ok {
+			log.Println("ABORT MULTIPART UPLOAD:", upload.bucket, upload.key)
+			g.forgetUpload(upload)
+			aborted++
+		}
+		upload.lock.Unlock()
+	}
+	return aborted
+}
+
+// GetBucketLifecycleConfiguration returns the lifecycle configuration of a
+// bucket.
+func (g *GoFakeS3) GetBucketLifecycleConfiguration(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["BucketName"]
+	log.Println("GET BUCKET LIFECYCLE:", bucketName)
+
+	if _, ok := g.source(bucketName); !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	if g.lifecycle == nil {
+		writeError(w, r, errLifecycleOff)
+		return
+	}
+	c := g.lifecycle.Configuration(bucketName)
+	if c == nil {
+		writeError(w, r, errNoSuchLifecycle)
+		return
+	}
+	g.writeXML(w, r, &lifecycle.Configuration{Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/", Rules: c.Rules})
+}
+
+// PutBucketLifecycleConfiguration replaces the lifecycle configuration of
+// a bucket. It lasts until the server restarts, which brings back the
+// configured one.
+func (g *GoFakeS3) PutBucketLifecycleConfiguration(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["BucketName"]
+	log.Println("PUT BUCKET LIFECYCLE:", bucketName)
+
+	if _, ok := g.source(bucketName); !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	if g.lifecycle == nil {
+		writeError(w, r, errLifecycleOff)
+		return
+	}
+	if serr := verifyContentMD5(r); serr != nil {
+		writeError(w, r, serr)
+		return
+	}
+
+	var c lifecycle.Configuration
+	body := io.LimitReader(r.Body, maxLifecycleConfigSize)
+	err := xml.NewDecoder(body).Decode(&c)
+	if err == nil {
+		// read on so that Content-MD5 is checked against the whole body
+		_, err = io.Copy(ioutil.Discard, body)
+	}
+	if err != nil {
+		var serr *s3Error
+		if errors.As(err, &serr) {
+			writeError(w, r, serr)
+			return
+		}
+		writeError(w, r, errMalformedXML)
+		return
+	}
+	c.Xmlns = ""
+	if err := g.lifecycle.SetConfiguration(bucketName, &c); err != nil {
+		var cerr *lifecycle.ConfigError
+		if errors.As(err, &cerr) {
+			err = &s3Error{http.StatusBadRequest, "InvalidArgument", cerr.Reason}
+		}
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
+	w.Header().Set("Server", "AmazonS3")
+}
+
+// DeleteBucketLifecycle removes the lifecycle configuration of a bucket.
+func (g *GoFakeS3) DeleteBucketLifecycle(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["BucketName"]
+	log.Println("DELETE BUCKET LIFECYCLE:", bucketName)
+
+	if _, ok := g.source(bucketName); !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	if g.lifecycle == nil {
+		writeError(w, r, errLifecycleOff)
+		return
+	}
+	g.lifecycle.SetConfiguration(bucketName, nil)
+
+	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
+	w.Header().Set("Server", "AmazonS3")
+	w.WriteHeader(http.StatusNoContent)
+}
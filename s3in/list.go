@@ -0,0 +1,204 @@
+package s3in
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+const defaultMaxKeys = 1000
+
+type CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// BucketV2 is the ListObjectsV2 (list-type=2) answer.
+type BucketV2 struct {
+	XMLName               xml.Name        `xml:"ListBucketResult"`
+	Xmlns                 string          `xml:"xmlns,attr"`
+	Name                  string          `xml:"Name"`
+	Prefix                string          `xml:"Prefix"`
+	StartAfter            string          `xml:"StartAfter,omitempty"`
+	ContinuationToken     string          `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string          `xml:"NextContinuationToken,omitempty"`
+	KeyCount              int             `xml:"KeyCount"`
+	MaxKeys               int             `xml:"MaxKeys"`
+	Delimiter             string          `xml:"Delimiter,omitempty"`
+	EncodingType          string          `xml:"EncodingType,omitempty"`
+	IsTruncated           bool            `xml:"IsTruncated"`
+	Contents              []*Content      `xml:"Contents"`
+	CommonPrefixes        []*CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// listing is one page of a bucket listing, in the terms both list versions
+// share.
+type listing struct {
+	contents       []*Content
+	commonPrefixes []*CommonPrefix
+	truncated      bool
+	// last is the final key or common prefix on the page, where the next
+	// page picks up.
+	last string
+}
+
+// paginate sorts files and cuts out the page after marker, rolling keys
+// that contain delimiter past prefix up into common prefixes. Each common
+// prefix counts once against maxKeys.
+func (g *GoFakeS3) paginate(files []lgpd.File, prefix, delimiter, marker string, maxKeys int) *listing {
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	page := &listing{contents: []*Content{}}
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name, prefix) || file.Name <= marker {
+			continue
+		}
+		common := ""
+		if delimiter != "" {
+			if i := strings.Index(file.Name[len(prefix):], delimiter); i >= 0 {
+				common = file.Name[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		// a common prefix not after the marker was on an earlier page
+		if common != "" && (seen[common] || common <= marker) {
+			continue
+		}
+		if len(page.contents)+len(page.commonPrefixes) >= maxKeys {
+			// max-keys=0 asks for an empty page, not a truncated one
+			page.truncated = maxKeys > 0
+			break
+		}
+		if common != "" {
+			seen[common] = true
+			page.commonPrefixes = append(page.commonPrefixes, &CommonPrefix{Prefix: common})
+			page.last = common
+			continue
+		}
+		page.contents = append(page.contents, &Content{
+			Key:          file.Name,
+			LastModified: g.modTime(file).UTC().Format(listTimeFormat),
+			ETag:         "\"" + entityTag(file) + "\"",
+			Size:         file.Length,
+			StorageClass: "STANDARD",
+		})
+		page.last = file.Name
+	}
+	return page
+}
+
+// encode applies encoding-type=url to the keys and prefixes of the page.
+func (page *listing) encode() {
+	for _, content := range page.contents {
+		content.Key = uriEncode(content.Key, false)
+	}
+	for _, common := range page.commonPrefixes {
+		common.Prefix = uriEncode(common.Prefix, false)
+	}
+}
+
+// listObjects answers GET Bucket in either version, choosing by list-type.
+func (g *GoFakeS3) listObjects(w http.ResponseWriter, r *http.Request, bucketName string, access lgpd.LGPD) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	encodingType := query.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		writeError(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid Encoding Method specified in Request"})
+		return
+	}
+	maxKeys := defaultMaxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "Provided max-keys not an integer or within integer range"})
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	v2 := query.Get("list-type") == "2"
+	marker := query.Get("marker")
+	if v2 {
+		marker = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				writeError(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect"})
+				return
+			}
+			marker = string(decoded)
+		}
+	}
+
+	files, err := access.List(r.Context(), prefix)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	page := g.paginate(files, prefix, delimiter, marker, maxKeys)
+	if encodingType != "" {
+		page.encode()
+		prefix = uriEncode(prefix, false)
+		delimiter = uriEncode(delimiter, false)
+	}
+
+	var result interface{}
+	if v2 {
+		bucketc := &BucketV2{
+			Xmlns:             "http://s3.amazonaws.com/doc/2006-03-01/",
+			Name:              bucketName,
+			Prefix:            prefix,
+			StartAfter:        query.Get("start-after"),
+			ContinuationToken: query.Get("continuation-token"),
+			KeyCount:          len(page.contents) + len(page.commonPrefixes),
+			MaxKeys:           maxKeys,
+			Delimiter:         delimiter,
+			EncodingType:      encodingType,
+			IsTruncated:       page.truncated,
+			Contents:          page.contents,
+			CommonPrefixes:    page.commonPrefixes,
+		}
+		if page.truncated {
+			bucketc.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(page.last))
+		}
+		if encodingType != "" {
+			bucketc.StartAfter = uriEncode(bucketc.StartAfter, false)
+		}
+		result = bucketc
+	} else {
+		bucketc := &Bucket{
+			Xmlns:          "http://s3.amazonaws.com/doc/2006-03-01/",
+			Name:           bucketName,
+			Prefix:         prefix,
+			Marker:         marker,
+			MaxKeys:        maxKeys,
+			Delimiter:      delimiter,
+			EncodingType:   encodingType,
+			IsTruncated:    page.truncated,
+			Contents:       page.contents,
+			CommonPrefixes: page.commonPrefixes,
+		}
+		if page.truncated {
+			bucketc.NextMarker = page.last
+		}
+		if encodingType != "" {
+			bucketc.Marker = uriEncode(bucketc.Marker, false)
+			bucketc.NextMarker = uriEncode(bucketc.NextMarker, false)
+		}
+		result = bucketc
+	}
+
+	x, err := xml.MarshalIndent(result, "", "  ")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Write([]byte(xml.Header))
+	w.Write(x)
+}
@@ -0,0 +1,175 @@
+package s3in
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+const (
+	userMetaPrefix = "x-amz-meta-"
+	// defaultContentType is what S3 reports for an object stored without
+	// a Content-Type.
+	defaultContentType = "binary/octet-stream"
+	// listTimeFormat is how listings render LastModified.
+	listTimeFormat = "2006-01-02T15:04:05.000Z"
+	// etagMeta is the user metadata field keeping the ETag of an object
+	// whose ETag is not the MD5 of its content, as for one completed from
+	// a multipart upload. Clients can neither see nor set it.
+	etagMeta = "s3emu-etag"
+	// maxUserMetaSize is the limit S3 puts on the user metadata of an
+	// object, counting the bytes of every name and value.
+	maxUserMetaSize = 2 << 10
+)
+
+var errMetadataTooLarge = &s3Error{http.StatusBadRequest, "MetadataTooLarge", "Your metadata headers exceed the maximum allowed metadata size."}
+
+// collectMetadata gathers the Content-Type and x-amz-meta-* fields a
+// client sends along with an object, either as request headers or as the
+// fields of a browser upload form. Names are matched case-insensitively.
+func collectMetadata(fields map[string][]string) lgpd.Metadata {
+	var meta lgpd.Metadata
+	for name, values := range fields {
+		lower := strings.ToLower(name)
+		switch {
+		case lower == "content-type" && len(values) > 0:
+			meta.ContentType = values[0]
+		case lower == userMetaPrefix+etagMeta:
+		case strings.HasPrefix(lower, userMetaPrefix) && len(lower) > len(userMetaPrefix):
+			if meta.UserMeta == nil {
+				meta.UserMeta = make(map[string]string)
+			}
+			meta.UserMeta[lower[len(userMetaPrefix):]] = strings.Join(values, ",")
+		}
+	}
+	return meta
+}
+
+// checkMetadata turns meta down before an object described by it is put
+// into access, if it is more than S3 allows or than access can keep.
+func checkMetadata(access lgpd.LGPD, meta lgpd.Metadata) error {
+	size := 0
+	for name, value := range meta.UserMeta {
+		if name != etagMeta {
+			size += len(name) + len(value)
+		}
+	}
+	if size > maxUserMetaSize {
+		return errMetadataTooLarge
+	}
+	return lgpd.CheckMetadata(access, meta)
+}
+
+// withETag returns meta keeping etag as the ETag of the object.
+func withETag(meta lgpd.Metadata, etag string) lgpd.Metadata {
+	userMeta := make(map[string]string, len(meta.UserMeta)+1)
+	for name, value := range meta.UserMeta {
+		userMeta[name] = value
+	}
+	userMeta[etagMeta] = etag
+	meta.UserMeta = userMeta
+	return meta
+}
+
+// withoutETag returns meta without the ETag kept for the object it
+// described, for an object whose content is its own.
+func withoutETag(meta lgpd.Metadata) lgpd.Metadata {
+	if _, ok := meta.UserMeta[etagMeta]; !ok {
+		return meta
+	}
+	userMeta := make(map[string]string, len(meta.UserMeta))
+	for name, value := range meta.UserMeta {
+		if name != etagMeta {
+			userMeta[name] = value
+		}
+	}
+	meta.UserMeta = userMeta
+	return meta
+}
+
+// setObjectHeaders describes file in the headers of a GET or HEAD answer.
+func (g *GoFakeS3) setObjectHeaders(w http.ResponseWriter, file lgpd.File) {
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Last-Modified", g.modTime(file).UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", "\""+entityTag(file)+"\"")
+	if file.VersionID != "" {
+		w.Header().Set("x-amz-version-id", file.VersionID)
+	}
+	for name, value := range file.UserMeta {
+		if name != etagMeta {
+			w.Header().Set(userMetaPrefix+name, value)
+		}
+	}
+}
+
+// entityTag is the ETag of file, unquoted: the one kept in its metadata if
+// any, else the MD5 of its content.
+func entityTag(file lgpd.File) string {
+	if tag, ok := file.UserMeta[etagMeta]; ok {
+		return tag
+	}
+	return file.Mark
+}
+
+// responseOverrides maps the query parameters a GET or HEAD may use to
+// dictate response headers, typically in a presigned download link, to
+// those headers.
+var responseOverrides = map[string]string{
+	"response-content-type":        "Content-Type",
+	"response-content-language":    "Content-Language",
+	"response-expires":             "Expires",
+	"response-cache-control":       "Cache-Control",
+	"response-content-disposition": "Content-Disposition",
+	"response-content-encoding":    "Content-Encoding",
+}
+
+// overrideResponseHeaders applies the response-* query parameters of r.
+func overrideResponseHeaders(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	for param, header := range responseOverrides {
+		if value := query.Get(param); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+}
+
+// streamBody copies an object to the client, flushing as it goes so a
+// large download starts at once rather than once a buffer fills. It stops
+// when the client goes away, as the next write then fails.
+func streamBody(w http.ResponseWriter, body io.Reader) {
+	dst := io.Writer(w)
+	if flusher, ok := w.(http.Flusher); ok {
+		dst = &flushWriter{w: w, flusher: flusher}
+	}
+	if _, err := io.Copy(dst, body); err != nil {
+		log.Println("error while sending:", err)
+	}
+}
+
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.flusher.Flush()
+	return n, err
+}
+
+// modTime is when file was last written, falling back to now for a
+// backend that could not tell.
+func (g *GoFakeS3) modTime(file lgpd.File) time.Time {
+	if file.ModTime.IsZero() {
+		return g.timeNow()
+	}
+	return file.ModTime.In(g.timeLocation)
+}
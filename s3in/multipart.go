@@ -0,0 +1,496 @@
+package s3in
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+const (
+	// minPartSize is the smallest size S3 accepts for any part but the last.
+	minPartSize     = 5 << 20
+	maxPartNumber   = 10000
+	defaultMaxParts = 1000
+)
+
+var errNoSuchUpload = &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist. The upload ID may be invalid, or the upload may have been aborted or completed."}
+
+// multipartUpload is an upload in progress. Its parts are kept as files in
+// dir until the upload is completed or aborted.
+type multipartUpload struct {
+	lock      sync.Mutex
+	bucket    string
+	key       string
+	id        string
+	dir       string
+	initiated time.Time
+	meta      lgpd.Metadata
+	parts     map[int]*uploadedPart
+}
+
+type uploadedPart struct {
+	number   int
+	etag     string
+	size     int64
+	modified time.Time
+}
+
+type InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type CompleteMultipartUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []CompletePart `xml:"Part"`
+}
+
+type CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type PartInfo struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type ListPartsResult struct {
+	XMLName              xml.Name    `xml:"ListPartsResult"`
+	Xmlns                string      `xml:"xmlns,attr"`
+	Bucket               string      `xml:"Bucket"`
+	Key                  string      `xml:"Key"`
+	UploadId             string      `xml:"UploadId"`
+	StorageClass         string      `xml:"StorageClass"`
+	PartNumberMarker     int         `xml:"PartNumberMarker"`
+	NextPartNumberMarker int         `xml:"NextPartNumberMarker"`
+	MaxParts             int         `xml:"MaxParts"`
+	IsTruncated          bool        `xml:"IsTruncated"`
+	Parts                []*PartInfo `xml:"Part"`
+}
+
+type UploadInfo struct {
+	Key          string `xml:"Key"`
+	UploadId     string `xml:"UploadId"`
+	StorageClass string `xml:"StorageClass"`
+	Initiated    string `xml:"Initiated"`
+}
+
+type ListMultipartUploadsResult struct {
+	XMLName            xml.Name      `xml:"ListMultipartUploadsResult"`
+	Xmlns              string        `xml:"xmlns,attr"`
+	Bucket             string        `xml:"Bucket"`
+	KeyMarker          string        `xml:"KeyMarker"`
+	UploadIdMarker     string        `xml:"UploadIdMarker"`
+	NextKeyMarker      string        `xml:"NextKeyMarker,omitempty"`
+	NextUploadIdMarker string        `xml:"NextUploadIdMarker,omitempty"`
+	Prefix             string        `xml:"Prefix"`
+	MaxUploads         int           `xml:"MaxUploads"`
+	IsTruncated        bool          `xml:"IsTruncated"`
+	Uploads            []*UploadInfo `xml:"Upload"`
+}
+
+// SetStagingDir sets where parts of multipart uploads are kept until the
+// upload completes. An empty dir uses the system default temporary
+// directory.
+func (g *GoFakeS3) SetStagingDir(dir string) {
+	g.stagingdir = dir
+}
+
+// CreateMultipartUpload starts a multipart upload.
+func (g *GoFakeS3) CreateMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucketName := vars["BucketName"]
+	key := vars["ObjectName"]
+	log.Println("CREATE MULTIPART UPLOAD:", bucketName, key)
+
+	access, ok := g.source(bucketName)
+	if !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	// the ETag is added on completion, so room is left for the longest
+	meta := collectMetadata(r.Header)
+	if err := checkMetadata(access, withETag(meta, strings.Repeat("0", 32)+"-10000")); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var rawid [16]byte
+	if _, err := rand.Read(rawid[:]); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id := hex.EncodeToString(rawid[:])
+	dir, err := ioutil.TempDir(g.stagingdir, "mpu-"+id+"-")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	g.multipart.Lock()
+	if g.uploads == nil {
+		g.uploads = make(map[string]*multipartUpload)
+	}
+	g.uploads[id] = &multipartUpload{
+		bucket:    bucketName,
+		key:       key,
+		id:        id,
+		dir:       dir,
+		initiated: g.timeNow(),
+		meta:      meta,
+		parts:     make(map[int]*uploadedPart),
+	}
+	g.multipart.Unlock()
+
+	g.writeXML(w, r, &InitiateMultipartUploadResult{
+		Xmlns:    "http://s3.amazonaws.com/doc/2006-03-01/",
+		Bucket:   bucketName,
+		Key:      key,
+		UploadId: id,
+	})
+}
+
+// UploadPart stores one part of a multipart upload on disk.
+func (g *GoFakeS3) UploadPart(w http.ResponseWriter, r *http.Request) {
+	upload, ok := g.upload(r)
+	if !ok {
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > maxPartNumber {
+		writeError(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive"})
+		return
+	}
+	log.Println("UPLOAD PART:", upload.bucket, upload.key, number)
+	if r.Header.Get("x-amz-copy-source") != "" {
+		writeError(w, r, &s3Error{http.StatusNotImplemented, "NotImplemented", "UploadPartCopy is not supported"})
+		return
+	}
+	if serr := verifyContentMD5(r); serr != nil {
+		writeError(w, r, serr)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(upload.dir, "incoming-")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if r.ContentLength >= 0 && size != r.ContentLength {
+		writeError(w, r, &s3Error{http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header."})
+		return
+	}
+
+	part := &uploadedPart{number: number, etag: hex.EncodeToString(hash.Sum(nil)), size: size, modified: g.timeNow()}
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+	if _, err := os.Stat(upload.dir); err != nil {
+		// aborted or completed while the part was arriving
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+	if err := os.Rename(tmp.Name(), partPath(upload, number)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	upload.parts[number] = part
+
+	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
+	w.Header().Set("ETag", "\""+part.etag+"\"")
+	w.Header().Set("Server", "AmazonS3")
+	w.Write([]byte{})
+}
+
+// CompleteMultipartUpload joins the listed parts and stores them as one
+// object with a single streamed put.
+func (g *GoFakeS3) CompleteMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := g.upload(r)
+	if !ok {
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+	access, ok := g.source(upload.bucket)
+	if !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	log.Println("COMPLETE MULTIPART UPLOAD:", upload.bucket, upload.key)
+
+	var request CompleteMultipartUpload
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Parts) == 0 {
+		writeError(w, r, errMalformedXML)
+		return
+	}
+
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+	var parts []*uploadedPart
+	var total int64
+	for i, requested := range request.Parts {
+		if i > 0 && requested.PartNumber <= request.Parts[i-1].PartNumber {
+			writeError(w, r, &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order. Parts must be ordered by part number."})
+			return
+		}
+		part, ok := upload.parts[requested.PartNumber]
+		if !ok || strings.Trim(requested.ETag, "\"") != part.etag {
+			writeError(w, r, &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found. The part may not have been uploaded, or the specified entity tag may not match the part's entity tag."})
+			return
+		}
+		if i < len(request.Parts)-1 && part.size < minPartSize {
+			writeError(w, r, &s3Error{http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size."})
+			return
+		}
+		parts = append(parts, part)
+		total += part.size
+	}
+
+	var readers []io.Reader
+	hashes := md5.New()
+	for _, part := range parts {
+		f, err := os.Open(partPath(upload, part.number))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer f.Close()
+		readers = append(readers, f)
+		sum, _ := hex.DecodeString(part.etag)
+		hashes.Write(sum)
+	}
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(hashes.Sum(nil)), len(parts))
+	meta := withETag(upload.meta, etag)
+
+	versionID, err := putObject(r.Context(), access, upload.key, io.MultiReader(readers...), total, meta)
+	if err != nil {
+		log.Println("error while creating:", err)
+		writeError(w, r, err)
+		return
+	}
+	g.forgetUpload(upload)
+
+	if versionID != "" {
+		w.Header().Set("x-amz-version-id", versionID)
+	}
+	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
+	g.writeXML(w, r, &CompleteMultipartUploadResult{
+		Xmlns:    "http://s3.amazonaws.com/doc/2006-03-01/",
+		Location: "/" + upload.bucket + "/" + upload.key,
+		Bucket:   upload.bucket,
+		Key:      upload.key,
+		ETag:     "\"" + etag + "\"",
+	})
+}
+
+// AbortMultipartUpload drops an upload and the parts staged for it.
+func (g *GoFakeS3) AbortMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := g.upload(r)
+	if !ok {
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+	log.Println("ABORT MULTIPART UPLOAD:", upload.bucket, upload.key)
+	upload.lock.Lock()
+	g.forgetUpload(upload)
+	upload.lock.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListParts lists the parts received so far for an upload.
+func (g *GoFakeS3) ListParts(w http.ResponseWriter, r *http.Request) {
+	upload, ok := g.upload(r)
+	if !ok {
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+	query := r.URL.Query()
+	maxParts := defaultMaxParts
+	if v := query.Get("max-parts"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "Provided max-parts not an integer or within integer range"})
+			return
+		}
+		if n < maxParts {
+			maxParts = n
+		}
+	}
+	marker, _ := strconv.Atoi(query.Get("part-number-marker"))
+
+	result := &ListPartsResult{
+		Xmlns:            "http://s3.amazonaws.com/doc/2006-03-01/",
+		Bucket:           upload.bucket,
+		Key:              upload.key,
+		UploadId:         upload.id,
+		StorageClass:     "STANDARD",
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+	}
+	upload.lock.Lock()
+	var numbers []int
+	for number := range upload.parts {
+		if number > marker {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Ints(numbers)
+	for _, number := range numbers {
+		if len(result.Parts) >= maxParts {
+			result.IsTruncated = maxParts > 0
+			break
+		}
+		part := upload.parts[number]
+		result.Parts = append(result.Parts, &PartInfo{
+			PartNumber:   part.number,
+			LastModified: part.modified.UTC().Format(listTimeFormat),
+			ETag:         "\"" + part.etag + "\"",
+			Size:         part.size,
+		})
+		result.NextPartNumberMarker = number
+	}
+	upload.lock.Unlock()
+	g.writeXML(w, r, result)
+}
+
+// ListMultipartUploads lists the uploads in progress in a bucket.
+func (g *GoFakeS3) ListMultipartUploads(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["BucketName"]
+	if _, ok := g.source(bucketName); !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	query := r.URL.Query()
+	maxUploads := defaultMaxKeys
+	if v := query.Get("max-uploads"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "Provided max-uploads not an integer or within integer range"})
+			return
+		}
+		if n < maxUploads {
+			maxUploads = n
+		}
+	}
+	prefix := query.Get("prefix")
+	keyMarker := query.Get("key-marker")
+	uploadIdMarker := query.Get("upload-id-marker")
+
+	var uploads []*multipartUpload
+	g.multipart.Lock()
+	for _, upload := range g.uploads {
+		if upload.bucket != bucketName || !strings.HasPrefix(upload.key, prefix) {
+			continue
+		}
+		if upload.key < keyMarker || upload.key == keyMarker && (uploadIdMarker == "" || upload.id <= uploadIdMarker) {
+			continue
+		}
+		uploads = append(uploads, upload)
+	}
+	g.multipart.Unlock()
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].key != uploads[j].key {
+			return uploads[i].key < uploads[j].key
+		}
+		return uploads[i].id < uploads[j].id
+	})
+
+	result := &ListMultipartUploadsResult{
+		Xmlns:          "http://s3.amazonaws.com/doc/2006-03-01/",
+		Bucket:         bucketName,
+		KeyMarker:      keyMarker,
+		UploadIdMarker: uploadIdMarker,
+		Prefix:         prefix,
+		MaxUploads:     maxUploads,
+	}
+	for _, upload := range uploads {
+		if len(result.Uploads) >= maxUploads {
+			result.IsTruncated = maxUploads > 0
+			break
+		}
+		result.Uploads = append(result.Uploads, &UploadInfo{
+			Key:          upload.key,
+			UploadId:     upload.id,
+			StorageClass: "STANDARD",
+			Initiated:    upload.initiated.UTC().Format(listTimeFormat),
+		})
+		result.NextKeyMarker = upload.key
+		result.NextUploadIdMarker = upload.id
+	}
+	g.writeXML(w, r, result)
+}
+
+// upload finds the upload named by the uploadId of r, provided it belongs
+// to the bucket and key of r.
+func (g *GoFakeS3) upload(r *http.Request) (*multipartUpload, bool) {
+	vars := mux.Vars(r)
+	g.multipart.Lock()
+	defer g.multipart.Unlock()
+	upload, ok := g.uploads[r.URL.Query().Get("uploadId")]
+	if !ok || upload.bucket != vars["BucketName"] || upload.key != vars["ObjectName"] {
+		return nil, false
+	}
+	return upload, true
+}
+
+// forgetUpload removes upload and its parts. The caller holds upload.lock.
+func (g *GoFakeS3) forgetUpload(upload *multipartUpload) {
+	g.multipart.Lock()
+	delete(g.uploads, upload.id)
+	g.multipart.Unlock()
+	os.RemoveAll(upload.dir)
+}
+
+func partPath(upload *multipartUpload, number int) string {
+	return filepath.Join(upload.dir, fmt.Sprintf("part-%05d", number))
+}
+
+func (g *GoFakeS3) writeXML(w http.ResponseWriter, r *http.Request, v interface{}) {
+	x, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Write([]byte(xml.Header))
+	w.Write(x)
+}
@@ -0,0 +1,89 @@
+package s3in
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xiaokangwang/s3emu/backend/memory"
+	"github.com/xiaokangwang/s3emu/versioning"
+)
+
+// completeUpload puts value into key of bucket through a multipart upload
+// of one part, returning the answer to CompleteMultipartUpload.
+func completeUpload(t *testing.T, h http.Handler, bucket, key, value string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := do(t, h, "POST", "/"+bucket+"/"+key+"?uploads", nil, http.Header{"X-Amz-Meta-Color": {"blue"}})
+	var initiated InitiateMultipartUploadResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &initiated); err != nil {
+		t.Fatalf("CreateMultipartUpload: %v %s", w.Code, w.Body)
+	}
+	target := "/" + bucket + "/" + key + "?uploadId=" + initiated.UploadId
+	w = do(t, h, "PUT", target+"&partNumber=1", strings.NewReader(value), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("UploadPart: %v %s", w.Code, w.Body)
+	}
+	complete := "<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>" + w.Header().Get("ETag") + "</ETag></Part></CompleteMultipartUpload>"
+	return do(t, h, "POST", target, strings.NewReader(complete), nil)
+}
+
+func TestMultipartETag(t *testing.T) {
+	_, h := newTestServer(t)
+	partSum := md5.Sum([]byte("hello"))
+	sum := md5.Sum(partSum[:])
+	want := "\"" + hex.EncodeToString(sum[:]) + "-1\""
+
+	w := completeUpload(t, h, "bucket", "a", "hello")
+	var result CompleteMultipartUploadResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || result.ETag != want {
+		t.Fatalf("CompleteMultipartUpload: %v %s, want ETag %v", w.Code, w.Body, want)
+	}
+
+	w = do(t, h, "HEAD", "/bucket/a", nil, nil)
+	if got := w.Header().Get("ETag"); got != want {
+		t.Errorf("HEAD ETag = %v, want %v", got, want)
+	}
+	if w.Header().Get("X-Amz-Meta-Color") != "blue" || w.Header().Get("X-Amz-Meta-S3emu-Etag") != "" {
+		t.Errorf("HEAD metadata %v", w.Header())
+	}
+	if w := do(t, h, "GET", "/bucket/a", nil, http.Header{"If-Match": {want}}); w.Code != http.StatusOK {
+		t.Errorf("GET If-Match with the multipart ETag: %v", w.Code)
+	}
+
+	w = do(t, h, "GET", "/bucket", nil, nil)
+	var listing Bucket
+	if err := xml.Unmarshal(w.Body.Bytes(), &listing); err != nil || len(listing.Contents) != 1 || listing.Contents[0].ETag != want {
+		t.Errorf("listing: %s", w.Body)
+	}
+
+	// a client cannot set the ETag through metadata
+	do(t, h, "PUT", "/bucket/a", strings.NewReader("hello"), http.Header{"X-Amz-Meta-S3emu-Etag": {"forged"}})
+	w = do(t, h, "HEAD", "/bucket/a", nil, nil)
+	if got := w.Header().Get("ETag"); got != "\""+hex.EncodeToString(partSum[:])+"\"" {
+		t.Errorf("HEAD ETag after a PUT = %v", got)
+	}
+}
+
+func TestMultipartVersioned(t *testing.T) {
+	g, h := newTestServer(t)
+	store := versioning.New(memory.NewMemoryBackend(0, 0))
+	if err := store.SetStatus(context.Background(), versioning.Enabled); err != nil {
+		t.Fatal(err)
+	}
+	g.SetSource("versioned", store)
+
+	w := completeUpload(t, h, "versioned", "a", "hello")
+	id := w.Header().Get("x-amz-version-id")
+	if w.Code != http.StatusOK || id == "" {
+		t.Fatalf("CompleteMultipartUpload: %v, version %q", w.Code, id)
+	}
+	w = do(t, h, "HEAD", "/versioned/a?versionId="+id, nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("x-amz-version-id") != id {
+		t.Fatalf("HEAD of the version: %v %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,378 @@
+package s3in
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxPostFields is how much form data may precede the file of a browser
+// upload.
+const maxPostFields = 20 << 10
+
+var (
+	errMalformedPOST  = &s3Error{http.StatusBadRequest, "MalformedPOSTRequest", "The body of your POST request is not well-formed multipart/form-data."}
+	errPostTooLarge   = &s3Error{http.StatusBadRequest, "MaxPostPreDataLengthExceededError", "Your POST request fields preceding the upload file were too large."}
+	errPostNoKey      = &s3Error{http.StatusBadRequest, "InvalidArgument", "Bucket POST must contain a field named 'key'.  If it is specified, please check the order of the fields."}
+	errPostNoFile     = &s3Error{http.StatusBadRequest, "InvalidArgument", "POST requires exactly one file upload per request."}
+	errPostNoPolicy   = &s3Error{http.StatusForbidden, "AccessDenied", "Bucket POST must contain a field named 'policy'."}
+	errPostSignature  = &s3Error{http.StatusBadRequest, "InvalidArgument", "Bucket POST must contain the fields x-amz-algorithm, x-amz-credential, x-amz-date and x-amz-signature for AWS4-HMAC-SHA256 signing."}
+	errEntityTooLarge = &s3Error{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed size"}
+	errEntityTooSmall = &s3Error{http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed size"}
+)
+
+// exemptPostFields need not be mentioned by the policy.
+var exemptPostFields = map[string]bool{
+	"policy":          true,
+	"x-amz-signature": true,
+	"file":            true,
+}
+
+type PostResponse struct {
+	XMLName  xml.Name `xml:"PostResponse"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type postPolicy struct {
+	Expiration string            `json:"expiration"`
+	Conditions []json.RawMessage `json:"conditions"`
+}
+
+// formPost matches the POST of an HTML form, which S3 takes as a browser
+// upload. The form is signed through its policy rather than like other
+// requests.
+func formPost(r *http.Request, _ *mux.RouteMatch) bool {
+	return isFormPost(r)
+}
+
+func isFormPost(r *http.Request) bool {
+	if r.Method != "POST" || r.URL.RawQuery != "" || r.Header.Get("Authorization") != "" {
+		return false
+	}
+	mediatype, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediatype == "multipart/form-data"
+}
+
+// CreateObjectBrowserUpload stores the file of an HTML form upload, as S3
+// does for POST Object. The form fields must satisfy the policy the form
+// carries, and with credentials configured the policy must be signed by
+// one of them. The file must be the last field; it is streamed to the
+// backend as it arrives.
+func (g *GoFakeS3) CreateObjectBrowserUpload(w http.ResponseWriter, r *http.Request) {
+	log.Println("CREATE OBJECT THROUGH BROWSER UPLOAD")
+	bucketName := mux.Vars(r)["BucketName"]
+	access, ok := g.source(bucketName)
+	if !ok {
+		log.Println("no bucket")
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, r, errMalformedPOST)
+		return
+	}
+	fields := make(map[string][]string)
+	var file *multipart.Part
+	var size int64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, r, errMalformedPOST)
+			return
+		}
+		name := strings.ToLower(part.FormName())
+		if name == "file" {
+			file = part
+			break
+		}
+		if name == "" {
+			continue
+		}
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxPostFields-size+1))
+		if err != nil {
+			writeError(w, r, errMalformedPOST)
+			return
+		}
+		if size += int64(len(value)); size > maxPostFields {
+			writeError(w, r, errPostTooLarge)
+			return
+		}
+		fields[name] = append(fields[name], string(value))
+	}
+	if file == nil {
+		writeError(w, r, errPostNoFile)
+		return
+	}
+	key := formValue(fields, "key")
+	if key == "" {
+		writeError(w, r, errPostNoKey)
+		return
+	}
+
+	if serr := g.verifyPostSignature(fields); serr != nil {
+		writeError(w, r, serr)
+		return
+	}
+	body := &limitedBody{r: file, min: 0, max: -1}
+	if policy := formValue(fields, "policy"); policy != "" {
+		if serr := checkPostPolicy(policy, bucketName, fields, g.timeNow(), body); serr != nil {
+			writeError(w, r, serr)
+			return
+		}
+	}
+
+	key = strings.Replace(key, "${filename}", file.FileName(), -1)
+	log.Println("(BUC)", bucketName)
+	log.Println("(KEY)", key)
+	meta := collectMetadata(fields)
+	if meta.ContentType == "" {
+		meta.ContentType = file.Header.Get("Content-Type")
+	}
+	if err := checkMetadata(access, meta); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	hash := md5.New()
+	versionID, err := putObject(r.Context(), access, key, io.TeeReader(body, hash), -1, meta)
+	if err != nil {
+		log.Println("error while creating:", err)
+		writeError(w, r, err)
+		return
+	}
+
+	etag := "\"" + hex.EncodeToString(hash.Sum(nil)) + "\""
+	location := objectURL(r, bucketName, key)
+	if versionID != "" {
+		w.Header().Set("x-amz-version-id", versionID)
+	}
+	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Location", location)
+	w.Header().Set("Server", "AmazonS3")
+
+	redirect := formValue(fields, "success_action_redirect")
+	if redirect == "" {
+		redirect = formValue(fields, "redirect")
+	}
+	// like S3, an unusable redirect falls back to success_action_status
+	if target, err := url.Parse(redirect); redirect != "" && err == nil && target.IsAbs() {
+		query := target.Query()
+		query.Set("bucket", bucketName)
+		query.Set("key", key)
+		query.Set("etag", etag)
+		target.RawQuery = query.Encode()
+		http.Redirect(w, r, target.String(), http.StatusSeeOther)
+		return
+	}
+	switch formValue(fields, "success_action_status") {
+	case "200":
+		w.WriteHeader(http.StatusOK)
+	case "201":
+		w.WriteHeader(http.StatusCreated)
+		g.writeXML(w, r, &PostResponse{Location: location, Bucket: bucketName, Key: key, ETag: etag})
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verifyPostSignature checks the SigV4 signature of the policy of a
+// browser upload. As with other requests, nothing is checked as long as
+// no credentials are configured.
+func (g *GoFakeS3) verifyPostSignature(fields map[string][]string) *s3Error {
+	if len(g.credentials) == 0 {
+		return nil
+	}
+	policy := formValue(fields, "policy")
+	if policy == "" {
+		return errPostNoPolicy
+	}
+	if formValue(fields, "x-amz-algorithm") != signV4Algorithm || formValue(fields, "x-amz-signature") == "" {
+		return errPostSignature
+	}
+	sig := &signature{}
+	if !sig.parseCredential(formValue(fields, "x-amz-credential")) {
+		return errPostSignature
+	}
+	var err error
+	sig.amzDate, err = time.Parse(amzDateFormat, formValue(fields, "x-amz-date"))
+	if err != nil || sig.service != "s3" || sig.amzDate.Format("20060102") != sig.date {
+		return errPostSignature
+	}
+	secret, ok := g.credentials[sig.accessKey]
+	if !ok {
+		return errUnknownKey
+	}
+	expected := hex.EncodeToString(hmacSHA256(sig.signingKey(secret), policy))
+	if !hmac.Equal([]byte(expected), []byte(formValue(fields, "x-amz-signature"))) {
+		return errSignature
+	}
+	return nil
+}
+
+// checkPostPolicy decodes the base64 encoded policy and checks that it has
+// not expired, that the form fields meet each of its conditions and that
+// it names every field but the exempt ones. A content-length-range
+// condition is left to body to enforce as the file is read.
+func checkPostPolicy(encoded, bucket string, fields map[string][]string, now time.Time, body *limitedBody) *s3Error {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return invalidPolicy("Policy is not base64 encoded.")
+	}
+	var policy postPolicy
+	if err := json.Unmarshal(raw, &policy); err != nil {
+		return invalidPolicy("Policy is not valid JSON.")
+	}
+	expiration, err := time.Parse(time.RFC3339, policy.Expiration)
+	if err != nil {
+		return invalidPolicy("Invalid 'expiration' value: '" + policy.Expiration + "'")
+	}
+	if now.After(expiration) {
+		return policyViolated("Policy expired.")
+	}
+
+	value := func(name string) string {
+		if name == "bucket" {
+			return bucket
+		}
+		return formValue(fields, name)
+	}
+	covered := make(map[string]bool)
+	for _, condition := range policy.Conditions {
+		var exact map[string]string
+		if json.Unmarshal(condition, &exact) == nil {
+			for name, want := range exact {
+				name = strings.ToLower(name)
+				covered[name] = true
+				if value(name) != want {
+					return policyViolated("Policy Condition failed: [\"eq\", \"$" + name + "\", \"" + want + "\"]")
+				}
+			}
+			continue
+		}
+		var terms []interface{}
+		if json.Unmarshal(condition, &terms) != nil || len(terms) != 3 {
+			return invalidPolicy("Invalid Policy: Invalid Condition: " + string(condition))
+		}
+		op, _ := terms[0].(string)
+		switch strings.ToLower(op) {
+		case "content-length-range":
+			min, okmin := terms[1].(float64)
+			max, okmax := terms[2].(float64)
+			if !okmin || !okmax || min < 0 || max < min {
+				return invalidPolicy("Invalid Policy: Invalid content-length-range: " + string(condition))
+			}
+			body.min, body.max = int64(min), int64(max)
+		case "eq", "starts-with":
+			field, _ := terms[1].(string)
+			want, okwant := terms[2].(string)
+			if !strings.HasPrefix(field, "$") || !okwant {
+				return invalidPolicy("Invalid Policy: Invalid Condition: " + string(condition))
+			}
+			name := strings.ToLower(field[1:])
+			covered[name] = true
+			if !conditionHolds(strings.ToLower(op), name, value(name), want) {
+				return policyViolated("Policy Condition failed: " + string(condition))
+			}
+		default:
+			return invalidPolicy("Invalid Policy: Invalid Condition: " + string(condition))
+		}
+	}
+
+	for name := range fields {
+		if !exemptPostFields[name] && !strings.HasPrefix(name, "x-ignore-") && !covered[name] {
+			return policyViolated("Extra input fields: " + name)
+		}
+	}
+	return nil
+}
+
+// conditionHolds evaluates an eq or starts-with condition. For
+// Content-Type, starts-with must hold for each of a comma separated list.
+func conditionHolds(op, name, value, want string) bool {
+	if op == "eq" {
+		return value == want
+	}
+	if name != "content-type" {
+		return strings.HasPrefix(value, want)
+	}
+	for _, v := range strings.Split(value, ",") {
+		if !strings.HasPrefix(strings.TrimSpace(v), want) {
+			return false
+		}
+	}
+	return true
+}
+
+func invalidPolicy(message string) *s3Error {
+	return &s3Error{http.StatusBadRequest, "InvalidPolicyDocument", message}
+}
+
+func policyViolated(message string) *s3Error {
+	return &s3Error{http.StatusForbidden, "AccessDenied", "Invalid according to Policy: " + message}
+}
+
+// formValue is the first value of the form field name.
+func formValue(fields map[string][]string, name string) string {
+	if values := fields[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// objectURL is where the object key of bucket can be fetched, as seen by
+// the client that sent r.
+func objectURL(r *http.Request, bucket, key string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	segments := strings.Split(bucket+"/"+key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return scheme + "://" + r.Host + "/" + strings.Join(segments, "/")
+}
+
+// limitedBody fails the read that takes the file of a browser upload past
+// max bytes, or that ends it short of min, so the object is never stored.
+// A negative max means no limit.
+type limitedBody struct {
+	r        io.Reader
+	n        int64
+	min, max int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.max >= 0 && b.n > b.max {
+		return n, errEntityTooLarge
+	}
+	if err == io.EOF && b.n < b.min {
+		return n, errEntityTooSmall
+	}
+	return n, err
+}
@@ -0,0 +1,230 @@
+package s3in
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/xiaokangwang/s3emu/backend/memory"
+	"github.com/xiaokangwang/s3emu/versioning"
+)
+
+// postForm sends a browser upload of fields, in order, followed by the
+// file filename holding content.
+func postForm(t *testing.T, h http.Handler, target string, fields [][2]string, filename, content string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, field := range fields {
+		form.WriteField(field[0], field[1])
+	}
+	file, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte(content))
+	form.Close()
+	return do(t, h, "POST", target, &body, http.Header{"Content-Type": {form.FormDataContentType()}})
+}
+
+// encodePolicy is the base64 policy document expiring at expiration with
+// conditions.
+func encodePolicy(t *testing.T, expiration time.Time, conditions ...interface{}) string {
+	t.Helper()
+	raw, err := json.Marshal(map[string]interface{}{
+		"expiration": expiration.UTC().Format(time.RFC3339),
+		"conditions": conditions,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestPostObject(t *testing.T) {
+	g, h := newTestServer(t)
+
+	w := postForm(t, h, "/bucket", [][2]string{{"key", "uploads/${filename}"}, {"Content-Type", "text/plain"}, {"x-amz-meta-color", "blue"}}, "hello.txt", "hello")
+	if w.Code != http.StatusNoContent || w.Header().Get("ETag") != md5Tag("hello") {
+		t.Fatalf("POST: %v %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Location"); got != "http://example.com/bucket/uploads/hello.txt" {
+		t.Errorf("Location = %v", got)
+	}
+	w = do(t, h, "GET", "/bucket/uploads/hello.txt", nil, nil)
+	if w.Body.String() != "hello" || w.Header().Get("Content-Type") != "text/plain" || w.Header().Get("X-Amz-Meta-Color") != "blue" {
+		t.Errorf("GET of the upload: %v %q %v", w.Code, w.Body, w.Header())
+	}
+
+	w = postForm(t, h, "/bucket", [][2]string{{"key", "a"}, {"success_action_status", "201"}}, "a", "hello")
+	var response PostResponse
+	if err := xml.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusCreated || response.Key != "a" || response.Bucket != "bucket" || response.ETag != md5Tag("hello") {
+		t.Errorf("POST with success_action_status 201: %v %s", w.Code, w.Body)
+	}
+	if w := postForm(t, h, "/bucket", [][2]string{{"key", "a"}, {"success_action_status", "200"}}, "a", "hello"); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("POST with success_action_status 200: %v %s", w.Code, w.Body)
+	}
+
+	w = postForm(t, h, "/bucket", [][2]string{{"key", "a b"}, {"success_action_redirect", "https://example.org/done?from=form"}}, "a", "hello")
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST with success_action_redirect: %v %s", w.Code, w.Body)
+	}
+	target, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || target.Host != "example.org" || target.Query().Get("from") != "form" || target.Query().Get("key") != "a b" ||
+		target.Query().Get("bucket") != "bucket" || target.Query().Get("etag") != md5Tag("hello") {
+		t.Errorf("redirect to %v", w.Header().Get("Location"))
+	}
+	// a redirect that is not an absolute URL is not followed
+	if w := postForm(t, h, "/bucket", [][2]string{{"key", "a"}, {"success_action_redirect", "/done"}}, "a", "hello"); w.Code != http.StatusNoContent {
+		t.Errorf("POST with a relative redirect: %v %v", w.Code, w.Header())
+	}
+
+	store := versioning.New(memory.NewMemoryBackend(0, 0))
+	if err := store.SetStatus(context.Background(), versioning.Enabled); err != nil {
+		t.Fatal(err)
+	}
+	g.SetSource("versioned", store)
+	w = postForm(t, h, "/versioned", [][2]string{{"key", "a"}}, "a", "hello")
+	if id := w.Header().Get("x-amz-version-id"); w.Code != http.StatusNoContent || id == "" {
+		t.Errorf("POST into a versioned bucket: %v %v", w.Code, w.Header())
+	} else if w := do(t, h, "HEAD", "/versioned/a?versionId="+id, nil, nil); w.Code != http.StatusOK {
+		t.Errorf("HEAD of the version posted: %v", w.Code)
+	}
+
+	w = postForm(t, h, "/bucket", nil, "a", "hello")
+	if w.Code != http.StatusBadRequest || errorCode(w) != "InvalidArgument" {
+		t.Errorf("POST without a key: %v %s", w.Code, w.Body)
+	}
+	if w := postForm(t, h, "/nobucket", [][2]string{{"key", "a"}}, "a", "hello"); errorCode(w) != "NoSuchBucket" {
+		t.Errorf("POST into a missing bucket: %v %s", w.Code, w.Body)
+	}
+}
+
+func TestPostPolicy(t *testing.T) {
+	_, h := newTestServer(t)
+	later := time.Now().Add(time.Hour)
+	post := func(policy string, fields [][2]string, content string) *httptest.ResponseRecorder {
+		t.Helper()
+		return postForm(t, h, "/bucket", append([][2]string{{"policy", policy}}, fields...), "photo.jpg", content)
+	}
+	allowed := func(what string, w *httptest.ResponseRecorder) {
+		t.Helper()
+		if w.Code != http.StatusNoContent {
+			t.Errorf("%v: %v %s", what, w.Code, w.Body)
+		}
+	}
+	refused := func(what string, w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || errorCode(w) != code {
+			t.Errorf("%v: %v %s, want %v %v", what, w.Code, w.Body, status, code)
+		}
+	}
+
+	policy := encodePolicy(t, later,
+		map[string]string{"bucket": "bucket"},
+		[]interface{}{"starts-with", "$key", "user/"},
+		[]interface{}{"starts-with", "$Content-Type", "image/"},
+		[]interface{}{"eq", "$x-amz-meta-color", "blue"},
+		[]interface{}{"content-length-range", 1, 10},
+	)
+	fields := func(key, contentType, color string) [][2]string {
+		return [][2]string{{"key", key}, {"Content-Type", contentType}, {"x-amz-meta-color", color}}
+	}
+	allowed("POST meeting the policy", post(policy, fields("user/a", "image/jpeg", "blue"), "hello"))
+	allowed("POST of several content types", post(policy, fields("user/a", "image/jpeg, image/png", "blue"), "hello"))
+	allowed("POST with an ignored field", post(policy, append(fields("user/a", "image/jpeg", "blue"), [2]string{"x-ignore-me", "x"}), "hello"))
+
+	refused("POST of another key", post(policy, fields("admin/a", "image/jpeg", "blue"), "hello"), http.StatusForbidden, "AccessDenied")
+	refused("POST of another content type", post(policy, fields("user/a", "image/jpeg, text/html", "blue"), "hello"), http.StatusForbidden, "AccessDenied")
+	refused("POST of another color", post(policy, fields("user/a", "image/jpeg", "red"), "hello"), http.StatusForbidden, "AccessDenied")
+	refused("POST of a field the policy leaves out", post(policy, append(fields("user/a", "image/jpeg", "blue"), [2]string{"x-amz-meta-size", "large"}), "hello"), http.StatusForbidden, "AccessDenied")
+	refused("POST of a large file", post(policy, fields("user/b", "image/jpeg", "blue"), "hello world"), http.StatusBadRequest, "EntityTooLarge")
+	refused("POST of an empty file", post(policy, fields("user/b", "image/jpeg", "blue"), ""), http.StatusBadRequest, "EntityTooSmall")
+	if w := do(t, h, "HEAD", "/bucket/user/b", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("a file outside content-length-range was stored: %v", w.Code)
+	}
+
+	refused("POST with an expired policy", post(encodePolicy(t, time.Now().Add(-time.Minute), []interface{}{"starts-with", "$key", ""}), [][2]string{{"key", "a"}}, "hello"), http.StatusForbidden, "AccessDenied")
+	refused("POST of another bucket", post(encodePolicy(t, later, map[string]string{"bucket": "other"}, []interface{}{"starts-with", "$key", ""}), [][2]string{{"key", "a"}}, "hello"), http.StatusForbidden, "AccessDenied")
+	refused("POST with a policy that is not base64", post("{}", [][2]string{{"key", "a"}}, "hello"), http.StatusBadRequest, "InvalidPolicyDocument")
+	refused("POST with a policy that is not JSON", post(base64.StdEncoding.EncodeToString([]byte("policy")), [][2]string{{"key", "a"}}, "hello"), http.StatusBadRequest, "InvalidPolicyDocument")
+	refused("POST with an unknown condition", post(encodePolicy(t, later, []interface{}{"ends-with", "$key", "a"}), [][2]string{{"key", "a"}}, "hello"), http.StatusBadRequest, "InvalidPolicyDocument")
+	refused("POST with a reversed content-length-range", post(encodePolicy(t, later, []interface{}{"content-length-range", 10, 1}), [][2]string{{"key", "a"}}, "hello"), http.StatusBadRequest, "InvalidPolicyDocument")
+}
+
+func TestPostSigned(t *testing.T) {
+	g, h := newTestServer(t)
+	now := time.Now().UTC()
+	g.now = func() time.Time { return now }
+	g.SetCredential("AK", "SK")
+
+	sig := &signature{accessKey: "AK", date: now.Format("20060102"), region: "us-east-1", service: "s3", amzDate: now}
+	credential := "AK/" + sig.scope()
+	policy := encodePolicy(t, now.Add(time.Hour),
+		map[string]string{"bucket": "bucket"},
+		[]interface{}{"starts-with", "$key", ""},
+		map[string]string{"x-amz-algorithm": signV4Algorithm},
+		map[string]string{"x-amz-credential": credential},
+		map[string]string{"x-amz-date": now.Format(amzDateFormat)},
+	)
+	fields := func(policy, credential, signature string) [][2]string {
+		return [][2]string{
+			{"key", "a"},
+			{"x-amz-algorithm", signV4Algorithm},
+			{"x-amz-credential", credential},
+			{"x-amz-date", now.Format(amzDateFormat)},
+			{"policy", policy},
+			{"x-amz-signature", signature},
+		}
+	}
+	signed := hexHMAC(sig.signingKey("SK"), policy)
+
+	if w := postForm(t, h, "/bucket", fields(policy, credential, signed), "a", "hello"); w.Code != http.StatusNoContent {
+		t.Fatalf("signed POST: %v %s", w.Code, w.Body)
+	}
+	for _, c := range []struct {
+		name   string
+		fields [][2]string
+		status int
+		code   string
+	}{
+		{"no policy", [][2]string{{"key", "a"}}, http.StatusForbidden, "AccessDenied"},
+		{"no signature", fields(policy, credential, "")[:5], http.StatusBadRequest, "InvalidArgument"},
+		{"a wrong signature", fields(policy, credential, hexHMAC(sig.signingKey("WRONG"), policy)), http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"an altered policy", fields(encodePolicy(t, now.Add(time.Hour), []interface{}{"starts-with", "$key", ""}), credential, signed), http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"an unknown key", fields(policy, "OTHER/"+sig.scope(), signed), http.StatusForbidden, "InvalidAccessKeyId"},
+		{"a malformed credential", fields(policy, "AK", signed), http.StatusBadRequest, "InvalidArgument"},
+	} {
+		w := postForm(t, h, "/bucket", c.fields, "a", "hello")
+		if w.Code != c.status || errorCode(w) != c.code {
+			t.Errorf("POST with %v: %v %s, want %v %v", c.name, w.Code, w.Body, c.status, c.code)
+		}
+	}
+
+	// a form with an Authorization header is not a browser upload, and
+	// is signed like any other request
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("key", "a")
+	form.Close()
+	w := do(t, h, "POST", "/bucket", &body, http.Header{
+		"Content-Type":  {form.FormDataContentType()},
+		"Authorization": {signV4Algorithm + " Credential=AK/" + sig.scope() + ", SignedHeaders=host, Signature=00"},
+	})
+	if w.Code < 400 {
+		t.Errorf("form POST with an Authorization header: %v %s", w.Code, w.Body)
+	}
+}
+
+func hexHMAC(key []byte, data string) string {
+	return hex.EncodeToString(hmacSHA256(key, data))
+}
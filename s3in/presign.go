@@ -0,0 +1,41 @@
+package s3in
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Presign returns rawurl carrying a SigV4 query string signature that lets
+// anyone holding it make a method request to it until expires has passed
+// from now, as the AWS SDKs' presigners do. Only the host header is
+// signed and the payload is left unsigned, so a presigned PUT accepts any
+// body.
+func Presign(method, rawurl, accessKey, secretKey, region string, expires time.Duration, now time.Time) (string, error) {
+	if expires < time.Second || expires > maxPresignExpiry {
+		return "", errors.New("expiry must be between one second and a week")
+	}
+	r, err := http.NewRequest(method, rawurl, nil)
+	if err != nil {
+		return "", err
+	}
+	sig := &signature{
+		accessKey:     accessKey,
+		date:          now.UTC().Format("20060102"),
+		region:        region,
+		service:       "s3",
+		signedHeaders: []string{"host"},
+		amzDate:       now.UTC(),
+		payloadHash:   unsignedPayload,
+	}
+	query := r.URL.Query()
+	query.Set("X-Amz-Algorithm", signV4Algorithm)
+	query.Set("X-Amz-Credential", sig.accessKey+"/"+sig.scope())
+	query.Set("X-Amz-Date", sig.amzDate.Format(amzDateFormat))
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+	r.URL.RawQuery = canonicalQuery(query)
+	r.URL.RawQuery += "&X-Amz-Signature=" + sig.sign(secretKey, canonicalRequest(r, sig))
+	return r.URL.String(), nil
+}
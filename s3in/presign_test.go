@@ -0,0 +1,111 @@
+package s3in
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xiaokangwang/s3emu/backend/memory"
+)
+
+func TestPresignExample(t *testing.T) {
+	// the presigned URL example of the SigV4 documentation
+	const want = "aeeed9bbccd4d02ee5c0109b86d86835f995330da4c265957d157751f604d404"
+	signed, err := Presign("GET", "https://examplebucket.s3.amazonaws.com/test.txt", exampleAccessKey, exampleSecret, "us-east-1", 24*time.Hour, exampleTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(signed, "X-Amz-Signature="+want) {
+		t.Fatalf("Presign = %s, want the signature %s", signed, want)
+	}
+
+	g := New()
+	g.now = func() time.Time { return exampleTime.Add(time.Hour) }
+	g.SetCredential(exampleAccessKey, exampleSecret)
+	g.SetBaseDomains("s3.amazonaws.com")
+	source := memory.NewMemoryBackend(0, 0)
+	source.Put(context.Background(), "test.txt", []byte("hello"))
+	g.SetSource("examplebucket", source)
+	if w := serve(g.Server(), httptest.NewRequest("GET", signed, nil)); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("GET: %v %s", w.Code, w.Body)
+	}
+}
+
+func TestPresigned(t *testing.T) {
+	g, h := newTestServer(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	g.now = func() time.Time { return now }
+	g.SetCredential("AK", "SK")
+	presign := func(method string, signedAt time.Time) string {
+		signed, err := Presign(method, "http://example.com/bucket/a", "AK", "SK", "us-east-1", time.Hour, signedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	// edit changes a parameter of a presigned URL, or drops it if value is
+	// empty.
+	edit := func(signed, name, value string) string {
+		u, err := url.Parse(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := u.Query()
+		if value == "" {
+			query.Del(name)
+		} else {
+			query.Set(name, value)
+		}
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+
+	// a presigned PUT takes any body
+	w := serve(h, httptest.NewRequest("PUT", presign("PUT", now), strings.NewReader("hello")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("presigned PUT: %v %s", w.Code, w.Body)
+	}
+	w = serve(h, httptest.NewRequest("GET", presign("GET", now.Add(-30*time.Minute)), nil))
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("presigned GET: %v %q", w.Code, w.Body)
+	}
+
+	get := presign("GET", now)
+	for _, c := range []struct {
+		name   string
+		method string
+		url    string
+		status int
+		code   string
+	}{
+		{"another method", "DELETE", get, http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"wrong signature", "GET", edit(get, "X-Amz-Signature", strings.Repeat("0", 64)), http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"altered expiry", "GET", edit(get, "X-Amz-Expires", "7200"), http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"unknown key", "GET", edit(get, "X-Amz-Credential", "OTHER/"+now.Format("20060102")+"/us-east-1/s3/aws4_request"), http.StatusForbidden, "InvalidAccessKeyId"},
+		{"expired", "GET", presign("GET", now.Add(-time.Hour-time.Second)), http.StatusForbidden, "AccessDenied"},
+		{"not yet valid", "GET", presign("GET", now.Add(time.Hour)), http.StatusForbidden, "AccessDenied"},
+		{"non-numeric expiry", "GET", edit(get, "X-Amz-Expires", "soon"), http.StatusBadRequest, "AuthorizationQueryParametersError"},
+		{"negative expiry", "GET", edit(get, "X-Amz-Expires", "-1"), http.StatusBadRequest, "AuthorizationQueryParametersError"},
+		{"expiry over a week", "GET", edit(get, "X-Amz-Expires", "604801"), http.StatusBadRequest, "AuthorizationQueryParametersError"},
+		{"no signature", "GET", edit(get, "X-Amz-Signature", ""), http.StatusBadRequest, "AuthorizationQueryParametersError"},
+		{"unsigned host", "GET", edit(get, "X-Amz-SignedHeaders", "x-amz-date"), http.StatusForbidden, "AccessDenied"},
+	} {
+		w := serve(h, httptest.NewRequest(c.method, c.url, nil))
+		if w.Code != c.status || errorCode(w) != c.code {
+			t.Errorf("%s: %v %s, want %v %v", c.name, w.Code, w.Body, c.status, c.code)
+		}
+	}
+	if w := serve(h, httptest.NewRequest("GET", get, nil)); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("GET after the failed requests: %v %q", w.Code, w.Body)
+	}
+
+	for _, expires := range []time.Duration{0, 8 * 24 * time.Hour} {
+		if _, err := Presign("GET", "http://example.com/bucket/a", "AK", "SK", "us-east-1", expires, now); err == nil {
+			t.Errorf("Presign with an expiry of %v succeeded", expires)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package s3in
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+var errUnsatisfiable = errors.New("requested range not satisfiable")
+
+// byteRange is a single satisfiable range of an object.
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+// parseRange interprets a Range header against an object of the given size.
+// ok is false when the header is to be ignored and the whole object served,
+// which is what S3 does for malformed and multi-range requests.
+func parseRange(header string, size int64) (br byteRange, ok bool, err error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return br, false, nil
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return br, false, nil
+	}
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return br, false, nil
+	}
+	first, last := spec[:dash], spec[dash+1:]
+	if first == "" {
+		// suffix range: the final n bytes
+		n, perr := strconv.ParseInt(last, 10, 64)
+		if perr != nil || n < 0 {
+			return br, false, nil
+		}
+		if n == 0 || size == 0 {
+			return br, true, errUnsatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return byteRange{start: size - n, length: n}, true, nil
+	}
+	start, perr := strconv.ParseInt(first, 10, 64)
+	if perr != nil || start < 0 {
+		return br, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		end, perr = strconv.ParseInt(last, 10, 64)
+		if perr != nil || end < start {
+			return br, false, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return br, true, errUnsatisfiable
+	}
+	return byteRange{start: start, length: end - start + 1}, true, nil
+}
+
+// getObjectRange answers a GET carrying a Range header with 206 Partial
+// Content, for the object meta describes, whose preconditions have been
+// checked. It reports false, writing nothing, when the header is ignorable.
+func (g *GoFakeS3) getObjectRange(w http.ResponseWriter, r *http.Request, access lgpd.LGPD, key string, meta lgpd.File) bool {
+	size := int64(meta.Length)
+	br, ok, err := parseRange(r.Header.Get("Range"), size)
+	if !ok {
+		return false
+	}
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		writeError(w, r, err)
+		return true
+	}
+
+	body, _, err := access.GetRange(r.Context(), key, br.start, br.length)
+	if err != nil {
+		log.Println("can't get")
+		writeError(w, r, err)
+		return true
+	}
+	defer body.Close()
+
+	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
+
+	g.setObjectHeaders(w, meta)
+	overrideResponseHeaders(w, r)
+	w.Header().Set("Server", "AmazonS3")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Range", br.contentRange(size))
+	w.Header().Set("Content-Length", fmt.Sprintf("%v", br.length))
+	w.WriteHeader(http.StatusPartialContent)
+	streamBody(w, body)
+	return true
+}
@@ -0,0 +1,320 @@
+package s3in
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/versioning"
+)
+
+var (
+	errNoSuchVersion      = &s3Error{http.StatusNotFound, "NoSuchVersion", "The specified version does not exist."}
+	errInvalidVersionID   = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid version id specified"}
+	errDeleteMarker       = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	errReservedKey        = &s3Error{http.StatusBadRequest, "InvalidArgument", "Keys under .s3emu/ are reserved for the server's own use."}
+	errVersioningFixed    = &s3Error{http.StatusNotImplemented, "NotImplemented", "Versioning cannot be enabled on this bucket."}
+	errIllegalVersioning  = &s3Error{http.StatusBadRequest, "IllegalVersioningConfigurationException", "The Versioning element must be specified"}
+	errUnsupportedMFADel  = &s3Error{http.StatusNotImplemented, "NotImplemented", "MFA Delete is not supported."}
+	errVersionMarkerAlone = &s3Error{http.StatusBadRequest, "InvalidArgument", "A version-id marker cannot be specified without a key marker."}
+)
+
+type VersioningConfiguration struct {
+	XMLName   xml.Name `xml:"VersioningConfiguration"`
+	Xmlns     string   `xml:"xmlns,attr,omitempty"`
+	Status    string   `xml:"Status,omitempty"`
+	MfaDelete string   `xml:"MfaDelete,omitempty"`
+}
+
+type ListVersionsResult struct {
+	XMLName             xml.Name `xml:"ListVersionsResult"`
+	Xmlns               string   `xml:"xmlns,attr"`
+	Name                string   `xml:"Name"`
+	Prefix              string   `xml:"Prefix"`
+	KeyMarker           string   `xml:"KeyMarker"`
+	VersionIdMarker     string   `xml:"VersionIdMarker"`
+	NextKeyMarker       string   `xml:"NextKeyMarker,omitempty"`
+	NextVersionIdMarker string   `xml:"NextVersionIdMarker,omitempty"`
+	MaxKeys             int      `xml:"MaxKeys"`
+	Delimiter           string   `xml:"Delimiter,omitempty"`
+	EncodingType        string   `xml:"EncodingType,omitempty"`
+	IsTruncated         bool     `xml:"IsTruncated"`
+	// Entries holds *ObjectVersion and *DeleteMarkerEntry values, in the
+	// order S3 interleaves them.
+	Entries        []interface{}
+	CommonPrefixes []*CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type ObjectVersion struct {
+	XMLName      xml.Name `xml:"Version"`
+	Key          string   `xml:"Key"`
+	VersionId    string   `xml:"VersionId"`
+	IsLatest     bool     `xml:"IsLatest"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+	Size         int      `xml:"Size"`
+	StorageClass string   `xml:"StorageClass"`
+}
+
+type DeleteMarkerEntry struct {
+	XMLName      xml.Name `xml:"DeleteMarker"`
+	Key          string   `xml:"Key"`
+	VersionId    string   `xml:"VersionId"`
+	IsLatest     bool     `xml:"IsLatest"`
+	LastModified string   `xml:"LastModified"`
+}
+
+// atVersion returns access as it was at versionID. A bucket that keeps no
+// versions has the null version only, which is what access holds.
+func atVersion(access lgpd.LGPD, versionID string) (lgpd.LGPD, error) {
+	if versionID == "" {
+		return access, nil
+	}
+	if store, ok := access.(*versioning.Store); ok {
+		return store.At(versionID), nil
+	}
+	if versionID != versioning.NullVersion {
+		return nil, errNoSuchVersion
+	}
+	return access, nil
+}
+
+// objectError reports err from reading file, telling the client when what
+// it read is a delete marker.
+func objectError(w http.ResponseWriter, r *http.Request, file lgpd.File, err error) {
+	if errors.Is(err, versioning.ErrDeleteMarker) {
+		w.Header().Set("x-amz-delete-marker", "true")
+		w.Header().Set("x-amz-version-id", file.VersionID)
+	}
+	writeError(w, r, err)
+}
+
+// removeObject deletes key from access, or its version versionID.
+func removeObject(ctx context.Context, access lgpd.LGPD, key, versionID string) (versioning.Version, error) {
+	if store, ok := access.(*versioning.Store); ok {
+		return store.Remove(ctx, key, versionID)
+	}
+	if versionID != "" && versionID != versioning.NullVersion {
+		return versioning.Version{}, lgpd.ErrNotFound
+	}
+	return versioning.Version{}, access.Delete(ctx, key)
+}
+
+// putObject stores value under key in access, returning the version ID it
+// was stored as when access keeps versions.
+func putObject(ctx context.Context, access lgpd.LGPD, key string, value io.Reader, size int64, meta lgpd.Metadata) (string, error) {
+	if store, ok := access.(*versioning.Store); ok {
+		return store.PutVersion(ctx, key, value, size, meta)
+	}
+	return "", access.PutS(ctx, key, value, size, meta)
+}
+
+// GetBucketVersioning reports whether versioning is on for a bucket.
+func (g *GoFakeS3) GetBucketVersioning(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["BucketName"]
+	log.Println("GET BUCKET VERSIONING:", bucketName)
+
+	access, ok := g.source(bucketName)
+	if !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	config := &VersioningConfiguration{Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/"}
+	if store, ok := access.(*versioning.Store); ok {
+		status, err := store.Status(r.Context())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		config.Status = status
+	}
+	g.writeXML(w, r, config)
+}
+
+// PutBucketVersioning enables or suspends versioning on a bucket.
+func (g *GoFakeS3) PutBucketVersioning(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["BucketName"]
+	log.Println("PUT BUCKET VERSIONING:", bucketName)
+
+	access, ok := g.source(bucketName)
+	if !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	store, ok := access.(*versioning.Store)
+	if !ok {
+		writeError(w, r, errVersioningFixed)
+		return
+	}
+	if serr := verifyContentMD5(r); serr != nil {
+		writeError(w, r, serr)
+		return
+	}
+	var config VersioningConfiguration
+	if err := xml.NewDecoder(r.Body).Decode(&config); err != nil {
+		var serr *s3Error
+		if errors.As(err, &serr) {
+			writeError(w, r, serr)
+			return
+		}
+		writeError(w, r, errMalformedXML)
+		return
+	}
+	if config.MfaDelete == "Enabled" {
+		writeError(w, r, errUnsupportedMFADel)
+		return
+	}
+	if err := store.SetStatus(r.Context(), config.Status); err != nil {
+		if errors.Is(err, versioning.ErrInvalidStatus) {
+			err = errIllegalVersioning
+		}
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("x-amz-id-2", "LriYPLdmOdAiIfgSm/F1YsViT1LW94/xUQxMsF7xiEb1a0wiIOIxl+zbwZ163pt7")
+	w.Header().Set("Server", "AmazonS3")
+}
+
+// ListObjectVersions lists every version and delete marker in a bucket. A
+// bucket that keeps no versions lists its objects as null versions.
+func (g *GoFakeS3) ListObjectVersions(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["BucketName"]
+	log.Println("LIST OBJECT VERSIONS:", bucketName)
+
+	access, ok := g.source(bucketName)
+	if !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	keyMarker := query.Get("key-marker")
+	versionMarker := query.Get("version-id-marker")
+	encodingType := query.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		writeError(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid Encoding Method specified in Request"})
+		return
+	}
+	if versionMarker != "" && keyMarker == "" {
+		writeError(w, r, errVersionMarkerAlone)
+		return
+	}
+	maxKeys := defaultMaxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "Provided max-keys not an integer or within integer range"})
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	var versions []versioning.Version
+	if store, ok := access.(*versioning.Store); ok {
+		var err error
+		if versions, err = store.Versions(r.Context(), prefix); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	} else {
+		files, err := access.List(r.Context(), prefix)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		for _, file := range files {
+			file.VersionID = versioning.NullVersion
+			versions = append(versions, versioning.Version{File: file, IsLatest: true})
+		}
+	}
+
+	result := &ListVersionsResult{
+		Xmlns:           "http://s3.amazonaws.com/doc/2006-03-01/",
+		Name:            bucketName,
+		Prefix:          prefix,
+		KeyMarker:       keyMarker,
+		VersionIdMarker: versionMarker,
+		MaxKeys:         maxKeys,
+		Delimiter:       delimiter,
+		EncodingType:    encodingType,
+	}
+	encode := func(s string) string {
+		if encodingType != "" {
+			return uriEncode(s, false)
+		}
+		return s
+	}
+	// with a version-id marker, the page resumes after that version of the
+	// key marker; without one, after all of its versions
+	skipping := true
+	seen := make(map[string]bool)
+	count := 0
+	for _, v := range versions {
+		if !strings.HasPrefix(v.Name, prefix) || v.Name < keyMarker {
+			continue
+		}
+		if v.Name == keyMarker && skipping {
+			skipping = versionMarker == "" || v.VersionID != versionMarker
+			continue
+		}
+		common := ""
+		if delimiter != "" {
+			if i := strings.Index(v.Name[len(prefix):], delimiter); i >= 0 {
+				common = v.Name[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if common != "" && (seen[common] || common <= keyMarker) {
+			continue
+		}
+		if count >= maxKeys {
+			result.IsTruncated = maxKeys > 0
+			break
+		}
+		count++
+		if common != "" {
+			seen[common] = true
+			result.CommonPrefixes = append(result.CommonPrefixes, &CommonPrefix{Prefix: encode(common)})
+			result.NextKeyMarker, result.NextVersionIdMarker = common, ""
+			continue
+		}
+		lastModified := g.modTime(v.File).UTC().Format(listTimeFormat)
+		if v.DeleteMarker {
+			result.Entries = append(result.Entries, &DeleteMarkerEntry{
+				Key:          encode(v.Name),
+				VersionId:    v.VersionID,
+				IsLatest:     v.IsLatest,
+				LastModified: lastModified,
+			})
+		} else {
+			result.Entries = append(result.Entries, &ObjectVersion{
+				Key:          encode(v.Name),
+				VersionId:    v.VersionID,
+				IsLatest:     v.IsLatest,
+				LastModified: lastModified,
+				ETag:         "\"" + entityTag(v.File) + "\"",
+				Size:         v.Length,
+				StorageClass: "STANDARD",
+			})
+		}
+		result.NextKeyMarker, result.NextVersionIdMarker = v.Name, v.VersionID
+	}
+	if !result.IsTruncated {
+		result.NextKeyMarker, result.NextVersionIdMarker = "", ""
+	}
+	result.Prefix = encode(result.Prefix)
+	result.KeyMarker = encode(result.KeyMarker)
+	result.NextKeyMarker = encode(result.NextKeyMarker)
+	result.Delimiter = encode(result.Delimiter)
+	g.writeXML(w, r, result)
+}
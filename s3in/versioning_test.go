@@ -0,0 +1,174 @@
+package s3in
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/xiaokangwang/s3emu/backend/memory"
+	"github.com/xiaokangwang/s3emu/versioning"
+)
+
+// listedVersions is a ListVersionsResult as a client reads it, with the
+// versions and delete markers in the order they were listed. Entries takes
+// in every element not named below, which listVersions then drops.
+type listedVersions struct {
+	Entries []struct {
+		XMLName   xml.Name
+		Key       string `xml:"Key"`
+		VersionId string `xml:"VersionId"`
+		IsLatest  bool   `xml:"IsLatest"`
+	} `xml:",any"`
+	IsTruncated         bool   `xml:"IsTruncated"`
+	NextKeyMarker       string `xml:"NextKeyMarker"`
+	NextVersionIdMarker string `xml:"NextVersionIdMarker"`
+}
+
+// newVersionedServer is newTestServer with versioning enabled on
+// "versioned".
+func newVersionedServer(t *testing.T) http.Handler {
+	g, h := newTestServer(t)
+	g.SetSource("versioned", versioning.New(memory.NewMemoryBackend(0, 0)))
+	body := `<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`
+	if w := do(t, h, "PUT", "/versioned?versioning", strings.NewReader(body), nil); w.Code != http.StatusOK {
+		t.Fatalf("PUT ?versioning: %v %s", w.Code, w.Body)
+	}
+	return h
+}
+
+// putVersioned writes value to key in "versioned", returning its version
+// ID.
+func putVersioned(t *testing.T, h http.Handler, key, value string) string {
+	t.Helper()
+	w := do(t, h, "PUT", "/versioned/"+key, strings.NewReader(value), nil)
+	if w.Code != http.StatusOK || w.Header().Get("x-amz-version-id") == "" {
+		t.Fatalf("PUT %s: %v %v %s", key, w.Code, w.Header(), w.Body)
+	}
+	return w.Header().Get("x-amz-version-id")
+}
+
+func listVersions(t *testing.T, h http.Handler, target string) listedVersions {
+	t.Helper()
+	w := do(t, h, "GET", target, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: %v %s", target, w.Code, w.Body)
+	}
+	var result listedVersions
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	entries := result.Entries[:0]
+	for _, e := range result.Entries {
+		if e.XMLName.Local == "Version" || e.XMLName.Local == "DeleteMarker" {
+			entries = append(entries, e)
+		}
+	}
+	result.Entries = entries
+	return result
+}
+
+func TestListObjectVersions(t *testing.T) {
+	h := newVersionedServer(t)
+	a1 := putVersioned(t, h, "a", "1")
+	a2 := putVersioned(t, h, "a", "2")
+	b1 := putVersioned(t, h, "b", "1")
+	w := do(t, h, "DELETE", "/versioned/b", nil, nil)
+	if w.Code != http.StatusNoContent || w.Header().Get("x-amz-delete-marker") != "true" {
+		t.Fatalf("DELETE: %v %v", w.Code, w.Header())
+	}
+	marker := w.Header().Get("x-amz-version-id")
+
+	result := listVersions(t, h, "/versioned?versions")
+	want := []struct {
+		element, key, id string
+		latest           bool
+	}{
+		{"Version", "a", a2, true},
+		{"Version", "a", a1, false},
+		{"DeleteMarker", "b", marker, true},
+		{"Version", "b", b1, false},
+	}
+	if len(result.Entries) != len(want) || result.IsTruncated {
+		t.Fatalf("?versions = %+v, want %d entries", result, len(want))
+	}
+	for i, w := range want {
+		e := result.Entries[i]
+		if e.XMLName.Local != w.element || e.Key != w.key || e.VersionId != w.id || e.IsLatest != w.latest {
+			t.Errorf("entry %d is %s %s@%s latest=%v, want %s %s@%s latest=%v", i,
+				e.XMLName.Local, e.Key, e.VersionId, e.IsLatest, w.element, w.key, w.id, w.latest)
+		}
+	}
+
+	// a page ends at a version, and the next resumes right after it
+	result = listVersions(t, h, "/versioned?versions&max-keys=1")
+	if !result.IsTruncated || result.NextKeyMarker != "a" || result.NextVersionIdMarker != a2 {
+		t.Fatalf("first page = %+v", result)
+	}
+	result = listVersions(t, h, "/versioned?versions&max-keys=2&key-marker=a&version-id-marker="+a2)
+	if len(result.Entries) != 2 || result.Entries[0].VersionId != a1 || result.Entries[1].VersionId != marker {
+		t.Fatalf("second page = %+v", result)
+	}
+
+	w = do(t, h, "GET", "/versioned?versions&version-id-marker="+a2, nil, nil)
+	if w.Code != http.StatusBadRequest || errorCode(w) != "InvalidArgument" {
+		t.Errorf("?versions with a version-id marker alone: %v %s", w.Code, w.Body)
+	}
+
+	// a bucket without versioning lists its objects as null versions
+	do(t, h, "PUT", "/bucket/c", strings.NewReader("c"), nil)
+	result = listVersions(t, h, "/bucket?versions")
+	if len(result.Entries) != 1 || result.Entries[0].VersionId != versioning.NullVersion || !result.Entries[0].IsLatest {
+		t.Errorf("?versions of an unversioned bucket = %+v", result)
+	}
+}
+
+func TestVersionID(t *testing.T) {
+	h := newVersionedServer(t)
+	first := putVersioned(t, h, "a", "first")
+	second := putVersioned(t, h, "a", "second")
+
+	w := do(t, h, "GET", "/versioned/a?versionId="+first, nil, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "first" || w.Header().Get("x-amz-version-id") != first {
+		t.Fatalf("GET versionId=%s: %v %v %q", first, w.Code, w.Header(), w.Body)
+	}
+	w = do(t, h, "HEAD", "/versioned/a?versionId="+second, nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "6" || w.Header().Get("x-amz-version-id") != second {
+		t.Fatalf("HEAD versionId=%s: %v %v", second, w.Code, w.Header())
+	}
+	w = do(t, h, "GET", "/versioned/a?versionId=bogus", nil, nil)
+	if w.Code != http.StatusBadRequest || errorCode(w) != "InvalidArgument" {
+		t.Errorf("GET with an invalid versionId: %v %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "GET", "/bucket/a?versionId="+first, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET a versionId from an unversioned bucket: %v %s", w.Code, w.Body)
+	}
+
+	// a delete marker has no content, and says so
+	w = do(t, h, "DELETE", "/versioned/a", nil, nil)
+	marker := w.Header().Get("x-amz-version-id")
+	w = do(t, h, "GET", "/versioned/a", nil, nil)
+	if w.Code != http.StatusNotFound || errorCode(w) != "NoSuchKey" {
+		t.Errorf("GET behind a delete marker: %v %s", w.Code, w.Body)
+	}
+	w = do(t, h, "GET", "/versioned/a?versionId="+marker, nil, nil)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("x-amz-delete-marker") != "true" ||
+		w.Header().Get("x-amz-version-id") != marker {
+		t.Errorf("GET of a delete marker: %v %v %s", w.Code, w.Header(), w.Body)
+	}
+
+	// deleting the delete marker and the newest version leaves the first
+	for _, id := range []string{marker, second} {
+		w = do(t, h, "DELETE", "/versioned/a?versionId="+id, nil, nil)
+		if w.Code != http.StatusNoContent || w.Header().Get("x-amz-version-id") != id {
+			t.Fatalf("DELETE versionId=%s: %v %v %s", id, w.Code, w.Header(), w.Body)
+		}
+	}
+	w = do(t, h, "GET", "/versioned/a", nil, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "first" {
+		t.Errorf("GET after deleting the newer versions: %v %q", w.Code, w.Body)
+	}
+	if w := do(t, h, "GET", "/versioned/a?versionId="+second, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a deleted version: %v %s", w.Code, w.Body)
+	}
+}
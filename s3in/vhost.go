@@ -0,0 +1,67 @@
+package s3in
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// defaultBaseDomains are served when SetBaseDomains was never called, so
+// that bucket.localhost keeps working out of the box.
+var defaultBaseDomains = []string{"localhost"}
+
+// SetBaseDomains sets the domains under which virtual-hosted-style requests
+// arrive: with "s3.example.com", a request for bucket.s3.example.com goes
+// to bucket. Requests to a base domain itself, to an IP address or to any
+// other host are taken to be path-style.
+func (g *GoFakeS3) SetBaseDomains(domains ...string) {
+	g.baseDomains = nil
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if domain != "" {
+			g.baseDomains = append(g.baseDomains, domain)
+		}
+	}
+}
+
+// SetTrustForwardedHost makes the host a reverse proxy reports in
+// X-Forwarded-Host stand for the Host of the request, both for finding
+// the bucket and for checking signatures. Only enable it when every
+// request passes through such a proxy, as clients could set it otherwise.
+func (g *GoFakeS3) SetTrustForwardedHost(trust bool) {
+	g.trustProxy = trust
+}
+
+// requestHost returns the host r was sent to, as the client saw it.
+func (g *GoFakeS3) requestHost(r *http.Request) string {
+	if g.trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+			// each proxy appends its own; the first is the client's
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	return r.Host
+}
+
+// virtualBucket returns the bucket named by the host of a
+// virtual-hosted-style request, or "" for a path-style one.
+func (g *GoFakeS3) virtualBucket(host string) string {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(strings.Trim(hostname, "[]"), "."))
+	if net.ParseIP(hostname) != nil {
+		return ""
+	}
+	domains := g.baseDomains
+	if domains == nil {
+		domains = defaultBaseDomains
+	}
+	for _, domain := range domains {
+		if strings.HasSuffix(hostname, "."+domain) {
+			return strings.TrimSuffix(hostname, "."+domain)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package s3in
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVirtualHost(t *testing.T) {
+	g, h := newTestServer(t)
+	g.SetBaseDomains("s3.example.com", ".s3.internal.")
+	do(t, h, "PUT", "/bucket/a", strings.NewReader("hello"), nil)
+
+	for _, target := range []string{
+		"http://bucket.s3.example.com/a",
+		"http://bucket.s3.example.com:9000/a",
+		"http://BUCKET.S3.Example.COM./a",
+		"http://bucket.s3.internal/a",
+		// anything else is path-style
+		"http://s3.example.com/bucket/a",
+		"http://10.0.0.2:9000/bucket/a",
+		"http://[::1]:9000/bucket/a",
+		"http://[fe80::1]/bucket/a",
+		"http://other.example.org/bucket/a",
+		"http://bucket.localhost/bucket/a",
+	} {
+		w := do(t, h, "GET", target, nil, nil)
+		if w.Code != http.StatusOK || w.Body.String() != "hello" {
+			t.Errorf("GET %s: %v %s", target, w.Code, w.Body)
+		}
+	}
+	w := do(t, h, "GET", "http://bucket.s3.example.com/", nil, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<Key>a</Key>") {
+		t.Errorf("GET of a virtual-hosted bucket: %v %s", w.Code, w.Body)
+	}
+	w = do(t, h, "GET", "http://nobucket.s3.example.com/a", nil, nil)
+	if w.Code != http.StatusNotFound || errorCode(w) != "NoSuchBucket" {
+		t.Errorf("GET from a missing virtual-hosted bucket: %v %s", w.Code, w.Body)
+	}
+
+	// without SetBaseDomains, buckets are found under localhost
+	_, h = newTestServer(t)
+	do(t, h, "PUT", "/bucket/a", strings.NewReader("hello"), nil)
+	if w := do(t, h, "GET", "http://bucket.localhost:9000/a", nil, nil); w.Code != http.StatusOK {
+		t.Errorf("GET from bucket.localhost: %v %s", w.Code, w.Body)
+	}
+}
+
+func TestForwardedHost(t *testing.T) {
+	g, h := newTestServer(t)
+	g.SetBaseDomains("s3.example.com")
+	do(t, h, "PUT", "/bucket/a", strings.NewReader("hello"), nil)
+	forwarded := http.Header{"X-Forwarded-Host": {"bucket.s3.example.com, proxy.internal"}}
+
+	// untrusted, the header is ignored and /a names the bucket a
+	w := do(t, h, "GET", "http://internal:8080/a", nil, forwarded)
+	if w.Code != http.StatusNotFound || errorCode(w) != "NoSuchBucket" {
+		t.Errorf("GET with an untrusted X-Forwarded-Host: %v %s", w.Code, w.Body)
+	}
+
+	g.SetTrustForwardedHost(true)
+	w = do(t, h, "GET", "http://internal:8080/a", nil, forwarded)
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("GET with a trusted X-Forwarded-Host: %v %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "GET", "http://internal:8080/bucket/a", nil, nil); w.Code != http.StatusOK {
+		t.Errorf("GET without X-Forwarded-Host: %v %s", w.Code, w.Body)
+	}
+
+	// the signature covers the host the client sent the request to
+	now := time.Now().UTC()
+	g.now = func() time.Time { return now }
+	g.SetCredential("AK", "SK")
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	for _, signed := range []string{"bucket.s3.example.com", "internal:8080"} {
+		r := httptest.NewRequest("GET", "http://internal:8080/a", nil)
+		r.Header.Set("X-Forwarded-Host", "bucket.s3.example.com")
+		r.Host = signed
+		signHeader(r, "AK", "SK", now, emptySHA256, headers...)
+		r.Host = "internal:8080"
+		w := serve(h, r)
+		if signed == "internal:8080" {
+			if w.Code != http.StatusForbidden || errorCode(w) != "SignatureDoesNotMatch" {
+				t.Errorf("GET signed for the proxy's host: %v %s", w.Code, w.Body)
+			}
+		} else if w.Code != http.StatusOK {
+			t.Errorf("GET signed for the forwarded host: %v %s", w.Code, w.Body)
+		}
+	}
+}
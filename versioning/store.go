@@ -0,0 +1,750 @@
+// Package versioning keeps the earlier versions of objects, as S3 does for
+// a bucket with versioning enabled. A Store wraps the lgpd.LGPD a bucket is
+// served from and keeps everything in it: the current version of a key is
+// stored under the key as before, and the versions it replaced, along with
+// delete markers, under a reserved prefix that List leaves out.
+package versioning
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+// The states a bucket's versioning can be in. A bucket starts out
+// Unversioned; once enabled, versioning can only be suspended again.
+const (
+	Unversioned = ""
+	Enabled     = "Enabled"
+	Suspended   = "Suspended"
+)
+
+// NullVersion is the ID of a version written while versioning was not
+// enabled. A key has one such version at most.
+const NullVersion = "null"
+
+const (
+	// reservedPrefix holds the store's own objects; clients may not use
+	// keys under it.
+	reservedPrefix = ".s3emu/"
+	statusKey      = reservedPrefix + "versioning"
+	// versionsPrefix holds each noncurrent version and delete marker as
+	// versionsPrefix + key + "/" + ID, so the versions of a key can be
+	// listed on their own. The IDs sort in the order the versions stopped
+	// being current.
+	versionsPrefix = reservedPrefix + "versions/"
+	// versionMeta and markerMeta are the user metadata through which a
+	// stored object records its version ID and whether it is a delete
+	// marker.
+	versionMeta = "s3emu-version-id"
+	markerMeta  = "s3emu-delete-marker"
+)
+
+var (
+	// ErrReservedKey is returned for a write to a key the store keeps for
+	// itself.
+	ErrReservedKey = errors.New("versioning: key is reserved")
+	// ErrInvalidVersion means a version ID is not one the store hands out.
+	ErrInvalidVersion = errors.New("versioning: invalid version ID")
+	// ErrDeleteMarker is returned for a read of a version that is a delete
+	// marker, which has no content.
+	ErrDeleteMarker = errors.New("versioning: version is a delete marker")
+	// ErrInvalidStatus is returned by SetStatus for anything but Enabled
+	// or Suspended.
+	ErrInvalidStatus = errors.New("versioning: status must be Enabled or Suspended")
+)
+
+// Version is one version of an object, or a delete marker. Its Name is the
+// key it is a version of.
+type Version struct {
+	lgpd.File
+	// IsLatest is set on the version that is the current one of its key,
+	// or the delete marker standing in for it.
+	IsLatest     bool
+	DeleteMarker bool
+}
+
+// Store is an lgpd.LGPD that keeps earlier versions once versioning is
+// enabled. Writes to one key are serialised while versioning is on, so that
+// each finds the version it replaces where it left it.
+type Store struct {
+	backend lgpd.LGPD
+	// mode is held for reading by every write, and for writing while the
+	// status changes.
+	mode       sync.RWMutex
+	statusLock sync.Mutex
+	loaded     bool
+	status     string
+	keysLock   sync.Mutex
+	keys       map[string]*keyLock
+	clock      sync.Mutex
+	last       int64
+}
+
+type keyLock struct {
+	sync.Mutex
+	users int
+}
+
+// New wraps backend. Its versioning status is read from backend the first
+// time it is needed.
+func New(backend lgpd.LGPD) *Store {
+	return &Store{backend: backend, keys: make(map[string]*keyLock)}
+}
+
+// Status reports whether versioning is Enabled or Suspended, or
+// Unversioned if it never was enabled.
+func (s *Store) Status(ctx context.Context) (string, error) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	if !s.loaded {
+		value, _, err := s.backend.Get(ctx, statusKey, false)
+		if err != nil && !errors.Is(err, lgpd.ErrNotFound) {
+			return "", err
+		}
+		s.status = string(value)
+		s.loaded = true
+	}
+	return s.status, nil
+}
+
+// SetStatus enables or suspends versioning. Suspending keeps the versions
+// there are, but writes replace the null version from then on.
+func (s *Store) SetStatus(ctx context.Context, status string) error {
+	if status != Enabled && status != Suspended {
+		return ErrInvalidStatus
+	}
+	s.mode.Lock()
+	defer s.mode.Unlock()
+	if _, err := s.Status(ctx); err != nil {
+		return err
+	}
+	if err := s.backend.Put(ctx, statusKey, []byte(status)); err != nil {
+		return err
+	}
+	s.statusLock.Lock()
+	s.status = status
+	s.statusLock.Unlock()
+	return nil
+}
+
+func reserved(key string) bool {
+	return strings.HasPrefix(key, reservedPrefix)
+}
+
+// validID reports whether id could be one the store handed out.
+func validID(id string) bool {
+	if id == NullVersion {
+		return true
+	}
+	if len(id) != 16 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// newID returns a version ID later than any handed out before.
+func (s *Store) newID() string {
+	s.clock.Lock()
+	defer s.clock.Unlock()
+	now := time.Now().UnixNano()
+	if now <= s.last {
+		now = s.last + 1
+	}
+	s.last = now
+	return fmt.Sprintf("%016x", now)
+}
+
+// lock takes the write lock of each of keys, returning the function that
+// releases them.
+func (s *Store) lock(keys ...string) func() {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+	var held []string
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		s.keysLock.Lock()
+		l := s.keys[key]
+		if l == nil {
+			l = &keyLock{}
+			s.keys[key] = l
+		}
+		l.users++
+		s.keysLock.Unlock()
+		l.Lock()
+		held = append(held, key)
+	}
+	return func() {
+		s.keysLock.Lock()
+		defer s.keysLock.Unlock()
+		for _, key := range held {
+			l := s.keys[key]
+			l.Unlock()
+			if l.users--; l.users == 0 {
+				delete(s.keys, key)
+			}
+		}
+	}
+}
+
+// clean returns meta without the user metadata the store keeps for itself,
+// so that clients can neither see nor forge it.
+func clean(meta lgpd.Metadata) lgpd.Metadata {
+	_, version := meta.UserMeta[versionMeta]
+	_, marker := meta.UserMeta[markerMeta]
+	if !version && !marker {
+		return meta
+	}
+	userMeta := make(map[string]string, len(meta.UserMeta))
+	for name, value := range meta.UserMeta {
+		if name != versionMeta && name != markerMeta {
+			userMeta[name] = value
+		}
+	}
+	meta.UserMeta = userMeta
+	return meta
+}
+
+// stamp returns meta recording the version ID id.
+func stamp(meta lgpd.Metadata, id string) lgpd.Metadata {
+	meta = clean(meta)
+	if id == Unversioned || id == NullVersion {
+		return meta
+	}
+	userMeta := map[string]string{versionMeta: id}
+	for name, value := range meta.UserMeta {
+		userMeta[name] = value
+	}
+	meta.UserMeta = userMeta
+	return meta
+}
+
+// versionOf returns the version ID recorded in a stored object.
+func versionOf(file lgpd.File) string {
+	if id := file.UserMeta[versionMeta]; id != "" {
+		return id
+	}
+	return NullVersion
+}
+
+// describe turns a stored object into what clients are told about it.
+// Buckets that never had versioning enabled show no version IDs.
+func describe(file lgpd.File, key, status string) Version {
+	v := Version{File: file, DeleteMarker: file.UserMeta[markerMeta] == "true"}
+	v.Name = key
+	if status != Unversioned || file.UserMeta[versionMeta] != "" {
+		v.VersionID = versionOf(file)
+	}
+	v.Metadata = clean(file.Metadata)
+	return v
+}
+
+// noncurrent is a version kept under versionsPrefix.
+type noncurrent struct {
+	Version
+	// stored is the name it is stored under.
+	stored string
+}
+
+// history returns the noncurrent versions of the keys starting with
+// prefix, or of key only when exact is set: by key, newest first.
+func (s *Store) history(ctx context.Context, status, prefix string, exact bool) ([]noncurrent, error) {
+	list := versionsPrefix + prefix
+	if exact {
+		list += "/"
+	}
+	files, err := s.backend.List(ctx, list)
+	if err != nil {
+		return nil, err
+	}
+	var ret []noncurrent
+	ids := make(map[string]string)
+	for _, file := range files {
+		rest := strings.TrimPrefix(file.Name, versionsPrefix)
+		// the ID never holds a slash, though the key may
+		i := strings.LastIndexByte(rest, '/')
+		if i < 0 {
+			continue
+		}
+		key := rest[:i]
+		if exact && key != prefix || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		ids[file.Name] = rest[i+1:]
+		ret = append(ret, noncurrent{Version: describe(file, key, status), stored: file.Name})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Name != ret[j].Name {
+			return ret[i].Name < ret[j].Name
+		}
+		return ids[ret[i].stored] > ids[ret[j].stored]
+	})
+	return ret, nil
+}
+
+// retire moves the current version file of its key under versionsPrefix,
+// returning where it went.
+func (s *Store) retire(ctx context.Context, file lgpd.File) (string, error) {
+	id := file.UserMeta[versionMeta]
+	if id == "" {
+		id = s.newID()
+	}
+	stored := versionsPrefix + file.Name + "/" + id
+	return stored, s.backend.Rename(ctx, file.Name, stored)
+}
+
+// dropNull deletes the noncurrent null version of key, if there is one.
+func (s *Store) dropNull(ctx context.Context, status, key string) error {
+	history, err := s.history(ctx, status, key, true)
+	if err != nil {
+		return err
+	}
+	for _, v := range history {
+		if v.VersionID == NullVersion {
+			if err := s.backend.Delete(ctx, v.stored); err != nil && !errors.Is(err, lgpd.ErrNotFound) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replace makes way for a new current version of key and has write store
+// it under the version ID it is given, which replace then returns. moved
+// is where the version replaced went, or "" if it is still under key for
+// write to overwrite. The caller holds the lock of key.
+func (s *Store) replace(ctx context.Context, status, key string, write func(id, moved string) error) (string, error) {
+	if status == Unversioned {
+		return Unversioned, write(Unversioned, "")
+	}
+	current, err := s.backend.Stat(ctx, key)
+	exists := err == nil
+	if err != nil && !errors.Is(err, lgpd.ErrNotFound) {
+		return "", err
+	}
+	id := NullVersion
+	moved := ""
+	if status == Suspended {
+		if err := s.dropNull(ctx, status, key); err != nil {
+			return "", err
+		}
+	}
+	// a null version is replaced rather than kept while suspended
+	if exists && (status == Enabled || current.UserMeta[versionMeta] != "") {
+		if moved, err = s.retire(ctx, current); err != nil {
+			return "", err
+		}
+	}
+	if status == Enabled {
+		// taken after retiring, which may use an ID of its own
+		id = s.newID()
+	}
+	if err := write(id, moved); err != nil {
+		if moved != "" {
+			s.backend.Rename(ctx, moved, key)
+		}
+		return "", err
+	}
+	return id, nil
+}
+
+// lookup finds the version id of key, returning where it is stored.
+func (s *Store) lookup(ctx context.Context, status, key, id string) (string, Version, error) {
+	current, err := s.backend.Stat(ctx, key)
+	exists := err == nil
+	if exists && versionOf(current) == id {
+		v := describe(current, key, status)
+		v.IsLatest = true
+		return key, v, nil
+	}
+	if err != nil && !errors.Is(err, lgpd.ErrNotFound) {
+		return "", Version{}, err
+	}
+	history, err := s.history(ctx, status, key, true)
+	if err != nil {
+		return "", Version{}, err
+	}
+	for i, v := range history {
+		if v.VersionID == id {
+			v.IsLatest = i == 0 && !exists
+			return v.stored, v.Version, nil
+		}
+	}
+	return "", Version{}, lgpd.ErrNotFound
+}
+
+// promote makes the newest noncurrent version of key current again, when
+// key has no current version and that version is not a delete marker.
+func (s *Store) promote(ctx context.Context, status, key string) error {
+	_, err := s.backend.Stat(ctx, key)
+	if err == nil || !errors.Is(err, lgpd.ErrNotFound) {
+		return err
+	}
+	history, err := s.history(ctx, status, key, true)
+	if err != nil || len(history) == 0 || history[0].DeleteMarker {
+		return err
+	}
+	return s.backend.Rename(ctx, history[0].stored, key)
+}
+
+func (s *Store) Get(ctx context.Context, key string, nofetch bool) ([]byte, lgpd.File, error) {
+	if reserved(key) {
+		return nil, lgpd.File{Name: key}, lgpd.ErrNotFound
+	}
+	status, err := s.Status(ctx)
+	if err != nil {
+		return nil, lgpd.File{}, err
+	}
+	value, file, err := s.backend.Get(ctx, key, nofetch)
+	return value, describe(file, key, status).File, err
+}
+
+func (s *Store) GetS(ctx context.Context, key string, nofetch bool) (io.ReadCloser, lgpd.File, error) {
+	if reserved(key) {
+		return nil, lgpd.File{Name: key}, lgpd.ErrNotFound
+	}
+	status, err := s.Status(ctx)
+	if err != nil {
+		return nil, lgpd.File{}, err
+	}
+	body, file, err := s.backend.GetS(ctx, key, nofetch)
+	return body, describe(file, key, status).File, err
+}
+
+func (s *Store) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, lgpd.File, error) {
+	if reserved(key) {
+		return nil, lgpd.File{Name: key}, lgpd.ErrNotFound
+	}
+	status, err := s.Status(ctx)
+	if err != nil {
+		return nil, lgpd.File{}, err
+	}
+	body, file, err := s.backend.GetRange(ctx, key, offset, length)
+	return body, describe(file, key, status).File, err
+}
+
+func (s *Store) Stat(ctx context.Context, key string) (lgpd.File, error) {
+	if reserved(key) {
+		return lgpd.File{Name: key}, lgpd.ErrNotFound
+	}
+	status, err := s.Status(ctx)
+	if err != nil {
+		return lgpd.File{}, err
+	}
+	file, err := s.backend.Stat(ctx, key)
+	return describe(file, key, status).File, err
+}
+
+// List lists the current versions only.
+func (s *Store) List(ctx context.Context, perfix string) ([]lgpd.File, error) {
+	status, err := s.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.backend.List(ctx, perfix)
+	if err != nil {
+		return nil, err
+	}
+	var ret []lgpd.File
+	for _, file := range files {
+		if !reserved(file.Name) {
+			ret = append(ret, describe(file, file.Name, status).File)
+		}
+	}
+	return ret, nil
+}
+
+func (s *Store) Put(ctx context.Context, key string, value []byte) error {
+	return s.PutS(ctx, key, bytes.NewReader(value), int64(len(value)), lgpd.Metadata{})
+}
+
+func (s *Store) PutS(ctx context.Context, key string, value io.Reader, size int64, meta lgpd.Metadata) error {
+	_, err := s.PutVersion(ctx, key, value, size, meta)
+	return err
+}
+
+// PutVersion is PutS returning the version ID the object was stored as,
+// which is empty while the bucket is Unversioned.
+func (s *Store) PutVersion(ctx context.Context, key string, value io.Reader, size int64, meta lgpd.Metadata) (string, error) {
+	if reserved(key) {
+		return "", ErrReservedKey
+	}
+	s.mode.RLock()
+	defer s.mode.RUnlock()
+	status, err := s.Status(ctx)
+	if err != nil {
+		return "", err
+	}
+	unlock := s.lock(key)
+	defer unlock()
+	return s.replace(ctx, status, key, func(id, moved string) error {
+		return s.backend.PutS(ctx, key, value, size, stamp(meta, id))
+	})
+}
+
+// Copy makes a new current version of dst with the content of the current
+// version of src, described by meta.
+func (s *Store) Copy(ctx context.Context, src, dst string, meta lgpd.Metadata) error {
+	_, err := s.CopyVersion(ctx, src, dst, meta)
+	return err
+}
+
+// CopyVersion is Copy returning the version ID the copy was stored as,
+// which is empty while the bucket is Unversioned.
+func (s *Store) CopyVersion(ctx context.Context, src, dst string, meta lgpd.Metadata) (string, error) {
+	if reserved(src) {
+		return "", lgpd.ErrNotFound
+	}
+	if reserved(dst) {
+		return "", ErrReservedKey
+	}
+	s.mode.RLock()
+	defer s.mode.RUnlock()
+	status, err := s.Status(ctx)
+	if err != nil {
+		return "", err
+	}
+	unlock := s.lock(src, dst)
+	defer unlock()
+	return s.replace(ctx, status, dst, func(id, moved string) error {
+		from := src
+		if src == dst && moved != "" {
+			from = moved
+		}
+		return lgpd.Copy(ctx, s.backend, from, s.backend, dst, stamp(meta, id))
+	})
+}
+
+// CheckMetadata lets the backend turn meta down, leaving room for the
+// version ID it is stored with.
+func (s *Store) CheckMetadata(meta lgpd.Metadata) error {
+	return lgpd.CheckMetadata(s.backend, stamp(meta, strings.Repeat("0", 16)))
+}
+
+// Delete removes the current version of key. Once versioning has been
+// enabled, a delete marker takes its place and it is kept.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	_, err := s.remove(ctx, key, "", true)
+	return err
+}
+
+// DeleteIf does what Delete does if match holds for the current version of
+// key, reporting whether it did. Writes to key wait while match is asked,
+// so the version deleted is the one match saw.
+func (s *Store) DeleteIf(ctx context.Context, key string, match func(lgpd.File) bool) (bool, error) {
+	if reserved(key) {
+		return false, lgpd.ErrNotFound
+	}
+	s.mode.RLock()
+	defer s.mode.RUnlock()
+	status, err := s.Status(ctx)
+	if err != nil {
+		return false, err
+	}
+	unlock := s.lock(key)
+	defer unlock()
+	current, err := s.backend.Stat(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if !match(describe(current, key, status).File) {
+		return false, nil
+	}
+	if status == Unversioned {
+		return true, s.backend.Delete(ctx, key)
+	}
+	_, err = s.mark(ctx, status, key)
+	return true, err
+}
+
+// DeleteBatch deletes each of keys as Delete does. While the bucket is
+// Unversioned no version is kept, so they go to the backend as one batch.
+func (s *Store) DeleteBatch(ctx context.Context, keys []string) []error {
+	errs := make([]error, len(keys))
+	s.mode.RLock()
+	status, err := s.Status(ctx)
+	if err != nil || status != Unversioned {
+		s.mode.RUnlock()
+		for i, key := range keys {
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			errs[i] = s.Delete(ctx, key)
+		}
+		return errs
+	}
+	defer s.mode.RUnlock()
+	var batch []string
+	var index []int
+	for i, key := range keys {
+		if reserved(key) {
+			errs[i] = lgpd.ErrNotFound
+			continue
+		}
+		batch = append(batch, key)
+		index = append(index, i)
+	}
+	for j, err := range lgpd.DeleteBatch(ctx, s.backend, batch) {
+		errs[index[j]] = err
+	}
+	return errs
+}
+
+// Remove deletes the version versionID of key for good, or, with an empty
+// versionID, does what Delete does, except that it leaves a delete marker
+// even where there was no current version, as S3 does. It returns the
+// version deleted or the delete marker made.
+func (s *Store) Remove(ctx context.Context, key, versionID string) (Version, error) {
+	return s.remove(ctx, key, versionID, false)
+}
+
+// remove is Remove, failing with lgpd.ErrNotFound instead of leaving a
+// delete marker in place of nothing when current is set.
+func (s *Store) remove(ctx context.Context, key, versionID string, current bool) (Version, error) {
+	if reserved(key) {
+		return Version{}, lgpd.ErrNotFound
+	}
+	if versionID != "" && !validID(versionID) {
+		return Version{}, ErrInvalidVersion
+	}
+	s.mode.RLock()
+	defer s.mode.RUnlock()
+	status, err := s.Status(ctx)
+	if err != nil {
+		return Version{}, err
+	}
+	if versionID == "" && status == Unversioned {
+		return Version{}, s.backend.Delete(ctx, key)
+	}
+	unlock := s.lock(key)
+	defer unlock()
+	if versionID == "" {
+		if current {
+			if _, err := s.backend.Stat(ctx, key); err != nil {
+				return Version{}, err
+			}
+		}
+		return s.mark(ctx, status, key)
+	}
+	stored, v, err := s.lookup(ctx, status, key, versionID)
+	if err != nil {
+		return Version{}, err
+	}
+	if err := s.backend.Delete(ctx, stored); err != nil {
+		return Version{}, err
+	}
+	return v, s.promote(ctx, status, key)
+}
+
+// mark puts a delete marker in place of the current version of key. The
+// caller holds the lock of key.
+func (s *Store) mark(ctx context.Context, status, key string) (Version, error) {
+	id, err := s.replace(ctx, status, key, func(id, moved string) error {
+		if moved == "" {
+			// the null version, which suspended versioning does not keep
+			if err := s.backend.Delete(ctx, key); err != nil && !errors.Is(err, lgpd.ErrNotFound) {
+				return err
+			}
+		}
+		stored := id
+		if id == NullVersion {
+			stored = s.newID()
+		}
+		meta := stamp(lgpd.Metadata{}, id)
+		if meta.UserMeta == nil {
+			meta.UserMeta = make(map[string]string)
+		}
+		meta.UserMeta[markerMeta] = "true"
+		return s.backend.PutS(ctx, versionsPrefix+key+"/"+stored, bytes.NewReader(nil), 0, meta)
+	})
+	if err != nil {
+		return Version{}, err
+	}
+	return Version{File: lgpd.File{Name: key, VersionID: id}, IsLatest: true, DeleteMarker: true}, nil
+}
+
+// Rename gives the current version of oldkey to newkey. Once versioning
+// has been enabled, that makes a new version of newkey and leaves a delete
+// marker on oldkey.
+func (s *Store) Rename(ctx context.Context, oldkey, newkey string) error {
+	if reserved(oldkey) {
+		return lgpd.ErrNotFound
+	}
+	if reserved(newkey) {
+		return ErrReservedKey
+	}
+	s.mode.RLock()
+	defer s.mode.RUnlock()
+	status, err := s.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if status == Unversioned {
+		return s.backend.Rename(ctx, oldkey, newkey)
+	}
+	unlock := s.lock(oldkey, newkey)
+	defer unlock()
+	current, err := s.backend.Stat(ctx, oldkey)
+	if err != nil || oldkey == newkey {
+		return err
+	}
+	_, err = s.replace(ctx, status, newkey, func(id, moved string) error {
+		return lgpd.Copy(ctx, s.backend, oldkey, s.backend, newkey, stamp(current.Metadata, id))
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.mark(ctx, status, oldkey)
+	return err
+}
+
+// Versions lists every version and delete marker of the keys starting
+// with prefix, by key and newest first.
+func (s *Store) Versions(ctx context.Context, prefix string) ([]Version, error) {
+	status, err := s.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.backend.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	history, err := s.history(ctx, status, prefix, false)
+	if err != nil {
+		return nil, err
+	}
+	var ret []Version
+	current := make(map[string]bool)
+	for _, file := range files {
+		if reserved(file.Name) {
+			continue
+		}
+		v := describe(file, file.Name, status)
+		v.IsLatest = true
+		current[file.Name] = true
+		ret = append(ret, v)
+	}
+	for i, v := range history {
+		v.IsLatest = !current[v.Name] && (i == 0 || history[i-1].Name != v.Name)
+		ret = append(ret, v.Version)
+	}
+	// stable, so each current version stays ahead of the older ones
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
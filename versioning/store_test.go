@@ -0,0 +1,296 @@
+package versioning
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/xiaokangwang/s3emu/backend/memory"
+	"github.com/xiaokangwang/s3emu/lgpd"
+	"github.com/xiaokangwang/s3emu/lgpd/lgpdtest"
+)
+
+func TestConformance(t *testing.T) {
+	for _, status := range []string{Unversioned, Enabled, Suspended} {
+		status := status
+		name := status
+		if name == Unversioned {
+			name = "Unversioned"
+		}
+		t.Run(name, func(t *testing.T) {
+			lgpdtest.RunConformance(t, func(t *testing.T) lgpd.LGPD {
+				store := New(memory.NewMemoryBackend(0, 0))
+				if status != Unversioned {
+					if err := store.SetStatus(context.Background(), status); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return store
+			})
+		})
+	}
+}
+
+// batchBackend counts the batches deleted from it.
+type batchBackend struct {
+	lgpd.LGPD
+	batches int
+}
+
+func (b *batchBackend) DeleteBatch(ctx context.Context, keys []string) []error {
+	b.batches++
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = b.Delete(ctx, key)
+	}
+	return errs
+}
+
+func TestDeleteBatch(t *testing.T) {
+	ctx := context.Background()
+	backend := &batchBackend{LGPD: memory.NewMemoryBackend(0, 0)}
+	store := New(backend)
+	for _, key := range []string{"a", "b"} {
+		if err := store.Put(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := lgpd.DeleteBatch(ctx, store, []string{"a", "b", statusKey})
+	if errs[0] != nil || errs[1] != nil || !errors.Is(errs[2], lgpd.ErrNotFound) {
+		t.Fatalf("DeleteBatch = %v", errs)
+	}
+	if backend.batches != 1 {
+		t.Fatalf("an Unversioned store made %d batches, want 1", backend.batches)
+	}
+
+	// once versions are kept, each key gets its delete marker
+	if err := store.SetStatus(ctx, Enabled); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, "c", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if errs := store.DeleteBatch(ctx, []string{"c"}); errs[0] != nil {
+		t.Fatalf("DeleteBatch = %v", errs)
+	}
+	versions, err := store.Versions(ctx, "c")
+	if err != nil || len(versions) != 2 || !versions[0].DeleteMarker {
+		t.Fatalf("Versions after DeleteBatch = %+v, %v", versions, err)
+	}
+	if backend.batches != 1 {
+		t.Fatalf("a versioned store made %d batches, want 1", backend.batches)
+	}
+}
+
+func TestDeleteIf(t *testing.T) {
+	ctx := context.Background()
+	store := New(memory.NewMemoryBackend(0, 0))
+	if err := store.Put(ctx, "a", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	listed, err := store.Stat(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	same := func(current lgpd.File) bool { return current.Mark == listed.Mark }
+
+	if err := store.Put(ctx, "a", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := store.DeleteIf(ctx, "a", same); deleted || err != nil {
+		t.Fatalf("DeleteIf of a rewritten key = %v, %v", deleted, err)
+	}
+	if _, err := store.Stat(ctx, "a"); err != nil {
+		t.Fatalf("the rewritten key is gone: %v", err)
+	}
+
+	if err := store.SetStatus(ctx, Enabled); err != nil {
+		t.Fatal(err)
+	}
+	listed, _ = store.Stat(ctx, "a")
+	if deleted, err := store.DeleteIf(ctx, "a", same); !deleted || err != nil {
+		t.Fatalf("DeleteIf of an unchanged key = %v, %v", deleted, err)
+	}
+	versions, err := store.Versions(ctx, "a")
+	if err != nil || len(versions) != 2 || !versions[0].DeleteMarker {
+		t.Fatalf("Versions after DeleteIf = %+v, %v", versions, err)
+	}
+	if _, err := store.DeleteIf(ctx, "missing", same); !errors.Is(err, lgpd.ErrNotFound) {
+		t.Fatalf("DeleteIf of a missing key: %v, want lgpd.ErrNotFound", err)
+	}
+}
+
+// putVersion writes value to key, returning its version ID.
+func putVersion(t *testing.T, store *Store, key, value string) string {
+	t.Helper()
+	id, err := store.PutVersion(context.Background(), key, strings.NewReader(value), int64(len(value)), lgpd.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// read returns the content of version id of key.
+func read(t *testing.T, store *Store, key, id string) string {
+	t.Helper()
+	value, _, err := store.At(id).Get(context.Background(), key, false)
+	if err != nil {
+		t.Fatalf("reading version %s of %s: %v", id, key, err)
+	}
+	return string(value)
+}
+
+func TestSuspendedReplacesNull(t *testing.T) {
+	ctx := context.Background()
+	store := New(memory.NewMemoryBackend(0, 0))
+	putVersion(t, store, "a", "unversioned")
+	if err := store.SetStatus(ctx, Enabled); err != nil {
+		t.Fatal(err)
+	}
+	kept := putVersion(t, store, "a", "enabled")
+	if err := store.SetStatus(ctx, Suspended); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"suspended", "suspended again"} {
+		if id := putVersion(t, store, "a", value); id != NullVersion {
+			t.Fatalf("a suspended put made version %q, want %q", id, NullVersion)
+		}
+	}
+
+	versions, err := store.Versions(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].VersionID != NullVersion || !versions[0].IsLatest ||
+		versions[1].VersionID != kept || versions[1].IsLatest {
+		t.Fatalf("Versions = %+v, want the null version then %s", versions, kept)
+	}
+	if got := read(t, store, "a", NullVersion); got != "suspended again" {
+		t.Fatalf("the null version holds %q", got)
+	}
+	if got := read(t, store, "a", kept); got != "enabled" {
+		t.Fatalf("version %s holds %q", kept, got)
+	}
+}
+
+func TestDeleteMarker(t *testing.T) {
+	ctx := context.Background()
+	store := New(memory.NewMemoryBackend(0, 0))
+	if err := store.SetStatus(ctx, Enabled); err != nil {
+		t.Fatal(err)
+	}
+	id := putVersion(t, store, "a", "value")
+	if err := store.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(ctx, "a"); !errors.Is(err, lgpd.ErrNotFound) {
+		t.Fatalf("Stat of a deleted key: %v, want lgpd.ErrNotFound", err)
+	}
+	if files, err := store.List(ctx, ""); err != nil || len(files) != 0 {
+		t.Fatalf("List after Delete = %+v, %v", files, err)
+	}
+
+	versions, err := store.Versions(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || !versions[0].DeleteMarker || !versions[0].IsLatest ||
+		versions[1].VersionID != id || versions[1].IsLatest {
+		t.Fatalf("Versions = %+v, want a delete marker then %s", versions, id)
+	}
+	marker := versions[0].VersionID
+	if _, err := store.At(marker).Stat(ctx, "a"); !errors.Is(err, ErrDeleteMarker) {
+		t.Fatalf("Stat of the delete marker: %v, want ErrDeleteMarker", err)
+	}
+	if got := read(t, store, "a", id); got != "value" {
+		t.Fatalf("version %s holds %q", id, got)
+	}
+
+	// removing the delete marker brings the version back
+	removed, err := store.Remove(ctx, "a", marker)
+	if err != nil || !removed.DeleteMarker {
+		t.Fatalf("Remove of the delete marker = %+v, %v", removed, err)
+	}
+	if value, _, err := store.Get(ctx, "a", false); err != nil || string(value) != "value" {
+		t.Fatalf("Get after removing the delete marker = %q, %v", value, err)
+	}
+}
+
+func TestRemovePromotes(t *testing.T) {
+	ctx := context.Background()
+	store := New(memory.NewMemoryBackend(0, 0))
+	if err := store.SetStatus(ctx, Enabled); err != nil {
+		t.Fatal(err)
+	}
+	first := putVersion(t, store, "a", "first")
+	second := putVersion(t, store, "a", "second")
+	// versions of a key below a are kept apart from those of a
+	child := putVersion(t, store, "a/b", "child")
+
+	if _, err := store.Remove(ctx, "a", second); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, err := store.Get(ctx, "a", false); err != nil || string(value) != "first" {
+		t.Fatalf("Get after removing the current version = %q, %v", value, err)
+	}
+	if _, err := store.At(second).Stat(ctx, "a"); !errors.Is(err, lgpd.ErrNotFound) {
+		t.Fatalf("Stat of a removed version: %v, want lgpd.ErrNotFound", err)
+	}
+	if _, err := store.Remove(ctx, "a", first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(ctx, "a"); !errors.Is(err, lgpd.ErrNotFound) {
+		t.Fatalf("Stat after removing every version: %v, want lgpd.ErrNotFound", err)
+	}
+	if _, err := store.At(child).Stat(ctx, "a"); !errors.Is(err, lgpd.ErrNotFound) {
+		t.Fatalf("a version of a/b was found as one of a: %v", err)
+	}
+	if got := read(t, store, "a/b", child); got != "child" {
+		t.Fatalf("version %s of a/b holds %q", child, got)
+	}
+}
+
+func TestVersionsOrder(t *testing.T) {
+	ctx := context.Background()
+	store := New(memory.NewMemoryBackend(0, 0))
+	if err := store.SetStatus(ctx, Enabled); err != nil {
+		t.Fatal(err)
+	}
+	b1 := putVersion(t, store, "b", "1")
+	a1 := putVersion(t, store, "a", "1")
+	a2 := putVersion(t, store, "a", "2")
+	ab1 := putVersion(t, store, "a/b", "1")
+	b2 := putVersion(t, store, "b", "2")
+	a3 := putVersion(t, store, "a", "3")
+	ab2 := putVersion(t, store, "a/b", "2")
+
+	versions, err := store.Versions(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		key, id string
+		latest  bool
+	}{
+		{"a", a3, true}, {"a", a2, false}, {"a", a1, false},
+		{"a/b", ab2, true}, {"a/b", ab1, false},
+		{"b", b2, true}, {"b", b1, false},
+	}
+	if len(versions) != len(want) {
+		t.Fatalf("Versions = %+v, want %d versions", versions, len(want))
+	}
+	for i, w := range want {
+		v := versions[i]
+		if v.Name != w.key || v.VersionID != w.id || v.IsLatest != w.latest {
+			t.Fatalf("version %d is %s@%s latest=%v, want %s@%s latest=%v", i, v.Name, v.VersionID, v.IsLatest, w.key, w.id, w.latest)
+		}
+	}
+
+	// a prefix takes in the keys under it, and only those
+	versions, err = store.Versions(ctx, "a/")
+	if err != nil || len(versions) != 2 || versions[0].VersionID != ab2 || versions[1].VersionID != ab1 {
+		t.Fatalf("Versions(a/) = %+v, %v", versions, err)
+	}
+}
@@ -0,0 +1,103 @@
+package versioning
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/xiaokangwang/s3emu/lgpd"
+)
+
+// errEarlierVersion is what a view from At answers anything but a read
+// with.
+var errEarlierVersion = errors.New("versioning: a single version can only be read")
+
+// At returns a read-only view of s in which every key holds its version
+// versionID. Reading a key that has no such version fails with
+// lgpd.ErrNotFound, and one whose version is a delete marker with
+// ErrDeleteMarker.
+func (s *Store) At(versionID string) lgpd.LGPD {
+	return &version{s: s, id: versionID}
+}
+
+type version struct {
+	s  *Store
+	id string
+}
+
+// open finds the version of key and hands read the name it is stored
+// under, holding the lock of key so that it stays there until read has
+// opened it.
+func (v *version) open(ctx context.Context, key string, read func(stored string) error) (lgpd.File, error) {
+	if !validID(v.id) {
+		return lgpd.File{Name: key}, ErrInvalidVersion
+	}
+	if reserved(key) {
+		return lgpd.File{Name: key}, lgpd.ErrNotFound
+	}
+	status, err := v.s.Status(ctx)
+	if err != nil {
+		return lgpd.File{Name: key}, err
+	}
+	unlock := v.s.lock(key)
+	defer unlock()
+	stored, found, err := v.s.lookup(ctx, status, key, v.id)
+	if err != nil {
+		return lgpd.File{Name: key}, err
+	}
+	if found.DeleteMarker {
+		return found.File, ErrDeleteMarker
+	}
+	return found.File, read(stored)
+}
+
+func (v *version) Get(ctx context.Context, key string, nofetch bool) ([]byte, lgpd.File, error) {
+	var value []byte
+	file, err := v.open(ctx, key, func(stored string) (err error) {
+		value, _, err = v.s.backend.Get(ctx, stored, nofetch)
+		return err
+	})
+	return value, file, err
+}
+
+func (v *version) GetS(ctx context.Context, key string, nofetch bool) (io.ReadCloser, lgpd.File, error) {
+	var body io.ReadCloser
+	file, err := v.open(ctx, key, func(stored string) (err error) {
+		body, _, err = v.s.backend.GetS(ctx, stored, nofetch)
+		return err
+	})
+	return body, file, err
+}
+
+func (v *version) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, lgpd.File, error) {
+	var body io.ReadCloser
+	file, err := v.open(ctx, key, func(stored string) (err error) {
+		body, _, err = v.s.backend.GetRange(ctx, stored, offset, length)
+		return err
+	})
+	return body, file, err
+}
+
+func (v *version) Stat(ctx context.Context, key string) (lgpd.File, error) {
+	return v.open(ctx, key, func(string) error { return nil })
+}
+
+func (v *version) Put(ctx context.Context, key string, value []byte) error {
+	return errEarlierVersion
+}
+
+func (v *version) PutS(ctx context.Context, key string, value io.Reader, size int64, meta lgpd.Metadata) error {
+	return errEarlierVersion
+}
+
+func (v *version) List(ctx context.Context, perfix string) ([]lgpd.File, error) {
+	return nil, errEarlierVersion
+}
+
+func (v *version) Delete(ctx context.Context, key string) error {
+	return errEarlierVersion
+}
+
+func (v *version) Rename(ctx context.Context, oldkey, newkey string) error {
+	return errEarlierVersion
+}